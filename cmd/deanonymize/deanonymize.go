@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/wontoniii/traffic-anonymization/pkg/anonymization"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+// packetSource is implemented by both the pcap and pcapng readers
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// Deanonymizer reverses addresses anonymized with a given epoch key
+type Deanonymizer struct {
+	ctx *anonymization.Cryptopan
+	// Only addresses whose original value is in one of these networks are
+	// rewritten, the other ones were not anonymized
+	nets []*net.IPNet
+}
+
+// Deanonymize returns the original address, or addr itself if the original
+// address is not in one of the configured networks
+func (d *Deanonymizer) Deanonymize(addr net.IP) net.IP {
+	orig := d.ctx.Deanonymize(addr)
+	if !network.IsPrivateIP(d.nets, orig) {
+		return addr
+	}
+	return orig
+}
+
+func (d *Deanonymizer) deanonymizeCSV(fname string, columns []int, header bool) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	w := csv.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	for line := 0; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !(header && line == 0) {
+			for _, c := range columns {
+				if c >= len(record) {
+					continue
+				}
+				if addr := net.ParseIP(strings.TrimSpace(record[c])); addr != nil {
+					record[c] = d.Deanonymize(addr).String()
+				}
+			}
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+}
+
+func openPacketSource(fname string) (*os.File, packetSource, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions); err == nil {
+		return f, r, nil
+	}
+	// Not a pcapng file, try the legacy pcap format
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, r, nil
+}
+
+func (d *Deanonymizer) deanonymizePcap(in, out string) error {
+	f, r, err := openPacketSource(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	of, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer of.Close()
+	w, err := pcapgo.NewNgWriter(of, r.LinkType())
+	if err != nil {
+		return err
+	}
+	defer w.Flush()
+
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		anonymization.RewriteAddresses(data, r.LinkType(), d.Deanonymize)
+		ci.InterfaceIndex = 0
+		if err := w.WritePacket(ci, data); err != nil {
+			return err
+		}
+	}
+}
+
+func parseColumns(columns string) ([]int, error) {
+	var ret []int
+	for _, c := range strings.Split(columns, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid column %q", c)
+		}
+		ret = append(ret, n-1)
+	}
+	return ret, nil
+}
+
+func main() {
+	keyFile := flag.String("key", "", "Key file of the epoch to reverse, or master secret if -derive is set")
+	derive := flag.Bool("derive", false, "Derive the epoch key from the master secret in -key")
+	algorithm := flag.String("algorithm", "cryptopan", "Algorithm used to anonymize the addresses: cryptopan or cryptopan-msb")
+	epoch := flag.String("epoch", "", "Identifier of the epoch to reverse. Required with -derive")
+	nets := flag.String("nets", "", "Comma separated networks whose addresses were anonymized, e.g. the local networks. Only addresses whose original value is in one of them are rewritten. Required")
+	csvFile := flag.String("csv", "", "CSV file to de-anonymize. The result is written to stdout")
+	columns := flag.String("columns", "1", "Comma separated CSV columns containing addresses, starting from 1")
+	header := flag.Bool("header", false, "Do not rewrite the first line of the CSV file")
+	pcapFile := flag.String("pcap", "", "pcap or pcapng file to de-anonymize")
+	out := flag.String("out", "", "pcapng file to create with the de-anonymized packets")
+	flag.Parse()
+
+	formatter := &log.TextFormatter{
+		FullTimestamp: true,
+	}
+	log.SetFormatter(formatter)
+
+	if *keyFile == "" {
+		log.Fatal("A key file is required")
+	}
+	kf, key, err := anonymization.ReadKeyFile(*keyFile)
+	if err != nil {
+		log.Fatalf("Could not load the key: %s", err)
+	}
+	epochID := kf.EpochID
+	if *derive {
+		if *epoch == "" {
+			log.Fatal("An epoch is required to derive the key")
+		}
+		epochID = *epoch
+		key = anonymization.DeriveEpochKey(key, epochID)
+	} else if *epoch != "" && kf.EpochID != "" && *epoch != kf.EpochID {
+		log.Fatalf("The key file belongs to epoch %s, not %s", kf.EpochID, *epoch)
+	}
+
+	d := &Deanonymizer{}
+	switch *algorithm {
+	case anonymization.AlgorithmCryptoPAn:
+		d.ctx, err = anonymization.NewCryptoPAn(key)
+	case anonymization.AlgorithmCryptoPAnMSB:
+		d.ctx, err = anonymization.NewCryptoPAnFixedMSB(key)
+	default:
+		log.Fatalf("Addresses anonymized with %s can not be de-anonymized", *algorithm)
+	}
+	if err != nil {
+		log.Fatalf("Error initializing crypto module: %s", err)
+	}
+	// Addresses that were kept, by the policy or as passthrough traffic,
+	// would be garbled by the inversion
+	if *nets == "" {
+		log.Fatal("The networks whose addresses were anonymized are required")
+	}
+	for _, n := range strings.Split(*nets, ",") {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(n))
+		if err != nil {
+			log.Fatalf("Invalid network %s", n)
+		}
+		d.nets = append(d.nets, ipnet)
+	}
+
+	// Leave a trace of every use of the tool
+	if epochID == "" {
+		epochID = "unknown"
+	}
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	log.Warnf("De-anonymization of epoch %s requested by user %s", epochID, username)
+
+	if *csvFile != "" {
+		cols, err := parseColumns(*columns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := d.deanonymizeCSV(*csvFile, cols, *header); err != nil {
+			log.Fatalf("Could not de-anonymize %s: %s", *csvFile, err)
+		}
+	} else if *pcapFile != "" {
+		if *out == "" {
+			log.Fatal("An output file is required to de-anonymize a pcap")
+		}
+		if err := d.deanonymizePcap(*pcapFile, *out); err != nil {
+			log.Fatalf("Could not de-anonymize %s: %s", *pcapFile, err)
+		}
+	} else {
+		for _, a := range flag.Args() {
+			addr := net.ParseIP(a)
+			if addr == nil {
+				log.Errorf("Invalid address %s", a)
+				continue
+			}
+			fmt.Printf("%s %s\n", a, d.Deanonymize(addr))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/wontoniii/traffic-anonymization/pkg/anonymization"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: escrow <genkey|list|unseal> [flags]")
+	fmt.Fprintln(os.Stderr, "  genkey -out <prefix>    create <prefix>.pub and <prefix>.key")
+	fmt.Fprintln(os.Stderr, "  list -archive <file>    list the entries of an archive")
+	fmt.Fprintln(os.Stderr, "  unseal -archive <file> -key <file> (-epoch <id>|-entry <n>) -out <file>")
+	os.Exit(2)
+}
+
+func writeFile(path string, data string, perm os.FileMode) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := f.WriteString(data + "\n"); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func genkey(args []string) {
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	out := fs.String("out", "escrow", "Prefix of the key files to create")
+	fs.Parse(args)
+
+	priv, err := anonymization.GenerateEscrowKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeFile(*out+".key", hex.EncodeToString(priv.Bytes()), 0600)
+	writeFile(*out+".pub", hex.EncodeToString(priv.PublicKey().Bytes()), 0644)
+	fmt.Printf("Created %s.pub (EscrowPublicKey) and %s.key. Store %s.key offline\n", *out, *out, *out)
+}
+
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	archive := fs.String("archive", "", "Escrow archive to read")
+	fs.Parse(args)
+
+	entries, err := anonymization.ReadEscrow(*archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%-6s %-26s %-26s %s\n", "ENTRY", "EPOCH", "START", "END")
+	for i, entry := range entries {
+		end := "-"
+		if !entry.End.IsZero() {
+			end = entry.End.Format("2006-01-02T15:04:05Z07:00")
+		}
+		fmt.Printf("%-6d %-26s %-26s %s\n", i, entry.EpochID, entry.Start.Format("2006-01-02T15:04:05Z07:00"), end)
+	}
+}
+
+func unseal(args []string) {
+	fs := flag.NewFlagSet("unseal", flag.ExitOnError)
+	archive := fs.String("archive", "", "Escrow archive to read")
+	keyFile := fs.String("key", "", "Escrow private key")
+	epoch := fs.String("epoch", "", "Epoch to unseal")
+	index := fs.Int("entry", -1, "Entry to unseal, as printed by list")
+	out := fs.String("out", "", "Key file to create, usable with deanonymize")
+	fs.Parse(args)
+
+	if *out == "" {
+		log.Fatal("An output file is required")
+	}
+	priv, err := anonymization.LoadEscrowPrivateKey(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := anonymization.ReadEscrow(*archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var entry *anonymization.EscrowEntry
+	if *index >= 0 {
+		if *index >= len(entries) {
+			log.Fatalf("The archive has only %d entries", len(entries))
+		}
+		entry = &entries[*index]
+	} else {
+		for i := range entries {
+			if entries[i].EpochID != *epoch {
+				continue
+			}
+			if entry != nil {
+				// Restarts with random keys produce several keys per epoch
+				log.Fatalf("Several entries for epoch %s, select one with -entry", *epoch)
+			}
+			entry = &entries[i]
+		}
+		if entry == nil {
+			log.Fatalf("No entry for epoch %s", *epoch)
+		}
+	}
+
+	key, err := entry.Unseal(priv)
+	if err != nil {
+		log.Fatalf("Could not unseal the key of epoch %s: %s", entry.EpochID, err)
+	}
+	kf := &anonymization.KeyFile{
+		EpochID: entry.EpochID,
+		Created: entry.Start,
+		Key:     hex.EncodeToString(key),
+	}
+	if err := anonymization.WriteKeyFile(*out, kf); err != nil {
+		log.Fatal(err)
+	}
+	log.Warnf("Unsealed the key of epoch %s into %s", entry.EpochID, *out)
+}
+
+func main() {
+	formatter := &log.TextFormatter{
+		FullTimestamp: true,
+	}
+	log.SetFormatter(formatter)
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "genkey":
+		genkey(os.Args[2:])
+	case "list":
+		list(os.Args[2:])
+	case "unseal":
+		unseal(os.Args[2:])
+	default:
+		usage()
+	}
+}
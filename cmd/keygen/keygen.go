@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/wontoniii/traffic-anonymization/pkg/anonymization"
+)
+
+func main() {
+	out := flag.String("out", "", "Key file to create. The file must not exist")
+	epoch := flag.String("epoch", "", "Identifier of the key epoch. If none is provided the creation time is used")
+	flag.Parse()
+
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "keygen: -out is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	epochID := *epoch
+	if epochID == "" {
+		epochID = time.Now().UTC().Format("20060102T150405Z")
+	}
+
+	kf := anonymization.NewKeyFile(epochID)
+	if err := anonymization.WriteKeyFile(*out, kf); err != nil {
+		fmt.Fprintf(os.Stderr, "keygen: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Created key for epoch %s in %s\n", kf.EpochID, *out)
+}
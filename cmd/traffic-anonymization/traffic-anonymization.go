@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -69,13 +71,202 @@ func loadConfig() config.SysConfig {
 	return conf
 }
 
+func toPorts(ports []int) ([]uint16, error) {
+	var ret []uint16
+	for _, port := range ports {
+		if port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", port)
+		}
+		ret = append(ret, uint16(port))
+	}
+	return ret, nil
+}
+
 func main() {
 	conf := loadConfig()
 
 	outb, _ := json.Marshal(conf)
 	log.Infof("Running with configuration:\n%s\n", outb)
 
-	amodule := anonymization.NewAModule("", conf.Misc.Anonymize, conf.Misc.PrivateNets, conf.Misc.LocalNets, conf.Misc.LoopTime)
+	var key []byte
+	var keyEpochID string
+	var rotation *anonymization.RotationPolicy
+	var escrow *anonymization.Escrow
+	var netAlgorithms []anonymization.NetAlgorithmSpec
+	var policy *anonymization.Policy
+	var checksums string
+	var macMode string
+	var extensions string
+	var sniMode string
+	var vlanMap map[uint16]uint16
+	if conf.Misc.Anonymize {
+		var err error
+		key, keyEpochID, err = anonymization.LoadKey(conf.Misc.KeyFile, conf.Misc.Key, conf.Misc.KeyEnv)
+		if err == anonymization.ErrNoKey {
+			key = nil
+		} else if err != nil {
+			log.Fatalf("Could not load the anonymization key: %s", err)
+		}
+		rotation, err = anonymization.ParseRotationPolicy(conf.Misc.Rotation, conf.Misc.LoopTime, conf.Misc.Timezone)
+		if err != nil {
+			log.Fatalf("Invalid key rotation: %s", err)
+		}
+		if key != nil && !conf.Misc.DeriveKeys && !rotation.Never() {
+			// A configured key is never replaced
+			if conf.Misc.Rotation != "" {
+				log.Fatalf("Rotation %s requires DeriveKeys when a key is configured", conf.Misc.Rotation)
+			}
+			rotation = &anonymization.RotationPolicy{Kind: anonymization.RotationNever, Location: rotation.Location}
+		}
+		if conf.Misc.EscrowArchive != "" {
+			escrow, err = anonymization.NewEscrow(conf.Misc.EscrowArchive, conf.Misc.EscrowPublicKey)
+			if err != nil {
+				log.Fatalf("Could not initialize the key escrow: %s", err)
+			}
+		}
+		for _, na := range conf.Misc.NetAlgorithms {
+			_, n, err := net.ParseCIDR(na.Net)
+			if err != nil {
+				log.Fatalf("Invalid network %s: %s", na.Net, err)
+			}
+			var prefix net.IP
+			if na.Prefix != "" {
+				if prefix = net.ParseIP(na.Prefix); prefix == nil {
+					log.Fatalf("Invalid prefix %s", na.Prefix)
+				}
+			}
+			netAlgorithms = append(netAlgorithms, anonymization.NetAlgorithmSpec{
+				Net: n,
+				AlgorithmSpec: anonymization.AlgorithmSpec{
+					Algorithm: na.Algorithm,
+					Bits:      na.TruncateBits,
+					Bits6:     na.TruncateBits6,
+					Prefix:    prefix,
+				},
+			})
+		}
+		if conf.Misc.PreserveLocalNets {
+			// Added last so that explicit algorithms for the same networks win
+			for _, n := range network.ToNets(conf.Misc.LocalNets) {
+				netAlgorithms = append(netAlgorithms, anonymization.NetAlgorithmSpec{
+					Net:           n,
+					AlgorithmSpec: anonymization.AlgorithmSpec{Algorithm: anonymization.AlgorithmSubnet},
+				})
+			}
+		}
+		var rules []anonymization.PolicyRule
+		for _, rc := range conf.Misc.Policy {
+			_, n, err := net.ParseCIDR(rc.Net)
+			if err != nil {
+				log.Fatalf("Invalid network %s: %s", rc.Net, err)
+			}
+			rule := anonymization.PolicyRule{
+				Net:      n,
+				Protocol: rc.Protocol,
+				Action:   rc.Action,
+				Truncate: anonymization.AlgorithmSpec{
+					Bits:  rc.TruncateBits,
+					Bits6: rc.TruncateBits6,
+				},
+			}
+			if rule.Ports, err = toPorts(rc.Ports); err != nil {
+				log.Fatalf("Invalid policy for network %s: %s", rc.Net, err)
+			}
+			rules = append(rules, rule)
+		}
+		if len(rules) > 0 {
+			if policy, err = anonymization.NewPolicy(rules); err != nil {
+				log.Fatalf("Invalid policy: %s", err)
+			}
+		}
+		if checksums, err = anonymization.ParseChecksumMode(conf.Misc.Checksums); err != nil {
+			log.Fatal(err)
+		}
+		if macMode, err = anonymization.ParseMACMode(conf.Misc.MACs); err != nil {
+			log.Fatal(err)
+		}
+		if extensions, err = anonymization.ParseExtensionsMode(conf.Misc.IPv6Extensions); err != nil {
+			log.Fatal(err)
+		}
+		if sniMode, err = anonymization.ParseSNIMode(conf.Misc.SNI); err != nil {
+			log.Fatal(err)
+		}
+		for _, vm := range conf.Misc.VLANMap {
+			if vm.From < 0 || vm.From > 4095 || vm.To < 0 || vm.To > 4095 {
+				log.Fatalf("Invalid VLAN mapping %d -> %d", vm.From, vm.To)
+			}
+			if vlanMap == nil {
+				vlanMap = make(map[uint16]uint16)
+			}
+			vlanMap[uint16(vm.From)] = uint16(vm.To)
+		}
+	}
+
+	// Payload rules and output handling also apply when passing packets through
+	var payloadRules []anonymization.PayloadRule
+	for _, pc := range conf.Misc.Payload {
+		rule := anonymization.PayloadRule{
+			Protocol:    pc.Protocol,
+			Application: pc.Application,
+			Mode:        pc.Mode,
+			Bytes:       pc.Bytes,
+		}
+		ports, err := toPorts(pc.Ports)
+		if err != nil {
+			log.Fatalf("Invalid payload rule: %s", err)
+		}
+		rule.Ports = ports
+		payloadRules = append(payloadRules, rule)
+	}
+	payload, err := anonymization.NewPayloadPolicy(payloadRules)
+	if err != nil {
+		log.Fatalf("Invalid payload rules: %s", err)
+	}
+	if conf.Misc.InPlace {
+		for _, inif := range conf.InIf {
+			// Zero copy packets are overwritten by the next read, while the
+			// writer may still hold them
+			if inif.ZeroCopy {
+				log.Fatalf("InPlace can not be used with the zero copy interface %s", inif.Ifname)
+			}
+		}
+	}
+
+	amodule := anonymization.NewAModule(anonymization.AModuleConfiguration{
+		Key:         key,
+		DeriveKeys:  conf.Misc.DeriveKeys,
+		KeyEpochID:  keyEpochID,
+		Anonymize:   conf.Misc.Anonymize,
+		PrivateNets: conf.Misc.PrivateNets,
+		LocalNets:   conf.Misc.LocalNets,
+		Rotation:    rotation,
+		Escrow:      escrow,
+		Algorithm: anonymization.AlgorithmSpec{
+			Algorithm: conf.Misc.Algorithm,
+			Bits:      conf.Misc.TruncateBits,
+			Bits6:     conf.Misc.TruncateBits6,
+		},
+		NetAlgorithms: netAlgorithms,
+		Policy:        policy,
+		Payload:       payload,
+		Checksums:     checksums,
+		InPlace:       conf.Misc.InPlace,
+		CacheSize:     conf.Misc.CacheSize,
+		StickyFlows:   conf.Misc.StickyFlows,
+		FlowTimeout:   time.Duration(conf.Misc.FlowTimeout) * time.Second,
+		MACMode:       macMode,
+
+		PreserveLinkLayer: conf.Misc.PreserveLinkLayer,
+		VLANMap:           vlanMap,
+		FragmentTimeout:   time.Duration(conf.Misc.FragmentTimeout) * time.Second,
+		Extensions:        extensions,
+		SNIMode:           sniMode,
+	})
+
+	if conf.OutIf.AlignEpochs && !amodule.Rotates() {
+		// The output would be a single file growing forever
+		log.Fatal("AlignEpochs requires anonymization with rotating keys")
+	}
 
 	var numInstances int = 0
 
@@ -121,6 +312,13 @@ func main() {
 
 	log.Infof("Starting with %d input interface instances", numInstances)
 
+	// Shared by all readers, as the fragments of a datagram may be read by
+	// different threads
+	var reassembler *network.Reassembler
+	if conf.Misc.Reassemble {
+		reassembler = network.NewReassembler(time.Duration(conf.Misc.FragmentTimeout) * time.Second)
+	}
+
 	// Initialize each instance
 	for i := 0; i < numInstances; i++ {
 		outnis[i] = new(network.NetworkInterface)
@@ -133,6 +331,9 @@ func main() {
 			ClusterID: conf.OutIf.ClusterID,
 			ZeroCopy:  conf.OutIf.ZeroCopy,
 			FanOut:    conf.OutIf.FanOut,
+
+			AlignEpochs: conf.OutIf.AlignEpochs,
+			Instance:    i,
 		}
 		outnis[i].NewNetworkInterface(ifconf)
 
@@ -155,6 +356,9 @@ func main() {
 
 		innis[i].NewNetworkInterface(ifconf)
 		readers[i] = network.NewReader(innis[i], anonymizers[i])
+		if reassembler != nil {
+			readers[i].SetReassembler(reassembler)
+		}
 		statsWriters[i] = stats.NewIfStatsPrinter(innis[i], fmt.Sprintf("inif_%s_%d", ifconf.Name, i))
 		statsWriters[i].Init()
 
@@ -167,8 +371,28 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGINT)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	var cacheStats *stats.CacheStatsPrinter
+	if conf.Misc.Anonymize && conf.Misc.CacheSize > 0 {
+		cacheStats = stats.NewCacheStatsPrinter(amodule, "amodule")
+		cacheStats.Init()
+		go cacheStats.Run()
+	}
+
+	var reassemblyStats *stats.ReassemblyStatsPrinter
+	if reassembler != nil {
+		reassemblyStats = stats.NewReassemblyStatsPrinter(reassembler, "reassembler")
+		reassemblyStats.Init()
+		go reassemblyStats.Run()
+	}
+
 	log.Infof("System running")
 	<-c
+	if cacheStats != nil {
+		cacheStats.Stop()
+	}
+	if reassemblyStats != nil {
+		reassemblyStats.Stop()
+	}
 	for i := 0; i < numInstances; i++ {
 		stops[i] <- struct{}{}
 		innis[i].IfHandle.Close()
@@ -0,0 +1,347 @@
+package anonymization
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	AlgorithmCryptoPAn    = "cryptopan"
+	AlgorithmCryptoPAnMSB = "cryptopan-msb"
+	AlgorithmHMAC         = "hmac"
+	AlgorithmTruncate     = "truncate"
+	AlgorithmPermutation  = "permutation"
+	AlgorithmSubnet       = "subnet"
+)
+
+const (
+	defaultTruncateBits     = 8
+	defaultTruncateBitsIPv6 = 64
+
+	hmacKeyInfo        = "traffic-anonymization hmac address key"
+	permutationKeyInfo = "traffic-anonymization permutation address key"
+)
+
+// AddressAnonymizer anonymizes IP addresses. Implementations must be safe for
+// concurrent use.
+type AddressAnonymizer interface {
+	Anonymize(addr net.IP) net.IP
+}
+
+// AlgorithmSpec selects an address anonymization algorithm.
+type AlgorithmSpec struct {
+	// One of the Algorithm* constants, cryptopan if empty
+	Algorithm string
+	// Number of low order IPv4 bits zeroed by truncate
+	Bits int
+	// Number of low order IPv6 bits zeroed by truncate
+	Bits6 int
+	// Prefix replacing the network prefix with subnet, nil to keep it
+	Prefix net.IP
+}
+
+// NetAlgorithmSpec selects the algorithm used for the addresses of a network.
+type NetAlgorithmSpec struct {
+	Net *net.IPNet
+	AlgorithmSpec
+}
+
+// Validate checks that the algorithm exists and fills in default values.
+func (spec *AlgorithmSpec) Validate() error {
+	spec.Algorithm = strings.ToLower(spec.Algorithm)
+	switch spec.Algorithm {
+	case "":
+		spec.Algorithm = AlgorithmCryptoPAn
+	case AlgorithmCryptoPAn, AlgorithmCryptoPAnMSB, AlgorithmHMAC, AlgorithmPermutation, AlgorithmSubnet:
+	case AlgorithmTruncate:
+		if spec.Bits == 0 {
+			spec.Bits = defaultTruncateBits
+		}
+		if spec.Bits6 == 0 {
+			spec.Bits6 = defaultTruncateBitsIPv6
+		}
+		if spec.Bits < 0 || spec.Bits > 32 || spec.Bits6 < 0 || spec.Bits6 > 128 {
+			return fmt.Errorf("invalid truncation of %d/%d bits", spec.Bits, spec.Bits6)
+		}
+	default:
+		return fmt.Errorf("unknown anonymization algorithm %q", spec.Algorithm)
+	}
+	return nil
+}
+
+// NewAddressAnonymizer creates the anonymizer described by spec for an epoch
+// key.
+func NewAddressAnonymizer(spec AlgorithmSpec, key []byte) (AddressAnonymizer, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	switch spec.Algorithm {
+	case AlgorithmCryptoPAnMSB:
+		return NewCryptoPAnFixedMSB(key)
+	case AlgorithmHMAC:
+		return NewHMACAnonymizer(hkdf(key, nil, []byte(hmacKeyInfo), sha256.Size)), nil
+	case AlgorithmTruncate:
+		return &TruncateAnonymizer{bits: spec.Bits, bits6: spec.Bits6}, nil
+	case AlgorithmPermutation:
+		return NewPermutationAnonymizer(hkdf(key, nil, []byte(permutationKeyInfo), 2*keySize))
+	case AlgorithmSubnet:
+		return nil, fmt.Errorf("%s can only be used for a network", AlgorithmSubnet)
+	default:
+		return NewCryptoPAn(key)
+	}
+}
+
+// HMACAnonymizer replaces addresses with a keyed HMAC-SHA256 of the address,
+// truncated to the address length. It does not preserve prefixes.
+type HMACAnonymizer struct {
+	pool sync.Pool
+}
+
+// NewHMACAnonymizer creates an HMAC anonymizer with the given key.
+func NewHMACAnonymizer(key []byte) *HMACAnonymizer {
+	ret := &HMACAnonymizer{}
+	ret.pool.New = func() interface{} {
+		return hmac.New(sha256.New, key)
+	}
+	return ret
+}
+
+// Anonymize anonymizes the provided IP address.
+func (h *HMACAnonymizer) Anonymize(addr net.IP) net.IP {
+	if v4addr := addr.To4(); v4addr != nil {
+		addr = v4addr
+	} else {
+		addr = addr.To16()
+	}
+	mac := h.pool.Get().(hash.Hash)
+	mac.Reset()
+	mac.Write(addr)
+	sum := mac.Sum(nil)
+	h.pool.Put(mac)
+
+	if len(addr) == net.IPv4len {
+		return net.IPv4(sum[0], sum[1], sum[2], sum[3])
+	}
+	ret := make(net.IP, net.IPv6len)
+	copy(ret, sum)
+	return ret
+}
+
+// TruncateAnonymizer zeroes the low order bits of addresses (black-marker
+// anonymization).
+type TruncateAnonymizer struct {
+	bits  int
+	bits6 int
+}
+
+// Anonymize anonymizes the provided IP address.
+func (t *TruncateAnonymizer) Anonymize(addr net.IP) net.IP {
+	if v4addr := addr.To4(); v4addr != nil {
+		return v4addr.Mask(net.CIDRMask(32-t.bits, 32)).To16()
+	}
+	return addr.To16().Mask(net.CIDRMask(128-t.bits6, 128))
+}
+
+// PermutationAnonymizer maps every byte of an address through a random
+// permutation table specific to its position. Addresses sharing their first n
+// bytes keep sharing their first n bytes, so /8, /16 and /24 structure is
+// preserved while the mapping is a simple table lookup.
+type PermutationAnonymizer struct {
+	tables [net.IPv6len][256]byte
+}
+
+// NewPermutationAnonymizer creates the permutation tables from a key. The same
+// key always produces the same tables.
+func NewPermutationAnonymizer(key []byte) (*PermutationAnonymizer, error) {
+	block, err := aes.NewCipher(key[:keySize])
+	if err != nil {
+		return nil, err
+	}
+	// The key stream is used to shuffle the tables (Fisher-Yates)
+	stream := cipher.NewCTR(block, key[keySize:keySize+blockSize])
+	var buf [4]byte
+	random := func(n int) int {
+		buf = [4]byte{}
+		stream.XORKeyStream(buf[:], buf[:])
+		return int(binary.BigEndian.Uint32(buf[:]) % uint32(n))
+	}
+
+	ret := &PermutationAnonymizer{}
+	for i := range ret.tables {
+		for j := range ret.tables[i] {
+			ret.tables[i][j] = byte(j)
+		}
+		for j := 255; j > 0; j-- {
+			k := random(j + 1)
+			ret.tables[i][j], ret.tables[i][k] = ret.tables[i][k], ret.tables[i][j]
+		}
+	}
+	return ret, nil
+}
+
+// Anonymize anonymizes the provided IP address.
+func (p *PermutationAnonymizer) Anonymize(addr net.IP) net.IP {
+	if v4addr := addr.To4(); v4addr != nil {
+		return net.IPv4(p.tables[0][v4addr[0]], p.tables[1][v4addr[1]], p.tables[2][v4addr[2]], p.tables[3][v4addr[3]])
+	}
+	v6addr := addr.To16()
+	ret := make(net.IP, net.IPv6len)
+	for i := range ret {
+		ret[i] = p.tables[i][v6addr[i]]
+	}
+	return ret
+}
+
+// SubnetAnonymizer keeps the prefix of a network, or replaces it with a fake
+// prefix, and anonymizes the host bits with Crypto-PAn. Anonymized addresses
+// of the network stay in the network, so the structure of inside and outside
+// addresses is visible in the output.
+type SubnetAnonymizer struct {
+	net    *net.IPNet
+	prefix net.IP
+	inner  AddressAnonymizer
+}
+
+// NewSubnetAnonymizer creates a subnet anonymizer for n. If prefix is nil the
+// prefix of n is kept.
+func NewSubnetAnonymizer(n *net.IPNet, prefix net.IP, key []byte) (*SubnetAnonymizer, error) {
+	var err error
+	ret := &SubnetAnonymizer{net: n, prefix: n.IP}
+	if prefix != nil {
+		if v4prefix := prefix.To4(); v4prefix != nil && len(n.IP) == net.IPv4len {
+			prefix = v4prefix
+		} else if len(n.IP) == net.IPv4len || v4prefix != nil {
+			return nil, fmt.Errorf("prefix %s and network %s are not of the same family", prefix, n)
+		}
+		ret.prefix = prefix.Mask(n.Mask)
+	}
+	if ret.inner, err = NewCryptoPAn(key); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Anonymize anonymizes the provided IP address. Addresses outside of the
+// network are anonymized with Crypto-PAn only, and never into the prefix of
+// the network.
+func (sa *SubnetAnonymizer) Anonymize(addr net.IP) net.IP {
+	anon := sa.inner.Anonymize(addr)
+	if !sa.net.Contains(addr) {
+		return avoidNets(sa.inner, anon, []*net.IPNet{sa.outputNet()})
+	}
+	if len(sa.net.IP) == net.IPv4len {
+		anon = anon.To4()
+	}
+	ret := make(net.IP, len(anon))
+	for i := range ret {
+		ret[i] = sa.prefix[i]&sa.net.Mask[i] | anon[i]&^sa.net.Mask[i]
+	}
+	return ret.To16()
+}
+
+// outputNet returns the network of the anonymized addresses of the network.
+func (sa *SubnetAnonymizer) outputNet() *net.IPNet {
+	return &net.IPNet{IP: sa.prefix.Mask(sa.net.Mask), Mask: sa.net.Mask}
+}
+
+// maxRemaps bounds the number of times an address is anonymized again to
+// leave the prefixes of the subnet anonymizers.
+const maxRemaps = 32
+
+// avoidNets anonymizes out again with a until it leaves the reserved networks
+// (cycle walking). With a permutation such as Crypto-PAn, addresses outside of
+// the reserved networks are still mapped to distinct addresses. When a is not
+// a permutation and keeps hitting them, the unspecified address is returned,
+// as any other address could be taken for an address of the networks.
+func avoidNets(a AddressAnonymizer, out net.IP, reserved []*net.IPNet) net.IP {
+	for i := 0; i <= maxRemaps; i++ {
+		inside := false
+		for _, n := range reserved {
+			if n.Contains(out) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return out
+		}
+		if i < maxRemaps {
+			out = a.Anonymize(out)
+		}
+	}
+	if out.To4() != nil {
+		return net.IPv4zero
+	}
+	return net.IPv6unspecified
+}
+
+// NetAnonymizer selects the anonymizer of the most specific network
+// containing an address, falling back to a default anonymizer. The addresses
+// that are not anonymized by a subnet anonymizer never land in the prefix of
+// one, so that they cannot be taken for addresses of its network.
+type NetAnonymizer struct {
+	def  AddressAnonymizer
+	nets []netAnonymizer
+	// Prefixes of the addresses anonymized by subnet anonymizers
+	reserved []*net.IPNet
+}
+
+type netAnonymizer struct {
+	net        *net.IPNet
+	anonymizer AddressAnonymizer
+}
+
+// NewNetAnonymizer creates the anonymizers of an epoch key.
+func NewNetAnonymizer(def AlgorithmSpec, nets []NetAlgorithmSpec, key []byte) (*NetAnonymizer, error) {
+	var err error
+	ret := &NetAnonymizer{}
+	if ret.def, err = NewAddressAnonymizer(def, key); err != nil {
+		return nil, err
+	}
+	for _, n := range nets {
+		var a AddressAnonymizer
+		if strings.ToLower(n.Algorithm) == AlgorithmSubnet {
+			var sa *SubnetAnonymizer
+			if sa, err = NewSubnetAnonymizer(n.Net, n.Prefix, key); err == nil {
+				ret.reserved = append(ret.reserved, sa.outputNet())
+			}
+			a = sa
+		} else {
+			a, err = NewAddressAnonymizer(n.AlgorithmSpec, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %w", n.Net, err)
+		}
+		ret.nets = append(ret.nets, netAnonymizer{net: n.Net, anonymizer: a})
+	}
+	return ret, nil
+}
+
+// Anonymize anonymizes the provided IP address.
+func (na *NetAnonymizer) Anonymize(addr net.IP) net.IP {
+	a := na.lookup(addr)
+	if _, ok := a.(*SubnetAnonymizer); ok {
+		return a.Anonymize(addr)
+	}
+	return avoidNets(a, a.Anonymize(addr), na.reserved)
+}
+
+func (na *NetAnonymizer) lookup(addr net.IP) AddressAnonymizer {
+	ret := na.def
+	best := -1
+	for _, n := range na.nets {
+		if ones, _ := n.net.Mask.Size(); ones > best && n.net.Contains(addr) {
+			ret = n.anonymizer
+			best = ones
+		}
+	}
+	return ret
+}
@@ -0,0 +1,169 @@
+package anonymization
+
+import (
+	"net"
+	"testing"
+)
+
+// TestTruncateAnonymizer tests that only the configured low order bits are
+// zeroed.
+func TestTruncateAnonymizer(t *testing.T) {
+	a, err := NewAddressAnonymizer(AlgorithmSpec{Algorithm: AlgorithmTruncate, Bits: 8, Bits6: 80}, testKey)
+	if err != nil {
+		t.Fatal("NewAddressAnonymizer failed:", err)
+	}
+	for _, vec := range []testVector{
+		{"140.77.12.34", "140.77.12.0"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1::"},
+	} {
+		if out := a.Anonymize(net.ParseIP(vec.origAddr)); !out.Equal(net.ParseIP(vec.obfsAddr)) {
+			t.Errorf("%s -> %s != %s", vec.origAddr, out, vec.obfsAddr)
+		}
+	}
+}
+
+// TestPermutationAnonymizer tests that the mapping is deterministic, injective
+// and preserves the structure of the first bytes.
+func TestPermutationAnonymizer(t *testing.T) {
+	a, _ := NewAddressAnonymizer(AlgorithmSpec{Algorithm: AlgorithmPermutation}, testKey)
+	b, _ := NewAddressAnonymizer(AlgorithmSpec{Algorithm: AlgorithmPermutation}, testKey)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 256; i++ {
+		addr := net.IPv4(140, 77, 12, byte(i))
+		out := a.Anonymize(addr)
+		if !out.Equal(b.Anonymize(addr)) {
+			t.Errorf("%s mapped to different addresses with the same key", addr)
+		}
+		if seen[out.String()] {
+			t.Errorf("%s collides with another address", out)
+		}
+		seen[out.String()] = true
+		if !out.Mask(net.CIDRMask(24, 32)).Equal(a.Anonymize(net.IPv4(140, 77, 12, 0)).Mask(net.CIDRMask(24, 32))) {
+			t.Errorf("%s is not in the same /24 as the other addresses", out)
+		}
+	}
+}
+
+// TestCryptopanFixedMSB tests that the fixed MSB variant differs from the
+// original algorithm and can be reversed.
+func TestCryptopanFixedMSB(t *testing.T) {
+	cpan, err := NewCryptoPAnFixedMSB(testKey)
+	if err != nil {
+		t.Fatal("NewCryptoPAnFixedMSB(testKey) failed:", err)
+	}
+	for _, vec := range append(v4Vectors, v6Vectors...) {
+		origAddr := net.ParseIP(vec.origAddr)
+		testAddr := cpan.Anonymize(origAddr)
+		if testAddr.Equal(net.ParseIP(vec.obfsAddr)) {
+			t.Errorf("%s -> %s matches the original algorithm", origAddr, testAddr)
+		}
+		if back := cpan.Deanonymize(testAddr); !back.Equal(origAddr) {
+			t.Errorf("%s -> %s -> %s", origAddr, testAddr, back)
+		}
+	}
+}
+
+// TestNetAnonymizer tests that the most specific network selects the
+// algorithm.
+func TestNetAnonymizer(t *testing.T) {
+	_, wide, _ := net.ParseCIDR("140.77.0.0/16")
+	_, narrow, _ := net.ParseCIDR("140.77.12.0/24")
+	na, err := NewNetAnonymizer(AlgorithmSpec{}, []NetAlgorithmSpec{
+		{Net: narrow, AlgorithmSpec: AlgorithmSpec{Algorithm: AlgorithmTruncate}},
+		{Net: wide, AlgorithmSpec: AlgorithmSpec{Algorithm: AlgorithmHMAC}},
+	}, testKey)
+	if err != nil {
+		t.Fatal("NewNetAnonymizer failed:", err)
+	}
+
+	if out := na.Anonymize(net.ParseIP("140.77.12.34")); !out.Equal(net.ParseIP("140.77.12.0")) {
+		t.Errorf("140.77.12.34 -> %s was not truncated", out)
+	}
+	if out := na.Anonymize(net.ParseIP("128.11.68.132")); !out.Equal(net.ParseIP("135.242.180.132")) {
+		t.Errorf("128.11.68.132 -> %s did not use Crypto-PAn", out)
+	}
+	if _, err := NewAddressAnonymizer(AlgorithmSpec{Algorithm: "rot13"}, testKey); err == nil {
+		t.Error("NewAddressAnonymizer accepted an unknown algorithm")
+	}
+}
+
+// TestSubnetAnonymizer tests that the network prefix is kept or replaced and
+// that host bits are still prefix-preserving anonymized.
+func TestSubnetAnonymizer(t *testing.T) {
+	_, n, _ := net.ParseCIDR("140.77.0.0/16")
+	keep, err := NewSubnetAnonymizer(n, nil, testKey)
+	if err != nil {
+		t.Fatal("NewSubnetAnonymizer failed:", err)
+	}
+	_, fake, _ := net.ParseCIDR("10.77.0.0/16")
+	remap, err := NewSubnetAnonymizer(n, net.ParseIP("10.77.0.0"), testKey)
+	if err != nil {
+		t.Fatal("NewSubnetAnonymizer failed:", err)
+	}
+
+	a1, a2 := net.ParseIP("140.77.12.34"), net.ParseIP("140.77.12.35")
+	o1, o2 := keep.Anonymize(a1), keep.Anonymize(a2)
+	if !n.Contains(o1) || o1.Equal(a1) {
+		t.Errorf("%s -> %s is not an anonymized address of %s", a1, o1, n)
+	}
+	if !o1.Mask(net.CIDRMask(24, 32)).Equal(o2.Mask(net.CIDRMask(24, 32))) {
+		t.Errorf("%s and %s are no longer in the same /24", o1, o2)
+	}
+	if r1 := remap.Anonymize(a1); !fake.Contains(r1) || !r1.Mask(net.CIDRMask(16, 32)).Equal(fake.IP) || r1[15] != o1[15] {
+		t.Errorf("%s -> %s is not %s remapped to %s", a1, r1, o1, fake)
+	}
+	if out := keep.Anonymize(net.ParseIP("128.11.68.132")); !out.Equal(net.ParseIP("135.242.180.132")) {
+		t.Errorf("Address outside of the network was anonymized to %s", out)
+	}
+
+	if _, err := NewSubnetAnonymizer(n, net.ParseIP("2001:db8::"), testKey); err == nil {
+		t.Error("NewSubnetAnonymizer accepted a prefix of another family")
+	}
+}
+
+// TestSubnetCollisions tests that addresses outside of the networks of subnet
+// anonymizers are not anonymized into their kept or fake prefixes.
+func TestSubnetCollisions(t *testing.T) {
+	_, local, _ := net.ParseCIDR("140.77.0.0/16")
+	_, other, _ := net.ParseCIDR("141.12.0.0/16")
+	_, fake, _ := net.ParseCIDR("10.77.0.0/16")
+	na, err := NewNetAnonymizer(AlgorithmSpec{}, []NetAlgorithmSpec{
+		{Net: local, AlgorithmSpec: AlgorithmSpec{Algorithm: AlgorithmSubnet}},
+		{Net: other, AlgorithmSpec: AlgorithmSpec{Algorithm: AlgorithmSubnet, Prefix: fake.IP}},
+	}, testKey)
+	if err != nil {
+		t.Fatal("NewNetAnonymizer failed:", err)
+	}
+	keep, err := NewSubnetAnonymizer(local, nil, testKey)
+	if err != nil {
+		t.Fatal("NewSubnetAnonymizer failed:", err)
+	}
+	cpan, _ := NewCryptoPAn(testKey)
+
+	seen := make(map[string]bool)
+	for _, target := range []string{"140.77.1.2", "140.77.200.3", "10.77.1.2", "10.77.99.4"} {
+		// An outside address that Crypto-PAn alone maps into a prefix
+		addr := cpan.Deanonymize(net.ParseIP(target))
+		if local.Contains(addr) || other.Contains(addr) {
+			t.Fatalf("%s is inside a subnet", addr)
+		}
+		out := na.Anonymize(addr)
+		if local.Contains(out) || fake.Contains(out) {
+			t.Errorf("%s -> %s is in the prefix of a subnet", addr, out)
+		}
+		if seen[out.String()] {
+			t.Errorf("%s -> %s collides with another address", addr, out)
+		}
+		seen[out.String()] = true
+		if local.Contains(net.ParseIP(target)) {
+			if out := keep.Anonymize(addr); local.Contains(out) {
+				t.Errorf("%s -> %s is in the prefix of %s", addr, out, local)
+			}
+		}
+	}
+	// Inside addresses still use the prefixes
+	if out := na.Anonymize(net.ParseIP("141.12.3.4")); !fake.Contains(out) {
+		t.Errorf("141.12.3.4 -> %s is not in %s", out, fake)
+	}
+}
@@ -2,8 +2,10 @@ package anonymization
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"net"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -12,19 +14,114 @@ import (
 	"github.com/wontoniii/traffic-anonymization/pkg/network"
 )
 
+// AModuleConfiguration is a support structure used to configure an AModule
+type AModuleConfiguration struct {
+	// Key provided by the configuration, nil to use random keys
+	Key []byte
+	// Whether Key is a master secret used to derive a key per epoch
+	DeriveKeys bool
+	// Identifier of the epoch of Key, used instead of the start of the epoch
+	// when Key is not a master secret. Empty to use the start
+	KeyEpochID string
+	// Whether to anonymize IP addresses or not
+	Anonymize bool
+	// Whether to anonymize private networks or not
+	PrivateNets bool
+	// Local networks to anonymize
+	LocalNets []string
+	// When to rotate keys
+	Rotation *RotationPolicy
+	// Archive where the key of every epoch is escrowed, nil to disable escrow
+	Escrow *Escrow
+	// Algorithm used to anonymize addresses
+	Algorithm AlgorithmSpec
+	// Algorithms used for specific networks, the most specific network wins
+	NetAlgorithms []NetAlgorithmSpec
+	// Per network actions, nil to only rely on PrivateNets and LocalNets
+	Policy *Policy
+	// Payload retention, nil to use the default rules
+	Payload *PayloadPolicy
+	// How length and checksum fields are handled, one of the Checksums* constants
+	Checksums string
+	// Whether to rewrite packets in place when their headers keep their shape,
+	// and to pass packets through without copying them. The raw data of the
+	// packets must not be reused by the reader
+	InPlace bool
+	// Number of anonymized addresses to cache, 0 to disable the cache
+	CacheSize int
+	// Whether flows active at a rotation keep the key of the previous epoch
+	StickyFlows bool
+	// Idle time after which a flow is considered finished
+	FlowTimeout time.Duration
+	// How MAC addresses are handled, one of the MAC* constants
+	MACMode string
+	// Whether to keep the VLAN tags and MPLS labels of the original frames
+	PreserveLinkLayer bool
+	// VLAN IDs replaced in the preserved tags
+	VLANMap map[uint16]uint16
+	// Time after which the handling of a fragmented datagram is forgotten
+	FragmentTimeout time.Duration
+	// How IPv6 extension headers are handled, one of the Extensions* constants
+	Extensions string
+	// How the server names of TLS ClientHello messages are handled, one of
+	// the SNI* constants
+	SNIMode string
+}
+
 // AModule
 type AModule struct {
 	// Whether to anonymize IP addresses or not
 	anonymize bool
-	// Time of the day when to create a new key
-	loopTime int
+	// When to create a new key
+	rotation *RotationPolicy
+	// Key provided by the configuration, used as master secret if deriveKeys is set
+	key []byte
+	// Whether to derive a new key from the master secret at every epoch
+	deriveKeys bool
+	// Identifier of the epoch of the configured key, if recorded with it
+	keyEpochID string
+	// Key escrow, nil if disabled
+	escrow *Escrow
+	// Algorithm used to anonymize addresses
+	algorithm AlgorithmSpec
+	// Algorithms used for specific networks
+	netAlgorithms []NetAlgorithmSpec
+	// Per network actions
+	policy *Policy
+	// Payload retention
+	payload *PayloadPolicy
+	// How length and checksum fields are handled
+	checksums string
+	// Whether to rewrite packets in place when possible
+	inPlace bool
+	// Size of the address cache
+	cacheSize int
+	// Lookups of the address caches of all epochs
+	cacheStats CacheStats
+	// Key epoch of the active flows, nil if flows are not sticky
+	flows *flowTable
+	// How MAC addresses are handled
+	macMode string
+	// Whether to keep the VLAN tags and MPLS labels of the original frames
+	preserveLinkLayer bool
+	// VLAN IDs replaced in the preserved tags
+	vlanMap map[uint16]uint16
+	// Handling of the fragmented datagrams, decided on their first fragment
+	fragments *fragmentTable
+	// How IPv6 extension headers are handled
+	extensions string
+	// How the server names of TLS ClientHello messages are handled
+	sniMode string
+	// ClientHello messages split over several TCP segments
+	hellos *helloTable
 	// Whether to anonymize private networks or not
 	privateNets bool
 	// Local network to anonymize
 	localNets []string
 
-	// Local variable to store the Cryptopan context
-	ctx *Cryptopan
+	// Anonymization context of the current key epoch, replaced as a whole at
+	// every rotation so that readers never block
+	epoch atomic.Pointer[epochContext]
 	// Local variable to know whether to anonymize local networks or not
 	hasLocalNet bool
 	// Private network variables
@@ -33,64 +130,130 @@ type AModule struct {
 	localNetCIDRs []*net.IPNet
 	// Stop channel
 	stopChan chan struct{}
-	// Mutex to access cryptopan
-	mu sync.RWMutex
 }
 
-// NewAModule
-func NewAModule(key string, anonymize bool, privateNets bool, localNets []string, loopTime int) *AModule {
-	ret := &AModule{}
+// epochContext is the anonymization context of a key epoch
+type epochContext struct {
+	// Anonymizer using the key of the epoch
+	ctx AddressAnonymizer
+	// Identifier of the epoch
+	epochID string
+	// Start of the epoch
+	start time.Time
+	// Number of rotations since the module was created
+	seq uint64
+	// MAC address anonymizer using the key of the epoch
+	mac *MACAnonymizer
+	// Server name anonymizer using the key of the epoch
+	sni *SNIAnonymizer
+}
 
-	var err error
+// NewAModule creates the anonymization module. If no key is configured a
+// random key is generated at every epoch of the rotation policy. If DeriveKeys
+// is set, the key is a master secret from which the key of every epoch is
+// derived, so that independent sensors sharing the master secret rotate to
+// the same keys. Otherwise the key is used for the whole run.
+func NewAModule(conf AModuleConfiguration) *AModule {
+	ret := &AModule{}
 
-	ret.anonymize = anonymize
+	ret.anonymize = conf.Anonymize
+	// The payload rules also apply to packets passed through
+	ret.payload = conf.Payload
+	if ret.payload == nil {
+		ret.payload, _ = NewPayloadPolicy(nil)
+	}
+	ret.inPlace = conf.InPlace
+	ret.fragments = newFragmentTable(conf.FragmentTimeout)
+	ret.hellos = newHelloTable()
+	ret.stopChan = make(chan struct{})
 	if ret.anonymize {
-		ret.ctx, err = NewCryptoPAn(CreateRandomKey())
-		if err != nil {
-			log.Fatal("Error initializing crypto module", err)
+		ret.key = conf.Key
+		ret.deriveKeys = conf.DeriveKeys && conf.Key != nil
+		if conf.Key != nil && !ret.deriveKeys {
+			ret.keyEpochID = conf.KeyEpochID
+		}
+		ret.escrow = conf.Escrow
+		ret.algorithm = conf.Algorithm
+		ret.netAlgorithms = conf.NetAlgorithms
+		ret.policy = conf.Policy
+		ret.checksums = conf.Checksums
+		ret.cacheSize = conf.CacheSize
+		ret.preserveLinkLayer = conf.PreserveLinkLayer
+		ret.vlanMap = conf.VLANMap
+		ret.extensions = conf.Extensions
+		if ret.extensions == "" {
+			ret.extensions = ExtensionsKeep
+		}
+		ret.macMode = conf.MACMode
+		if ret.macMode == "" {
+			ret.macMode = MACZero
+		}
+		ret.sniMode = conf.SNIMode
+		if ret.sniMode == "" {
+			ret.sniMode = SNIHash
+		}
+		if conf.Key == nil {
+			log.Warnln("No anonymization key configured, using a random key")
 		}
 
-		ret.loopTime = loopTime
-		// Check if need to active loop to change anonymization key
+		ret.rotation = conf.Rotation
+		if ret.rotation != nil && !ret.rotation.Never() && conf.Key != nil && !ret.deriveKeys {
+			log.Warnf("Ignoring the %s key rotation, a configured key is never replaced without DeriveKeys", ret.rotation.Kind)
+		}
+		if ret.rotation == nil || conf.Key != nil && !ret.deriveKeys {
+			// A configured key is never replaced
+			ret.rotation = &RotationPolicy{Kind: RotationNever, Location: time.Local}
+		}
+		start := ret.rotation.EpochStart(time.Now())
+		if err := ret.rotate(start); err != nil {
+			log.Fatal("Error initializing crypto module", err)
+		}
 
-		ret.privateNets = privateNets
+		ret.privateNets = conf.PrivateNets
 		if ret.privateNets {
 			ret.privateNetsCIDR = network.CIDRAllInit()
 		}
 
-		ret.localNets = localNets
+		ret.localNets = conf.LocalNets
 		if len(ret.localNets) > 0 {
 			ret.hasLocalNet = true
 			ret.localNetCIDRs = network.ToNets(ret.localNets)
 		}
 
-		ret.stopChan = make(chan struct{})
+		if ret.rotation.Never() {
+			log.Debugln("AModule initialized correctly")
+			return ret
+		}
+		if conf.StickyFlows {
+			ret.flows = newFlowTable(conf.FlowTimeout)
+			ret.flows.track(ret.rotation.Next(start))
+			go func() {
+				ticker := time.NewTicker(time.Duration(ret.flows.timeout))
+				defer ticker.Stop()
+				for {
+					select {
+					case now := <-ticker.C:
+						ret.flows.expire(now.UnixNano())
+					case <-ret.stopChan:
+						return
+					}
+				}
+			}()
+		}
 		go func() {
 			for {
-				now := time.Now()
-				nextTicker := time.Date(
-					now.Year(),
-					now.Month(),
-					now.Day(),
-					ret.loopTime, 0, 0, 0, now.Location(),
-				)
-
-				if now.After(nextTicker) {
-					nextTicker = nextTicker.Add(24 * time.Hour)
+				start = ret.rotation.Next(start)
+				if ret.flows != nil {
+					ret.flows.track(start)
 				}
 
-				// Calculate the duration until the next 2 AM
-				durationTillTicker := time.Until(nextTicker)
-
 				select {
-				case <-time.After(durationTillTicker):
-					// Replace key after ticker
-					ret.mu.Lock()
-					ret.ctx, err = NewCryptoPAn(CreateRandomKey())
-					if err != nil {
-						log.Fatal("Error initializing crypto module", err)
+				case <-time.After(time.Until(start)):
+					// Replace key after ticker. The capture stops rather
+					// than keep using a key past its epoch
+					if err := ret.rotate(start); err != nil {
+						log.Fatal("Error rotating the anonymization key: ", err)
 					}
-					ret.mu.Unlock()
 				case <-ret.stopChan:
 					// Exit the loop if stopChan is closed
 					return
@@ -104,6 +267,84 @@ func NewAModule(key string, anonymize bool, privateNets bool, localNets []string
 	return ret
 }
 
+// EpochID returns the identifier of the current key epoch.
+func (am *AModule) EpochID() string {
+	if epoch := am.epoch.Load(); epoch != nil {
+		return epoch.epochID
+	}
+	return ""
+}
+
+// Rotates tells whether packets are anonymized with keys that change at every
+// epoch.
+func (am *AModule) Rotates() bool {
+	return am.anonymize && !am.rotation.Never()
+}
+
+// rotate replaces the anonymization context with the one of the epoch starting at
+// start. On error the context of the previous epoch is kept.
+func (am *AModule) rotate(start time.Time) error {
+	var key []byte
+	epochID := EpochID(start)
+	if am.keyEpochID != "" {
+		epochID = am.keyEpochID
+	}
+	if am.deriveKeys {
+		key = DeriveEpochKey(am.key, epochID)
+	} else if am.key != nil {
+		key = am.key
+	} else {
+		key = CreateRandomKey()
+	}
+
+	var ctx AddressAnonymizer
+	ctx, err := NewNetAnonymizer(am.algorithm, am.netAlgorithms, key)
+	if err != nil {
+		return err
+	}
+	if am.cacheSize > 0 {
+		// A new cache per key, so that addresses of the previous epoch are forgotten
+		ctx = NewCachedAnonymizer(ctx, am.cacheSize, &am.cacheStats)
+	}
+
+	if am.escrow != nil {
+		var end time.Time
+		if !am.rotation.Never() {
+			end = am.rotation.Next(start)
+		}
+		// The key is escrowed as soon as it is used, so that it survives a crash
+		activation := time.Now()
+		if activation.Before(start) {
+			activation = start
+		}
+		// A key that could not be escrowed is never used
+		if err := am.escrow.Seal(epochID, activation, end, key); err != nil {
+			return fmt.Errorf("could not escrow the key of epoch %s: %w", epochID, err)
+		}
+	}
+
+	var seq uint64
+	if prev := am.epoch.Load(); prev != nil {
+		seq = prev.seq + 1
+	}
+	am.epoch.Store(&epochContext{
+		ctx:     ctx,
+		epochID: epochID,
+		start:   start,
+		seq:     seq,
+		mac:     NewMACAnonymizer(am.macMode, key),
+		sni:     NewSNIAnonymizer(am.sniMode, key),
+	})
+	log.Infof("Using anonymization key of epoch %s", epochID)
+	return nil
+}
+
+// CacheStats returns the number of address cache hits and misses since the
+// module was created.
+func (am *AModule) CacheStats() (hits, misses uint64) {
+	return am.cacheStats.Hits.Load(), am.cacheStats.Misses.Load()
+}
+
 func (am *AModule) Stop() error {
 	close(am.stopChan)
 	return nil
@@ -214,111 +455,422 @@ func isQUICHandshake(udp *layers.UDP) bool {
 	return false
 }
 
+// anonymizeAddr applies the policy rule of an address and returns the new
+// address, or nil if the address is left in clear. Without a rule the address
+// is anonymized only if local is set.
+func (am *AModule) anonymizeAddr(epoch *epochContext, rule *PolicyRule, addr net.IP, local bool) net.IP {
+	action := ActionPass
+	if rule != nil {
+		action = rule.Action
+	} else if local {
+		action = ActionAnonymize
+	}
+
+	switch action {
+	case ActionAnonymize:
+		log.Debugf("Anonymizing %s", addr)
+		return epoch.ctx.Anonymize(addr)
+	case ActionTruncate:
+		log.Debugf("Truncating %s", addr)
+		return rule.truncator.Anonymize(addr)
+	default:
+		return nil
+	}
+}
+
+// anonymizedByDefault tells whether an address without policy rule is
+// anonymized, that is if it belongs to the private or local networks.
+func (am *AModule) anonymizedByDefault(addr net.IP) bool {
+	return am.privateNets && network.IsPrivateIP(am.privateNetsCIDR, addr) || am.hasLocalNet && network.IsPrivateIP(am.localNetCIDRs, addr)
+}
+
 // Anonymize processes incoming packets.
 func (am *AModule) Anonymize(pkt *network.Packet) error {
 	if am.anonymize {
-		is_src_local := network.IsPrivateIP(am.localNetCIDRs, net.ParseIP(pkt.SrcIP))
-		is_dst_local := network.IsPrivateIP(am.localNetCIDRs, net.ParseIP(pkt.DstIP))
-		if is_src_local && is_dst_local && am.hasLocalNet && !pkt.IsDNS {
-			log.Debugf("Both source and destination are private, dropping packet")
-			return &net.AddrError{}
+		return am.anonymizePacket(pkt, 0, true)
+	}
+	am.passThrough(pkt)
+	return nil
+}
+
+// anonymizePacket anonymizes a packet, or the packet carried by a tunnel at
+// nesting level depth, which starts with a link layer header if link is set.
+func (am *AModule) anonymizePacket(pkt *network.Packet, depth int, link bool) error {
+	srcIP := net.ParseIP(pkt.SrcIP)
+	dstIP := net.ParseIP(pkt.DstIP)
+	protocol := ""
+	if pkt.IsTCP {
+		protocol = "tcp"
+	} else if pkt.IsUDP {
+		protocol = "udp"
+	} else if pkt.IsFrag {
+		protocol = ipProtocolName(uint8(pkt.Frag.Protocol))
+	}
+	now := time.Now().UnixNano()
+	var fragKey fragmentKey
+	var datagram *fragmentEntry
+	if pkt.IsFrag {
+		fragKey = newFragmentKey(pkt, srcIP, dstIP)
+		// Later fragments are handled like the first one, which has the ports
+		if e, ok := am.fragments.get(fragKey, now); ok && !isFirstFragment(pkt) {
+			datagram = &e
 		}
+	}
+	var srcRule, dstRule *PolicyRule
+	if datagram != nil {
+		srcRule, dstRule = datagram.srcRule, datagram.dstRule
+	} else {
+		srcRule = am.policy.Lookup(srcIP, protocol, pkt.SrcPort)
+		dstRule = am.policy.Lookup(dstIP, protocol, pkt.DstPort)
+	}
+	if srcRule != nil && srcRule.Action == ActionDrop || dstRule != nil && dstRule.Action == ActionDrop {
+		log.Debugf("Dropping packet by policy")
+		return &net.AddrError{}
+	}
 
-		pkt.OutBuf = gopacket.NewSerializeBufferExpectedSize(len(pkt.RawData), 0)
+	is_src_local := network.IsPrivateIP(am.localNetCIDRs, srcIP)
+	is_dst_local := network.IsPrivateIP(am.localNetCIDRs, dstIP)
+	// Policy rules take precedence over the default local traffic handling
+	if srcRule == nil && dstRule == nil && is_src_local && is_dst_local && am.hasLocalNet && !pkt.IsDNS {
+		log.Debugf("Both source and destination are private, dropping packet")
+		return &net.AddrError{}
+	}
 
-		am.mu.RLock()
-		if am.privateNets && network.IsPrivateIP(am.privateNetsCIDR, net.ParseIP(pkt.SrcIP)) || am.hasLocalNet && is_src_local {
-			log.Debugf("Source is private, anonymize")
-			pkt.SrcIP = am.ctx.Anonymize(net.ParseIP(pkt.SrcIP)).String()
-		}
-		if am.privateNets && network.IsPrivateIP(am.privateNetsCIDR, net.ParseIP(pkt.DstIP)) || am.hasLocalNet && is_dst_local {
-			log.Debugf("Destination is private, anonymize")
-			pkt.DstIP = am.ctx.Anonymize(net.ParseIP(pkt.DstIP)).String()
+	newSrcIP, newDstIP := srcIP, dstIP
+	quote := parseICMPQuote(pkt)
+	// Both addresses are anonymized with the same epoch even if keys are
+	// rotated meanwhile
+	epoch := am.epoch.Load()
+	if datagram != nil {
+		epoch = datagram.epoch
+	} else if am.flows != nil {
+		var key flowKey
+		if quote != nil {
+			// Errors belong to the flow of the packet that caused them
+			key = newFlowKey(quote.protocol, quote.srcIP, quote.srcPort, quote.dstIP, quote.dstPort)
+		} else {
+			key = newFlowKey(transportProtocol(pkt), srcIP, pkt.SrcPort, dstIP, pkt.DstPort)
 		}
-		am.mu.RUnlock()
-
-		options := gopacket.SerializeOptions{}
+		epoch = am.flows.epoch(key, now, epoch)
+	}
+	if addr := am.anonymizeAddr(epoch, srcRule, srcIP, am.anonymizedByDefault(srcIP)); addr != nil {
+		newSrcIP = addr
+		pkt.SrcIP = addr.String()
+	}
+	if addr := am.anonymizeAddr(epoch, dstRule, dstIP, am.anonymizedByDefault(dstIP)); addr != nil {
+		newDstIP = addr
+		pkt.DstIP = addr.String()
+	}
+	pkt.EpochID = epoch.epochID
+	pkt.EpochStart = epoch.start
+
+	options := gopacket.SerializeOptions{}
+	ipOptions := gopacket.SerializeOptions{}
+	var networkLayer gopacket.NetworkLayer
+	if pkt.IsIPv4 {
+		pkt.Ip4.SrcIP = newSrcIP
+		pkt.Ip4.DstIP = newDstIP
+		networkLayer = pkt.Ip4
+	} else if pkt.IsIPv6 {
+		pkt.Ip6.SrcIP = newSrcIP
+		pkt.Ip6.DstIP = newDstIP
+		networkLayer = pkt.Ip6
+	}
+	// The transport checksum covers the final destination of routed packets
+	// and the home address of packets sent by mobile nodes
+	ckSrcIP, newCkSrcIP := srcIP, newSrcIP
+	ckDstIP, newCkDstIP := dstIP, newDstIP
+	checksumLayer := networkLayer
+	extensions := am.rewriteExtensions(epoch, pkt, protocol, srcIP, dstIP, newSrcIP, newDstIP)
+	if extensions != nil {
+		ckSrcIP, newCkSrcIP = extensions.homeAddr, extensions.newHomeAddr
+		ckDstIP, newCkDstIP = extensions.finalDst, extensions.newFinalDst
+		ip6 := *pkt.Ip6
+		ip6.SrcIP = newCkSrcIP
+		ip6.DstIP = newCkDstIP
+		checksumLayer = &ip6
+	}
 
-		if pkt.IsTCP {
-			// Check if the payload is a TLS handshake
-			if isTLSHandshake(pkt.Tcp) {
-				log.Debugf("TLS handshake detected")
-				err := gopacket.Payload(pkt.Tcp.LayerPayload()).SerializeTo(pkt.OutBuf, options)
-				if err != nil {
-					log.Error(err)
-					return nil
+	payload := am.payload.Payload(pkt)
+	// Handshakes are kept without their identifying fields
+	scrubbed := false
+	// Header bytes removed from the carried packet of a tunnel
+	shrink := 0
+	if pkt.IsFrag {
+		keep := 0
+		if datagram != nil {
+			keep = datagram.keep
+		} else if isFirstFragment(pkt) {
+			keep = am.datagramKeep(pkt)
+			if pkt.IsTCP {
+				// The rest of a ClientHello is not kept in the later fragments
+				// nor in the following segments
+				hdrLen := len(pkt.Tcp.Contents)
+				if data := pkt.Frag.Data[hdrLen:]; isClientHello(data) && clientHelloLen(data) > len(data) {
+					am.hellos.add(newHelloKey(srcIP, pkt.SrcPort, dstIP, pkt.DstPort), pkt.Tcp.Seq, clientHelloLen(data), now)
+					if keep < 0 || keep > len(pkt.Frag.Data) {
+						keep = len(pkt.Frag.Data)
+					}
 				}
 			}
-			err := pkt.Tcp.SerializeTo(pkt.OutBuf, options)
-			if err != nil {
-				log.Error(err)
-				return nil
+			am.fragments.add(fragKey, fragmentEntry{srcRule: srcRule, dstRule: dstRule, epoch: epoch, keep: keep}, now)
+		}
+		// The data of later fragments seen before the first one is stripped
+		payload = fragmentData(pkt, keep)
+		if pkt.IsTCP && isFirstFragment(pkt) {
+			payload, scrubbed = scrubFragmentClientHello(pkt, payload, epoch.sni, am.checksums != ChecksumsKeep)
+		}
+		if am.checksums != ChecksumsKeep && isFirstFragment(pkt) {
+			payload = updateFragmentChecksum(pkt, payload, ckSrcIP, ckDstIP, newCkSrcIP, newCkDstIP)
+		}
+	} else if pkt.IsICMP4 || pkt.IsICMP6 {
+		var ok bool
+		if payload, ok = am.anonymizeICMP(epoch, pkt, quote); !ok {
+			log.Debugf("Dropping ICMP error by policy")
+			return &net.AddrError{}
+		}
+	} else if pkt.Tunnel.Inner != nil {
+		var err error
+		if payload, shrink, err = am.anonymizeTunnel(pkt, depth); err != nil {
+			log.Debugf("Dropping tunnel by policy")
+			return err
+		}
+	}
+	if pkt.IsTCP && !pkt.IsFrag {
+		key := newHelloKey(srcIP, pkt.SrcPort, dstIP, pkt.DstPort)
+		if isClientHello(payload) {
+			// The rest of the message is zeroed in the following segments
+			if n := clientHelloLen(payload); n > len(pkt.Tcp.Payload) {
+				am.hellos.add(key, pkt.Tcp.Seq, n, now)
 			}
-			log.Debugf("Added tcp %d", len(pkt.OutBuf.Bytes()))
-
+			payload, scrubbed = scrubClientHello(payload, epoch.sni)
+		} else {
+			payload, scrubbed = am.hellos.scrub(key, pkt.Tcp.Seq, payload, now)
 		}
-		if pkt.IsUDP {
-			// Check if the payload is a TLS handshake
-			if pkt.IsDNS || isQUICHandshake(pkt.Udp) {
-				log.Debugf("DNS or QUIC handshake detected")
-				err := gopacket.Payload(pkt.Udp.LayerPayload()).SerializeTo(pkt.OutBuf, options)
-				if err != nil {
-					log.Error(err)
-					return nil
+	} else if pkt.IsUDP && !pkt.IsFrag && pkt.Tunnel.Inner == nil {
+		payload, scrubbed = scrubQUIC(payload, epoch.sni)
+	}
+	// Carried packets are part of the data of the tunnel packet
+	if am.inPlace && depth == 0 && !scrubbed && am.rewriteInPlace(pkt, epoch.mac, srcIP, dstIP, newSrcIP, newDstIP, payload) {
+		return nil
+	}
+	pkt.OutBuf = gopacket.NewSerializeBufferExpectedSize(len(pkt.RawData), 0)
+
+	switch am.checksums {
+	case ChecksumsRecompute:
+		options = gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		ipOptions = options
+		if checksumLayer != nil && !pkt.IsFrag {
+			if pkt.IsTCP {
+				pkt.Tcp.SetNetworkLayerForChecksum(checksumLayer)
+			} else if pkt.IsUDP {
+				pkt.Udp.SetNetworkLayerForChecksum(checksumLayer)
+			} else if pkt.IsICMP6 {
+				pkt.Icmp6.SetNetworkLayerForChecksum(checksumLayer)
+			}
+		}
+	case ChecksumsPreserveLength:
+		// The transport checksum still covers the original payload, so it
+		// is only updated for the new addresses of the pseudo-header
+		ipOptions.ComputeChecksums = true
+		// The transport checksum of fragments is updated in their data
+		if pkt.IsTCP && !pkt.IsFrag {
+			pkt.Tcp.Checksum = updateAddrChecksum(pkt.Tcp.Checksum, pkt.IsIPv4, ckSrcIP, ckDstIP, newCkSrcIP, newCkDstIP)
+			if scrubbed {
+				var ok bool
+				if pkt.Tcp.Checksum, ok = updatePrefixChecksum(pkt.Tcp.Checksum, pkt.Tcp.Payload, payload); !ok {
+					// The checksum still covers the original payload
+					log.Debugf("Stripping scrubbed payload longer than the original")
+					payload = nil
 				}
 			}
-			err := pkt.Udp.SerializeTo(pkt.OutBuf, options)
-			if err != nil {
-				log.Error(err)
-				return nil
+		} else if pkt.IsUDP && !pkt.IsFrag && pkt.Udp.Checksum != 0 {
+			pkt.Udp.Checksum = updateAddrChecksum(pkt.Udp.Checksum, pkt.IsIPv4, ckSrcIP, ckDstIP, newCkSrcIP, newCkDstIP)
+			if scrubbed {
+				var ok bool
+				if pkt.Udp.Checksum, ok = updatePrefixChecksum(pkt.Udp.Checksum, pkt.Udp.Payload, payload); !ok {
+					log.Debugf("Stripping scrubbed payload longer than the original")
+					payload = nil
+				}
 			}
-			log.Debugf("Added udp %d", len(pkt.OutBuf.Bytes()))
+			if pkt.Tunnel.Inner != nil {
+				// The carried packet is rewritten too, the checksum still
+				// covers the rest of the original one after it
+				var ok bool
+				if pkt.Udp.Checksum, ok = replacePrefixChecksum(pkt.Udp.Checksum, pkt.Udp.Payload, len(payload)+shrink, payload); !ok {
+					log.Debugf("Stripping carried packet longer than the original")
+					payload = append([]byte(nil), pkt.Tunnel.Header...)
+					shrink = 0
+				}
+				if shrink != 0 {
+					// The length is both in the header and the pseudo-header
+					var length, newLength [2]byte
+					binary.BigEndian.PutUint16(length[:], pkt.Udp.Length)
+					binary.BigEndian.PutUint16(newLength[:], pkt.Udp.Length-uint16(shrink))
+					pkt.Udp.Checksum = updateChecksum(pkt.Udp.Checksum, length[:], newLength[:])
+					pkt.Udp.Checksum = updateChecksum(pkt.Udp.Checksum, length[:], newLength[:])
+				}
+			}
+			if pkt.Udp.Checksum == 0 {
+				// Zero means no checksum in UDP
+				pkt.Udp.Checksum = 0xffff
+			}
+		} else if pkt.IsICMP4 || pkt.IsICMP6 {
+			updateICMPChecksum(pkt, ckSrcIP, ckDstIP, newCkSrcIP, newCkDstIP, payload)
+		}
+	}
 
+	if shrink != 0 {
+		// The lengths describe the original packet without the removed
+		// headers
+		if pkt.IsUDP {
+			pkt.Udp.Length -= uint16(shrink)
 		}
 		if pkt.IsIPv4 {
-			pkt.Ip4.SrcIP = net.ParseIP(pkt.SrcIP)
-			pkt.Ip4.DstIP = net.ParseIP(pkt.DstIP)
-			err := pkt.Ip4.SerializeTo(pkt.OutBuf, options)
-			if err != nil {
-				log.Error(err)
-			}
-			log.Debugf("Added ip4 %d", len(pkt.OutBuf.Bytes()))
+			pkt.Ip4.Length -= uint16(shrink)
+		} else if pkt.IsIPv6 {
+			pkt.Ip6.Length -= uint16(shrink)
 		}
-		if pkt.IsIPv6 {
-			pkt.Ip6.SrcIP = net.ParseIP(pkt.SrcIP)
-			pkt.Ip6.DstIP = net.ParseIP(pkt.DstIP)
-			err := pkt.Ip6.SerializeTo(pkt.OutBuf, options)
+		pkt.Ci.Length -= shrink
+	}
+
+	if len(payload) > 0 {
+		log.Debugf("Keeping %d bytes of payload", len(payload))
+		err := gopacket.Payload(payload).SerializeTo(pkt.OutBuf, options)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+	}
+
+	// The transport header of fragments is part of their data
+	if pkt.IsTCP && !pkt.IsFrag {
+		err := pkt.Tcp.SerializeTo(pkt.OutBuf, options)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		log.Debugf("Added tcp %d", len(pkt.OutBuf.Bytes()))
+
+	}
+	if pkt.IsUDP && !pkt.IsFrag {
+		err := pkt.Udp.SerializeTo(pkt.OutBuf, options)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		log.Debugf("Added udp %d", len(pkt.OutBuf.Bytes()))
+
+	}
+	if pkt.IsICMP4 {
+		err := pkt.Icmp4.SerializeTo(pkt.OutBuf, options)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		log.Debugf("Added icmp %d", len(pkt.OutBuf.Bytes()))
+	}
+	if pkt.IsICMP6 {
+		err := pkt.Icmp6.SerializeTo(pkt.OutBuf, options)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		log.Debugf("Added icmp6 %d", len(pkt.OutBuf.Bytes()))
+	}
+	if extensions != nil {
+		hdr, err := pkt.OutBuf.PrependBytes(len(extensions.data))
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		copy(hdr, extensions.data)
+		// The hop-by-hop header, if kept, is part of the chain
+		pkt.Ip6.HopByHop = nil
+		pkt.Ip6.NextHeader = extensions.next
+		if am.checksums != ChecksumsRecompute {
+			pkt.Ip6.Length -= uint16(extensions.stripped)
+		}
+		log.Debugf("Added ip6 extensions %d", len(pkt.OutBuf.Bytes()))
+	}
+	if pkt.IsIPv4 {
+		err := pkt.Ip4.SerializeTo(pkt.OutBuf, ipOptions)
+		if err != nil {
+			log.Error(err)
+		}
+		log.Debugf("Added ip4 %d", len(pkt.OutBuf.Bytes()))
+	}
+	if pkt.IsIPv6 {
+		err := pkt.Ip6.SerializeTo(pkt.OutBuf, ipOptions)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		log.Debugf("Added ip6 %d", len(pkt.OutBuf.Bytes()))
+	}
+
+	if link && am.preserveLinkLayer {
+		// The original header, with its tags and labels, in front of the
+		// anonymized IP packet
+		orig := linkHeader(pkt)
+		hdr, err := pkt.OutBuf.PrependBytes(len(orig))
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		copy(hdr, orig)
+		am.rewriteLinkHeader(hdr, epoch.mac)
+		// Carried frames are not padded
+		if length := len(pkt.OutBuf.Bytes()); depth == 0 && length < minFrameSize {
+			padding, err := pkt.OutBuf.AppendBytes(minFrameSize - length)
 			if err != nil {
 				log.Error(err)
 				return nil
 			}
-			log.Debugf("Added ip6 %d", len(pkt.OutBuf.Bytes()))
+			for i := range padding {
+				padding[i] = 0
+			}
 		}
-
+	} else if link {
 		ethernetLayer := &layers.Ethernet{
-			SrcMAC:       net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
-			DstMAC:       net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			SrcMAC:       make(net.HardwareAddr, 6),
+			DstMAC:       make(net.HardwareAddr, 6),
 			EthernetType: layers.EthernetTypeIPv4,
 		}
+		if len(pkt.Eth.SrcMAC) == 6 && len(pkt.Eth.DstMAC) == 6 {
+			epoch.mac.Anonymize(ethernetLayer.SrcMAC, pkt.Eth.SrcMAC)
+			epoch.mac.Anonymize(ethernetLayer.DstMAC, pkt.Eth.DstMAC)
+		}
 
 		if pkt.IsIPv6 {
 			ethernetLayer.EthernetType = layers.EthernetTypeIPv6
 		}
 
-		ethernetLayer.SerializeTo(pkt.OutBuf, options)
-
-		log.Debugf("Added eth %d", len(pkt.OutBuf.Bytes()))
-		if pkt.Ci.Length < len(pkt.OutBuf.Bytes()) {
-			log.Debugf("The packet length is smaller than the produced data len, src %s, dst %s", pkt.SrcIP, pkt.DstIP)
-			pkt.Ci.Length = len(pkt.OutBuf.Bytes())
-			// return nil
+		if depth == 0 {
+			ethernetLayer.SerializeTo(pkt.OutBuf, gopacket.SerializeOptions{})
 		} else {
-			log.Debugf("And the produced data len is %d", len(pkt.OutBuf.Bytes()))
+			// Carried frames are not padded, which the layer always does
+			hdr, err := pkt.OutBuf.PrependBytes(14)
+			if err != nil {
+				log.Error(err)
+				return nil
+			}
+			copy(hdr, ethernetLayer.DstMAC)
+			copy(hdr[6:], ethernetLayer.SrcMAC)
+			binary.BigEndian.PutUint16(hdr[12:], uint16(ethernetLayer.EthernetType))
 		}
-	} else {
-		log.Fatal("No support of passthrough at the moment")
 	}
 
+	log.Debugf("Added eth %d", len(pkt.OutBuf.Bytes()))
+	if am.checksums == ChecksumsRecompute {
+		// The lengths describe the output packet, which is complete
+		pkt.Ci.Length = len(pkt.OutBuf.Bytes())
+	} else if pkt.Ci.Length < len(pkt.OutBuf.Bytes()) {
+		log.Debugf("The packet length is smaller than the produced data len, src %s, dst %s", pkt.SrcIP, pkt.DstIP)
+		pkt.Ci.Length = len(pkt.OutBuf.Bytes())
+		// return nil
+	} else {
+		log.Debugf("And the produced data len is %d", len(pkt.OutBuf.Bytes()))
+	}
 	return nil
-
 }
@@ -0,0 +1,94 @@
+package anonymization
+
+import (
+	"container/list"
+	"hash/maphash"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of independently locked parts of a cache, to limit contention between
+// reader threads
+const cacheShards = 16
+
+// CacheStats counts the lookups of address caches. The same counters can be
+// shared by the caches of successive epochs.
+type CacheStats struct {
+	Hits   atomic.Uint64
+	Misses atomic.Uint64
+}
+
+// CachedAnonymizer remembers the most recently anonymized addresses of another
+// anonymizer. A cache belongs to a single key, a new one is created when keys
+// are rotated.
+type CachedAnonymizer struct {
+	inner  AddressAnonymizer
+	stats  *CacheStats
+	seed   maphash.Seed
+	shards [cacheShards]cacheShard
+}
+
+type cacheShard struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[[net.IPv6len]byte]*list.Element
+}
+
+type cacheEntry struct {
+	addr [net.IPv6len]byte
+	anon net.IP
+}
+
+// NewCachedAnonymizer creates a cache of up to size addresses in front of
+// inner. Lookups are counted in stats, which may be nil.
+func NewCachedAnonymizer(inner AddressAnonymizer, size int, stats *CacheStats) *CachedAnonymizer {
+	if stats == nil {
+		stats = &CacheStats{}
+	}
+	ret := &CachedAnonymizer{inner: inner, stats: stats, seed: maphash.MakeSeed()}
+	shardSize := (size + cacheShards - 1) / cacheShards
+	for i := range ret.shards {
+		ret.shards[i].size = shardSize
+		ret.shards[i].lru = list.New()
+		ret.shards[i].entries = make(map[[net.IPv6len]byte]*list.Element, shardSize)
+	}
+	return ret
+}
+
+// Anonymize anonymizes the provided IP address. The returned address is shared
+// with the cache and must not be modified.
+func (c *CachedAnonymizer) Anonymize(addr net.IP) net.IP {
+	var key [net.IPv6len]byte
+	copy(key[:], addr.To16())
+	shard := &c.shards[maphash.Bytes(c.seed, key[:])%cacheShards]
+
+	shard.mu.Lock()
+	if e, ok := shard.entries[key]; ok {
+		shard.lru.MoveToFront(e)
+		anon := e.Value.(*cacheEntry).anon
+		shard.mu.Unlock()
+		c.stats.Hits.Add(1)
+		return anon
+	}
+	shard.mu.Unlock()
+	c.stats.Misses.Add(1)
+
+	// Computed outside of the lock, concurrent misses of the same address
+	// produce the same result
+	anon := c.inner.Anonymize(addr)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.entries[key]; ok {
+		return anon
+	}
+	if shard.lru.Len() >= shard.size {
+		oldest := shard.lru.Back()
+		shard.lru.Remove(oldest)
+		delete(shard.entries, oldest.Value.(*cacheEntry).addr)
+	}
+	shard.entries[key] = shard.lru.PushFront(&cacheEntry{addr: key, anon: anon})
+	return anon
+}
@@ -0,0 +1,56 @@
+package anonymization
+
+import (
+	"net"
+	"testing"
+)
+
+// countingAnonymizer counts the addresses it anonymizes
+type countingAnonymizer struct {
+	AddressAnonymizer
+	calls int
+}
+
+func (c *countingAnonymizer) Anonymize(addr net.IP) net.IP {
+	c.calls++
+	return c.AddressAnonymizer.Anonymize(addr)
+}
+
+// TestCachedAnonymizer tests that cached results match the anonymizer and that
+// the least recently used addresses are evicted.
+func TestCachedAnonymizer(t *testing.T) {
+	ctx, err := NewCryptoPAn([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal("NewCryptoPAn failed:", err)
+	}
+	inner := &countingAnonymizer{AddressAnonymizer: ctx}
+	stats := &CacheStats{}
+	// Two entries per shard, so that both addresses fit whatever their shard
+	cache := NewCachedAnonymizer(inner, 2*cacheShards, stats)
+
+	addrs := []string{"128.11.68.132", "2001:db8::1"}
+	for i := 0; i < 3; i++ {
+		for _, a := range addrs {
+			addr := net.ParseIP(a)
+			if got, want := cache.Anonymize(addr), ctx.Anonymize(addr); !got.Equal(want) {
+				t.Errorf("%s: %s != %s", a, got, want)
+			}
+		}
+	}
+	if inner.calls != len(addrs) {
+		t.Errorf("%d addresses anonymized instead of %d", inner.calls, len(addrs))
+	}
+	if hits, misses := stats.Hits.Load(), stats.Misses.Load(); hits != 4 || misses != 2 {
+		t.Errorf("%d hits and %d misses instead of 4 and 2", hits, misses)
+	}
+
+	// Fill every shard, the shard of the first address must have evicted it
+	for i := 0; i < 256*cacheShards; i++ {
+		cache.Anonymize(net.IPv4(10, 0, byte(i>>8), byte(i)))
+	}
+	calls := inner.calls
+	cache.Anonymize(net.ParseIP(addrs[0]))
+	if inner.calls != calls+1 {
+		t.Error("Address not evicted from a full cache")
+	}
+}
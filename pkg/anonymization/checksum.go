@@ -0,0 +1,117 @@
+package anonymization
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// Length and checksum fields are left untouched
+	ChecksumsKeep = "keep"
+	// Lengths and checksums are recomputed to match the output packet
+	ChecksumsRecompute = "recompute"
+	// Lengths describe the original packet and checksums are updated for the
+	// new addresses. The output is marked as truncated in the capture
+	ChecksumsPreserveLength = "preserve-length"
+)
+
+// ParseChecksumMode validates the checksum mode, keep if empty.
+func ParseChecksumMode(mode string) (string, error) {
+	switch mode = strings.ToLower(mode); mode {
+	case "":
+		return ChecksumsKeep, nil
+	case ChecksumsKeep, ChecksumsRecompute, ChecksumsPreserveLength:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown checksum mode %q", mode)
+}
+
+// updateChecksum returns the Internet checksum csum updated for the
+// replacement of old by new (RFC 1624, eqn. 3). old and new must have the same
+// even length.
+func updateChecksum(csum uint16, old, new []byte) uint16 {
+	sum := uint32(^csum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	return checksumFold(sum)
+}
+
+// updatePrefixChecksum returns a checksum covering orig updated for the
+// replacement of the beginning of orig by new, the rest of orig being still
+// covered. It returns false, leaving the checksum untouched, if new is longer
+// than orig.
+func updatePrefixChecksum(csum uint16, orig, new []byte) (uint16, bool) {
+	return replacePrefixChecksum(csum, orig, len(new), new)
+}
+
+// replacePrefixChecksum returns a checksum covering orig updated for the
+// replacement of the first n bytes of orig by new, the rest of orig being
+// still covered after new. It returns false, leaving the checksum untouched,
+// if orig is shorter than n or if the rest of orig would move by an odd number
+// of bytes.
+func replacePrefixChecksum(csum uint16, orig []byte, n int, new []byte) (uint16, bool) {
+	if n > len(orig) || (n-len(new))%2 != 0 {
+		return csum, false
+	}
+	old := orig[:n]
+	if len(new)%2 == 1 {
+		// The last word is completed with the next byte of orig, or padded
+		next := byte(0)
+		if n < len(orig) {
+			next = orig[n]
+		}
+		old = append(old[:n:n], next)
+		new = append(new[:len(new):len(new)], next)
+	}
+	sum := uint32(^csum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+	}
+	return checksumFold(checksumAdd(sum, new)), true
+}
+
+// updateAddrChecksum updates a transport checksum for the replacement of the
+// addresses of its pseudo-header.
+func updateAddrChecksum(csum uint16, ipv4 bool, oldSrc, oldDst, newSrc, newDst net.IP) uint16 {
+	addr := func(ip net.IP) []byte {
+		if ipv4 {
+			return ip.To4()
+		}
+		return ip.To16()
+	}
+	csum = updateChecksum(csum, addr(oldSrc), addr(newSrc))
+	return updateChecksum(csum, addr(oldDst), addr(newDst))
+}
+
+// checksumAdd adds data to a one's complement sum.
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for ; len(data) >= 2; data = data[2:] {
+		sum += uint32(binary.BigEndian.Uint16(data))
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds a one's complement sum into an Internet checksum.
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// transportChecksum computes the TCP or UDP checksum of a segment, whose
+// checksum field must be zero, including the IPv4 or IPv6 pseudo-header.
+func transportChecksum(src, dst []byte, protocol uint8, segment []byte) uint16 {
+	sum := checksumAdd(0, src)
+	sum = checksumAdd(sum, dst)
+	length := uint32(len(segment))
+	sum += length>>16 + length&0xffff + uint32(protocol)
+	return checksumFold(checksumAdd(sum, segment))
+}
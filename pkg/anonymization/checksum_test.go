@@ -0,0 +1,47 @@
+package anonymization
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func tcpChecksum(t *testing.T, src, dst net.IP, payload []byte) uint16 {
+	var ip gopacket.NetworkLayer
+	if src.To4() != nil {
+		ip = &layers.IPv4{Version: 4, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+	} else {
+		ip = &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 1, ACK: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return tcp.Checksum
+}
+
+// TestUpdateAddrChecksum tests that the incremental update matches a full
+// checksum computation.
+func TestUpdateAddrChecksum(t *testing.T) {
+	payload := []byte("some payload")
+	for _, tc := range []struct {
+		src, dst, newSrc, newDst string
+	}{
+		{"192.0.2.1", "198.51.100.7", "10.77.1.2", "203.0.113.250"},
+		{"255.255.255.255", "0.0.0.0", "0.0.0.0", "255.255.255.255"},
+		{"2001:db8::1", "2001:db8:1::2", "fd00::1234", "2001:db8:ffff::"},
+	} {
+		src, dst := net.ParseIP(tc.src), net.ParseIP(tc.dst)
+		newSrc, newDst := net.ParseIP(tc.newSrc), net.ParseIP(tc.newDst)
+		want := tcpChecksum(t, newSrc, newDst, payload)
+		got := updateAddrChecksum(tcpChecksum(t, src, dst, payload), src.To4() != nil, src, dst, newSrc, newDst)
+		if got != want {
+			t.Errorf("%s %s -> %s %s: %#04x != %#04x", tc.src, tc.dst, tc.newSrc, tc.newDst, got, want)
+		}
+	}
+}
@@ -3,10 +3,15 @@ package anonymization
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
-	"math/rand"
+	"encoding/binary"
 	"net"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -15,6 +20,32 @@ const (
 
 	blockSize = aes.BlockSize
 	keySize   = 128 / 8
+
+	// Number of leading address bits whose pads are precomputed for every
+	// possible prefix when the key is created
+	precomputedBits = 16
+	// Maximum number of memoized prefix pads, for all the keys
+	maxMemoizedPrefixes = 1 << 18
+)
+
+// Instances created with the same key share the state of the key, so that
+// the precomputed pads, 128 KiB, are only computed and held once per key
+// however many anonymizers use it, and the memoized pads are shared and
+// bounded across keys.
+var cryptopanStates = struct {
+	sync.Mutex
+	m map[cryptopanID]*cryptopanState
+}{m: make(map[cryptopanID]*cryptopanState)}
+
+// Number of memoized prefix pads of all the keys
+var memoizedPrefixes atomic.Int64
+
+// Prefix lengths whose pads are memoized, longest last. Addresses sharing one
+// of these prefixes with a previous address skip the AES operations of the
+// prefix.
+var (
+	memoLevelsIPv4 = []uint{24}
+	memoLevelsIPv6 = []uint{32, 48, 64}
 )
 
 // KeySizeError is the error returned when the provided key is an invalid
@@ -25,10 +56,12 @@ func (e KeySizeError) Error() string {
 	return "invalid key size " + strconv.Itoa(int(e))
 }
 
+// CreateRandomKey returns Size bytes of keying material read from the system
+// CSPRNG. It panics if the CSPRNG fails, as no safe key can be produced.
 func CreateRandomKey() []byte {
-	key := make([]byte, 32)
-	for i := 0; i < 32; i++ {
-		key[i] = byte(rand.Intn(255) + 1)
+	key := make([]byte, Size)
+	if _, err := rand.Read(key); err != nil {
+		panic("unable to read random key: " + err.Error())
 	}
 	return key
 }
@@ -52,8 +85,46 @@ func (v *bitvector) Bit(idx uint) uint {
 // Cryptopan is an instance of the Crypto-PAn algorithm, initialized with a
 // given key.
 type Cryptopan struct {
+	*cryptopanState
+}
+
+// cryptopanID identifies the state of a key without holding the key
+type cryptopanID struct {
+	hash     [sha256.Size]byte
+	fixedMSB bool
+}
+
+// cryptopanState is the state of Crypto-PAn for a key, shared by the
+// instances created with the key.
+type cryptopanState struct {
+	id cryptopanID
+	// Number of instances using the state, guarded by cryptopanStates
+	refs    int
 	aesImpl cipher.Block
 	pad     bitvector
+	// Whether to use bit pos of the PRF output for bit pos of the one time
+	// pad instead of always using its MSB
+	fixedMSB bool
+	// One time pad of the first precomputedBits bits for every prefix
+	prefixPads []uint16
+	// One time pads of the memoized prefixes, by prefix
+	memo      sync.Map
+	memoCount atomic.Int64
+}
+
+// memoKey identifies a memoized address prefix
+type memoKey struct {
+	bits   uint
+	prefix [8]byte
+}
+
+// padBit returns the bit of the PRF output used for bit pos of the one time
+// pad.
+func (ctx *cryptopanState) padBit(output *bitvector, pos uint) uint {
+	if ctx.fixedMSB {
+		return output.Bit(pos)
+	}
+	return output.Bit(0)
 }
 
 // Anonymize anonymizes the provided IP address with the Crypto-PAn algorithm.
@@ -79,15 +150,28 @@ func (ctx *Cryptopan) anonymize(addr net.IP) []byte {
 	addrBits := uint(len(addr) * 8)
 	var origAddr, input, output, toXor bitvector
 	copy(origAddr[:], addr[:])
-	copy(input[:], ctx.pad[:])
 
-	// The first bit does not take any bits from orig_addr.
-	ctx.aesImpl.Encrypt(output[:], input[:])
-	toXor.SetBit(0, output.Bit(0))
+	// The first bits of the one time pad only depend on the first bits of
+	// the address, and are either precomputed or memoized.
+	binary.BigEndian.PutUint16(toXor[:], ctx.prefixPads[binary.BigEndian.Uint16(origAddr[:])])
+	start := uint(precomputedBits)
+	levels := memoLevelsIPv4
+	if addrBits > 32 {
+		levels = memoLevelsIPv6
+	}
+	for i := len(levels) - 1; i >= 0; i-- {
+		if pad, ok := ctx.memo.Load(newMemoKey(&origAddr, levels[i])); ok {
+			toXor = pad.(bitvector)
+			start = levels[i]
+			break
+		}
+	}
+	copy(input[:], ctx.pad[:])
+	copy(input[:start/8], origAddr[:start/8])
 
 	// The rest of the one time pad is build by copying orig_addr into the AES
 	// input bit by bit (MSB first) and encrypting with ECB-AES128.
-	for pos := uint(1); pos < addrBits; pos++ {
+	for pos := start; pos < addrBits; pos++ {
 		// Copy an additional bit into input from orig_addr.
 		input.SetBit(pos-1, origAddr.Bit(pos-1))
 
@@ -101,8 +185,15 @@ func (ctx *Cryptopan) anonymize(addr net.IP) []byte {
 		// happened, and no one else does that.
 		//
 		// Something like: toXor.SetBit(pos, output.Bit(pos)) will fix this,
-		// but will lead to different output than every other implementation.
-		toXor.SetBit(pos, output.Bit(0))
+		// but will lead to different output than every other implementation,
+		// so it is only done by the fixed MSB variant.
+		toXor.SetBit(pos, ctx.padBit(&output, pos))
+
+		for _, level := range levels {
+			if pos+1 == level && level > start {
+				ctx.memoize(newMemoKey(&origAddr, level), toXor)
+			}
+		}
 	}
 
 	// Xor the pseudorandom one-time-pad with the address and return.
@@ -112,17 +203,134 @@ func (ctx *Cryptopan) anonymize(addr net.IP) []byte {
 	return toXor[:len(addr)]
 }
 
+func newMemoKey(addr *bitvector, bits uint) memoKey {
+	key := memoKey{bits: bits}
+	copy(key.prefix[:bits/8], addr[:bits/8])
+	return key
+}
+
+// memoize stores the one time pad of a prefix, unless too many prefixes are
+// already memoized for all the keys.
+func (ctx *Cryptopan) memoize(key memoKey, pad bitvector) {
+	if memoizedPrefixes.Load() >= maxMemoizedPrefixes {
+		return
+	}
+	if _, loaded := ctx.memo.LoadOrStore(key, pad); !loaded {
+		ctx.memoCount.Add(1)
+		memoizedPrefixes.Add(1)
+	}
+}
+
+// precompute fills the one time pads of all the prefixes of precomputedBits
+// bits, walking the tree of prefixes so that every AES input is only
+// encrypted once.
+func (ctx *cryptopanState) precompute() {
+	ctx.prefixPads = make([]uint16, 1<<precomputedBits)
+	// AES input of every level of the walk, allocated once
+	inputs := make([]bitvector, precomputedBits)
+	var output bitvector
+	var walk func(prefix uint, bits uint, pad uint16)
+	walk = func(prefix uint, bits uint, pad uint16) {
+		if bits == precomputedBits {
+			ctx.prefixPads[prefix] = pad
+			return
+		}
+		input := &inputs[bits]
+		if bits == 0 {
+			*input = ctx.pad
+		} else {
+			*input = inputs[bits-1]
+			input.SetBit(bits-1, prefix&1)
+		}
+		ctx.aesImpl.Encrypt(output[:], input[:])
+		pad |= uint16(ctx.padBit(&output, bits)) << (precomputedBits - 1 - bits)
+		walk(prefix<<1, bits+1, pad)
+		walk(prefix<<1|1, bits+1, pad)
+	}
+	walk(0, 0, 0)
+}
+
+// Deanonymize recovers the original IP address from an address anonymized
+// with the same key.
+func (ctx *Cryptopan) Deanonymize(addr net.IP) net.IP {
+	var origAddr []byte
+	if v4addr := addr.To4(); v4addr != nil {
+		origAddr = ctx.deanonymize(v4addr)
+		return net.IPv4(origAddr[0], origAddr[1], origAddr[2], origAddr[3])
+	} else if v6addr := addr.To16(); v6addr != nil {
+		origAddr = ctx.deanonymize(v6addr)
+		addr := make(net.IP, net.IPv6len)
+		copy(addr[:], origAddr[:])
+		return addr
+	}
+
+	panic("unsupported address type")
+}
+
+func (ctx *Cryptopan) deanonymize(addr net.IP) []byte {
+	addrBits := uint(len(addr) * 8)
+	var obfsAddr, origAddr, input, output bitvector
+	copy(obfsAddr[:], addr[:])
+	copy(input[:], ctx.pad[:])
+
+	// Bit pos of the one time pad only depends on the first pos bits of the
+	// original address, so the original address can be recovered MSB first.
+	for pos := uint(0); pos < addrBits; pos++ {
+		if pos > 0 {
+			input.SetBit(pos-1, origAddr.Bit(pos-1))
+		}
+		ctx.aesImpl.Encrypt(output[:], input[:])
+		origAddr.SetBit(pos, obfsAddr.Bit(pos)^ctx.padBit(&output, pos))
+	}
+	return origAddr[:len(addr)]
+}
+
 // NewCryptoPAn constructs and initializes Crypto-PAn with a given key.
 func NewCryptoPAn(key []byte) (ctx *Cryptopan, err error) {
+	return newCryptoPAn(key, false)
+}
+
+// NewCryptoPAnFixedMSB constructs the variant of Crypto-PAn that uses a
+// different bit of the PRF output for every bit of the address. Its output is
+// not compatible with the other Crypto-PAn implementations.
+func NewCryptoPAnFixedMSB(key []byte) (ctx *Cryptopan, err error) {
+	return newCryptoPAn(key, true)
+}
+
+func newCryptoPAn(key []byte, fixedMSB bool) (ctx *Cryptopan, err error) {
 	if len(key) != Size {
 		return nil, KeySizeError(len(key))
 	}
 
-	ctx = new(Cryptopan)
-	if ctx.aesImpl, err = aes.NewCipher(key[0:keySize]); err != nil {
-		return nil, err
+	id := cryptopanID{hash: sha256.Sum256(key), fixedMSB: fixedMSB}
+	cryptopanStates.Lock()
+	defer cryptopanStates.Unlock()
+	state := cryptopanStates.m[id]
+	if state == nil {
+		state = &cryptopanState{id: id, fixedMSB: fixedMSB}
+		if state.aesImpl, err = aes.NewCipher(key[0:keySize]); err != nil {
+			return nil, err
+		}
+		state.aesImpl.Encrypt(state.pad[:], key[keySize:])
+		state.precompute()
+		cryptopanStates.m[id] = state
 	}
-	ctx.aesImpl.Encrypt(ctx.pad[:], key[keySize:])
+	state.refs++
 
+	ctx = &Cryptopan{cryptopanState: state}
+	// The state of a key is released with its last instance, e.g. when the
+	// key is rotated
+	runtime.SetFinalizer(ctx, (*Cryptopan).release)
 	return
 }
+
+// release releases the state of the key of an instance that is no longer
+// used.
+func (ctx *Cryptopan) release() {
+	cryptopanStates.Lock()
+	defer cryptopanStates.Unlock()
+	if ctx.refs--; ctx.refs == 0 {
+		delete(cryptopanStates.m, ctx.id)
+		memoizedPrefixes.Add(-ctx.memoCount.Load())
+	}
+}
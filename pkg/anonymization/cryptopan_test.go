@@ -29,7 +29,9 @@ package anonymization
 
 import (
 	"net"
+	"runtime"
 	"testing"
+	"time"
 )
 
 // testKey is the key used in the original Crypto-PAn source distribution
@@ -222,6 +224,23 @@ func TestCryptopanIPv4Keys(t *testing.T) {
 	}
 }
 
+// TestCryptopanDeanonymize tests that the test vectors can be reversed.
+func TestCryptopanDeanonymize(t *testing.T) {
+	cpan, err := NewCryptoPAn(testKey)
+	if err != nil {
+		t.Fatal("NewCryptoPAn(testKey) failed:", err)
+	}
+
+	for _, vec := range append(v4Vectors, v6Vectors...) {
+		origAddr := net.ParseIP(vec.origAddr)
+		obfsAddr := net.ParseIP(vec.obfsAddr)
+		testAddr := cpan.Deanonymize(obfsAddr)
+		if !origAddr.Equal(testAddr) {
+			t.Errorf("%s -> %s != %s", obfsAddr, testAddr, origAddr)
+		}
+	}
+}
+
 // BenchmarkCryptopanIPv4 benchmarks annonymizing IPv4 addresses.
 func BenchmarkCryptopanIPv4(b *testing.B) {
 	cpan, err := NewCryptoPAn(testKey)
@@ -249,3 +268,162 @@ func BenchmarkCryptopanIPv6(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+// referenceAnonymize is the bit by bit Crypto-PAn algorithm, without
+// precomputed or memoized pads.
+func referenceAnonymize(ctx *Cryptopan, addr []byte) []byte {
+	var origAddr, input, output, toXor bitvector
+	copy(origAddr[:], addr)
+	copy(input[:], ctx.pad[:])
+	for pos := uint(0); pos < uint(len(addr)*8); pos++ {
+		if pos > 0 {
+			input.SetBit(pos-1, origAddr.Bit(pos-1))
+		}
+		ctx.aesImpl.Encrypt(output[:], input[:])
+		toXor.SetBit(pos, ctx.padBit(&output, pos))
+	}
+	for i := range addr {
+		toXor[i] ^= origAddr[i]
+	}
+	return toXor[:len(addr)]
+}
+
+// TestCryptopanPrecomputed tests that the precomputed and memoized pads give
+// the same results as the bit by bit algorithm, for addresses sharing
+// prefixes of all lengths.
+func TestCryptopanPrecomputed(t *testing.T) {
+	for _, fixedMSB := range []bool{false, true} {
+		cpan, err := newCryptoPAn(CreateRandomKey(), fixedMSB)
+		if err != nil {
+			t.Fatal("newCryptoPAn failed:", err)
+		}
+		var addrs []net.IP
+		for _, vec := range append(v4Vectors, v6Vectors...) {
+			base := net.ParseIP(vec.origAddr)
+			addrs = append(addrs, base)
+			if v4 := base.To4(); v4 != nil {
+				base = v4
+			}
+			// Flip one bit at every position to share every prefix length
+			for bit := 0; bit < len(base)*8; bit++ {
+				addr := append(net.IP(nil), base...)
+				addr[bit/8] ^= 0x80 >> (bit % 8)
+				addrs = append(addrs, addr)
+			}
+		}
+		// Twice, to use the memoized pads
+		for i := 0; i < 2; i++ {
+			for _, addr := range addrs {
+				want := referenceAnonymize(cpan, addr)
+				if v4 := addr.To4(); v4 != nil {
+					want = referenceAnonymize(cpan, v4)
+				}
+				if got := cpan.Anonymize(addr); !got.Equal(net.IP(want)) {
+					t.Fatalf("fixedMSB=%v %s -> %s != %s", fixedMSB, addr, got, net.IP(want))
+				}
+			}
+		}
+	}
+}
+
+// TestCryptopanShared tests that the instances created with the same key share
+// its state, which is released with the last one.
+func TestCryptopanShared(t *testing.T) {
+	key := CreateRandomKey()
+	a, _ := NewCryptoPAn(key)
+	b, _ := NewCryptoPAn(append([]byte(nil), key...))
+	msb, _ := NewCryptoPAnFixedMSB(key)
+	if a.cryptopanState != b.cryptopanState || a.cryptopanState == msb.cryptopanState {
+		t.Fatal("States not shared by key and variant")
+	}
+	a.Anonymize(net.ParseIP("192.0.2.1"))
+	if b.memoCount.Load() != 1 {
+		t.Errorf("%d prefixes memoized", b.memoCount.Load())
+	}
+
+	id := a.id
+	a, b = nil, nil
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		cryptopanStates.Lock()
+		_, ok := cryptopanStates.m[id]
+		cryptopanStates.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("State not released")
+}
+
+// BenchmarkCryptopanIPv6Vectors benchmarks anonymizing the IPv6 test vectors,
+// checking the results.
+func BenchmarkCryptopanIPv6Vectors(b *testing.B) {
+	cpan, err := NewCryptoPAn(testKey)
+	if err != nil {
+		b.Fatal("NewCryptoPAn(testKey) failed:", err)
+	}
+	var origAddrs, obfsAddrs []net.IP
+	for _, vec := range v6Vectors {
+		origAddrs = append(origAddrs, net.ParseIP(vec.origAddr))
+		obfsAddrs = append(obfsAddrs, net.ParseIP(vec.obfsAddr))
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		j := i % len(origAddrs)
+		if !cpan.Anonymize(origAddrs[j]).Equal(obfsAddrs[j]) {
+			b.Fatalf("%s not anonymized to %s", origAddrs[j], obfsAddrs[j])
+		}
+	}
+}
+
+// BenchmarkCryptopanIPv6Reference benchmarks the bit by bit algorithm on the
+// IPv6 test vectors.
+func BenchmarkCryptopanIPv6Reference(b *testing.B) {
+	cpan, err := NewCryptoPAn(testKey)
+	if err != nil {
+		b.Fatal("NewCryptoPAn(testKey) failed:", err)
+	}
+	var origAddrs []net.IP
+	for _, vec := range v6Vectors {
+		origAddrs = append(origAddrs, net.ParseIP(vec.origAddr))
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_ = referenceAnonymize(cpan, origAddrs[i%len(origAddrs)])
+	}
+}
+
+// BenchmarkCryptopanIPv4Vectors benchmarks anonymizing the IPv4 test vectors,
+// checking the results.
+func BenchmarkCryptopanIPv4Vectors(b *testing.B) {
+	cpan, err := NewCryptoPAn(testKey)
+	if err != nil {
+		b.Fatal("NewCryptoPAn(testKey) failed:", err)
+	}
+	var origAddrs, obfsAddrs []net.IP
+	for _, vec := range v4Vectors {
+		origAddrs = append(origAddrs, net.ParseIP(vec.origAddr))
+		obfsAddrs = append(obfsAddrs, net.ParseIP(vec.obfsAddr))
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		j := i % len(origAddrs)
+		if !cpan.Anonymize(origAddrs[j]).Equal(obfsAddrs[j]) {
+			b.Fatalf("%s not anonymized to %s", origAddrs[j], obfsAddrs[j])
+		}
+	}
+}
+
+// BenchmarkNewCryptoPAn benchmarks the creation of a key, including the
+// precomputation of the prefix pads.
+func BenchmarkNewCryptoPAn(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := NewCryptoPAn(testKey); err != nil {
+			b.Fatal("NewCryptoPAn(testKey) failed:", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package anonymization
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+)
+
+// epochKeyInfo is the HKDF context string used to derive per-epoch keys.
+const epochKeyInfo = "traffic-anonymization crypto-pan epoch key "
+
+// hkdf implements HKDF-SHA256 as described in RFC 5869.
+func hkdf(secret, salt, info []byte, length int) []byte {
+	return hkdfExpand(hkdfExtract(secret, salt), info, length)
+}
+
+// hkdfExtract is the extract step of HKDF-SHA256.
+func hkdfExtract(secret, salt []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	return extractor.Sum(nil)
+}
+
+// hkdfExpand is the expand step of HKDF-SHA256.
+func hkdfExpand(prk, info []byte, length int) []byte {
+	expander := hmac.New(sha256.New, prk)
+	var out, prev []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expander.Reset()
+		expander.Write(prev)
+		expander.Write(info)
+		expander.Write([]byte{counter})
+		prev = expander.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+// EpochID returns the identifier of the key epoch starting at start. The
+// identifier is independent of the local time zone, so sensors in different
+// locations agree on it.
+func EpochID(start time.Time) string {
+	return start.UTC().Format(time.RFC3339)
+}
+
+// DeriveEpochKey derives the Crypto-PAn key of an epoch from a master secret.
+// The same master secret and epoch identifier always produce the same key.
+func DeriveEpochKey(master []byte, epochID string) []byte {
+	return hkdf(master, nil, []byte(epochKeyInfo+epochID), Size)
+}
@@ -0,0 +1,36 @@
+package anonymization
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// TestHKDF tests against test case 1 of RFC 5869.
+func TestHKDF(t *testing.T) {
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm, _ := hex.DecodeString("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865")
+
+	if out := hkdf(ikm, salt, info, len(okm)); !bytes.Equal(out, okm) {
+		t.Errorf("hkdf = %x != %x", out, okm)
+	}
+}
+
+// TestDeriveEpochKey makes sure keys are reproducible and differ across
+// epochs.
+func TestDeriveEpochKey(t *testing.T) {
+	k1 := DeriveEpochKey(testKey, "2024-01-01T02:00:00Z")
+	k2 := DeriveEpochKey(testKey, "2024-01-01T02:00:00Z")
+	k3 := DeriveEpochKey(testKey, "2024-01-02T02:00:00Z")
+	if len(k1) != Size {
+		t.Fatalf("Derived key has size %d", len(k1))
+	}
+	if !bytes.Equal(k1, k2) {
+		t.Errorf("Same epoch produced different keys %x != %x", k1, k2)
+	}
+	if bytes.Equal(k1, k3) {
+		t.Errorf("Different epochs produced the same key %x", k1)
+	}
+}
@@ -0,0 +1,187 @@
+package anonymization
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// escrowKeyInfo is the HKDF context string used to derive the key sealing an
+// escrow entry.
+const escrowKeyInfo = "traffic-anonymization key escrow"
+
+// EscrowEntry is an epoch key sealed to the escrow public key. Entries are
+// stored one per line in the archive.
+type EscrowEntry struct {
+	// Identifier of the key epoch
+	EpochID string
+	// Time the key started being used
+	Start time.Time
+	// Scheduled end of the epoch, zero if keys are never rotated
+	End time.Time
+	// Ephemeral X25519 public key of the sender
+	EphemeralKey []byte
+	// AES-GCM nonce
+	Nonce []byte
+	// Sealed epoch key
+	Ciphertext []byte
+}
+
+// Escrow appends the keys of every epoch to an archive, encrypted to a public
+// key whose private counterpart is kept offline.
+type Escrow struct {
+	path string
+	pub  *ecdh.PublicKey
+	mu   sync.Mutex
+}
+
+// NewEscrow creates an escrow writing to the archive at path and sealing keys
+// to the X25519 public key stored hex encoded in publicKeyFile.
+func NewEscrow(path string, publicKeyFile string) (*Escrow, error) {
+	pub, err := LoadEscrowPublicKey(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Escrow{path: path, pub: pub}, nil
+}
+
+// GenerateEscrowKeys creates a new X25519 key pair for the escrow.
+func GenerateEscrowKeys() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func readHexFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(string(bytes.TrimSpace(data)))
+}
+
+// LoadEscrowPublicKey reads a hex encoded X25519 public key.
+func LoadEscrowPublicKey(path string) (*ecdh.PublicKey, error) {
+	data, err := readHexFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("escrow public key %s: %w", path, err)
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+// LoadEscrowPrivateKey reads a hex encoded X25519 private key.
+func LoadEscrowPrivateKey(path string) (*ecdh.PrivateKey, error) {
+	data, err := readHexFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("escrow private key %s: %w", path, err)
+	}
+	return ecdh.X25519().NewPrivateKey(data)
+}
+
+// escrowAEAD derives the AES-GCM instance used to seal an entry from the
+// X25519 shared secret.
+func escrowAEAD(secret []byte, ephemeral []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdf(secret, ephemeral, []byte(escrowKeyInfo), 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts the key of an epoch and appends it to the archive.
+func (e *Escrow) Seal(epochID string, start, end time.Time, key []byte) error {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	secret, err := ephemeral.ECDH(e.pub)
+	if err != nil {
+		return err
+	}
+	entry := EscrowEntry{
+		EpochID:      epochID,
+		Start:        start.UTC(),
+		EphemeralKey: ephemeral.PublicKey().Bytes(),
+	}
+	if !end.IsZero() {
+		entry.End = end.UTC()
+	}
+	aead, err := escrowAEAD(secret, entry.EphemeralKey)
+	if err != nil {
+		return err
+	}
+	entry.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(entry.Nonce); err != nil {
+		return err
+	}
+	entry.Ciphertext = aead.Seal(nil, entry.Nonce, key, []byte(epochID))
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, err := os.OpenFile(e.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	// The entry must survive a crash of the sensor
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadEscrow returns all the entries of an archive, oldest first.
+func ReadEscrow(path string) ([]EscrowEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []EscrowEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		entry := EscrowEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("escrow archive %s line %d: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Unseal decrypts the epoch key of the entry with the escrow private key.
+func (entry *EscrowEntry) Unseal(priv *ecdh.PrivateKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(entry.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := escrowAEAD(secret, entry.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, entry.Nonce, entry.Ciphertext, []byte(entry.EpochID))
+}
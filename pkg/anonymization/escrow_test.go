@@ -0,0 +1,91 @@
+package anonymization
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEscrow seals two keys and makes sure they can be unsealed only with the
+// escrow private key.
+func TestEscrow(t *testing.T) {
+	dir := t.TempDir()
+	priv, err := GenerateEscrowKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubFile := filepath.Join(dir, "escrow.pub")
+	if err := os.WriteFile(pubFile, []byte(hex.EncodeToString(priv.PublicKey().Bytes())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "escrow.log")
+	escrow, err := NewEscrow(archive, pubFile)
+	if err != nil {
+		t.Fatal("NewEscrow failed:", err)
+	}
+	start := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	keys := [][]byte{CreateRandomKey(), CreateRandomKey()}
+	for i, key := range keys {
+		s := start.AddDate(0, 0, i)
+		if err := escrow.Seal(EpochID(s), s, s.AddDate(0, 0, 1), key); err != nil {
+			t.Fatal("Seal failed:", err)
+		}
+	}
+
+	entries, err := ReadEscrow(archive)
+	if err != nil {
+		t.Fatal("ReadEscrow failed:", err)
+	}
+	if len(entries) != len(keys) {
+		t.Fatalf("Read %d entries, expected %d", len(entries), len(keys))
+	}
+	for i, entry := range entries {
+		key, err := entry.Unseal(priv)
+		if err != nil {
+			t.Fatal("Unseal failed:", err)
+		}
+		if !bytes.Equal(key, keys[i]) {
+			t.Errorf("Entry %d unsealed to %x, expected %x", i, key, keys[i])
+		}
+	}
+
+	other, _ := GenerateEscrowKeys()
+	if _, err := entries[0].Unseal(other); err == nil {
+		t.Error("Unseal succeeded with the wrong private key")
+	}
+}
+
+// TestEscrowFailure makes sure that a key that could not be escrowed is not
+// used.
+func TestEscrowFailure(t *testing.T) {
+	dir := t.TempDir()
+	priv, err := GenerateEscrowKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubFile := filepath.Join(dir, "escrow.pub")
+	if err := os.WriteFile(pubFile, []byte(hex.EncodeToString(priv.PublicKey().Bytes())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	escrow, err := NewEscrow(filepath.Join(dir, "escrow.log"), pubFile)
+	if err != nil {
+		t.Fatal("NewEscrow failed:", err)
+	}
+	rotation := &RotationPolicy{Kind: RotationDaily, Location: time.UTC}
+	am := NewAModule(AModuleConfiguration{Anonymize: true, Escrow: escrow, Rotation: rotation})
+	defer am.Stop()
+	epochID := am.EpochID()
+
+	// The archive can no longer be written
+	escrow.path = filepath.Join(dir, "missing", "escrow.log")
+	if err := am.rotate(rotation.Next(time.Now())); err == nil {
+		t.Fatal("Rotation succeeded without escrowing the key")
+	}
+	if am.EpochID() != epochID {
+		t.Errorf("Switched to epoch %s without escrowing its key", am.EpochID())
+	}
+}
@@ -0,0 +1,169 @@
+package anonymization
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+const (
+	// Number of independently locked parts of the flow table
+	flowShards = 16
+	// Idle time after which a flow is forgotten if not configured
+	defaultFlowTimeout = 5 * time.Minute
+)
+
+// flowKey identifies a flow in both directions, with the endpoints in a
+// canonical order
+type flowKey struct {
+	protocol uint8
+	addrA    [net.IPv6len]byte
+	addrB    [net.IPv6len]byte
+	portA    uint16
+	portB    uint16
+}
+
+func newFlowKey(protocol uint8, srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) flowKey {
+	key := flowKey{protocol: protocol}
+	var src, dst [net.IPv6len]byte
+	copy(src[:], srcIP.To16())
+	copy(dst[:], dstIP.To16())
+	if c := compareAddr(src, dst); c < 0 || c == 0 && srcPort <= dstPort {
+		key.addrA, key.portA, key.addrB, key.portB = src, srcPort, dst, dstPort
+	} else {
+		key.addrA, key.portA, key.addrB, key.portB = dst, dstPort, src, srcPort
+	}
+	return key
+}
+
+// transportProtocol returns the IP protocol number of the transport layer of a
+// packet.
+func transportProtocol(pkt *network.Packet) uint8 {
+	switch {
+	case pkt.IsTCP:
+		return uint8(layers.IPProtocolTCP)
+	case pkt.IsUDP:
+		return uint8(layers.IPProtocolUDP)
+	case pkt.IsICMP4:
+		return uint8(layers.IPProtocolICMPv4)
+	case pkt.IsICMP6:
+		return uint8(layers.IPProtocolICMPv6)
+	}
+	return 0
+}
+
+func compareAddr(a, b [net.IPv6len]byte) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return int(a[i]) - int(b[i])
+		}
+	}
+	return 0
+}
+
+// flowEntry is the key epoch of a flow
+type flowEntry struct {
+	epoch    *epochContext
+	lastSeen int64
+}
+
+// flowTable remembers the key epoch of the active flows, so that flows active
+// at a rotation keep being anonymized with the key of the previous epoch. Flows
+// are only tracked during the timeout before a rotation, and looked up while
+// flows kept in the previous epoch remain, so that the other packets do not
+// take any lock.
+type flowTable struct {
+	timeout int64
+	seed    maphash.Seed
+	// Time from which new flows are tracked, the timeout before the next
+	// rotation
+	trackFrom atomic.Int64
+	// Number of tracked flows
+	size   atomic.Int64
+	shards [flowShards]flowShard
+}
+
+type flowShard struct {
+	mu    sync.Mutex
+	flows map[flowKey]flowEntry
+}
+
+func newFlowTable(timeout time.Duration) *flowTable {
+	if timeout <= 0 {
+		timeout = defaultFlowTimeout
+	}
+	ft := &flowTable{timeout: int64(timeout), seed: maphash.MakeSeed()}
+	for i := range ft.shards {
+		ft.shards[i].flows = make(map[flowKey]flowEntry)
+	}
+	return ft
+}
+
+// track sets the start of the next key epoch, new flows being tracked from
+// the timeout before it.
+func (ft *flowTable) track(next time.Time) {
+	ft.trackFrom.Store(next.UnixNano() - ft.timeout)
+}
+
+func (ft *flowTable) shard(key *flowKey) *flowShard {
+	// The key is canonical, so both directions share a shard
+	var b [2*net.IPv6len + 5]byte
+	copy(b[:], key.addrA[:])
+	copy(b[net.IPv6len:], key.addrB[:])
+	binary.BigEndian.PutUint16(b[2*net.IPv6len:], key.portA)
+	binary.BigEndian.PutUint16(b[2*net.IPv6len+2:], key.portB)
+	b[2*net.IPv6len+4] = key.protocol
+	return &ft.shards[maphash.Bytes(ft.seed, b[:])%flowShards]
+}
+
+// epoch returns the key epoch of a flow seen at now. Flows that are new, were
+// idle for longer than the timeout or started before the previous epoch use
+// the current epoch.
+func (ft *flowTable) epoch(key flowKey, now int64, current *epochContext) *epochContext {
+	tracking := now >= ft.trackFrom.Load()
+	if !tracking && ft.size.Load() == 0 {
+		return current
+	}
+	shard := ft.shard(&key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	e, ok := shard.flows[key]
+	if !ok || now-e.lastSeen > ft.timeout || current.seq-e.epoch.seq > 1 {
+		e.epoch = current
+	}
+	if e.epoch == current && !tracking {
+		// Only the flows kept in the previous epoch are looked up
+		if ok {
+			delete(shard.flows, key)
+			ft.size.Add(-1)
+		}
+		return current
+	}
+	if !ok {
+		ft.size.Add(1)
+	}
+	e.lastSeen = now
+	shard.flows[key] = e
+	return e.epoch
+}
+
+// expire forgets the flows idle since longer than the timeout.
+func (ft *flowTable) expire(now int64) {
+	for i := range ft.shards {
+		shard := &ft.shards[i]
+		shard.mu.Lock()
+		for key, e := range shard.flows {
+			if now-e.lastSeen > ft.timeout {
+				delete(shard.flows, key)
+				ft.size.Add(-1)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
@@ -0,0 +1,106 @@
+package anonymization
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TestFlowTable tests that flows active at a rotation keep their epoch until
+// they are idle or a second rotation happens.
+func TestFlowTable(t *testing.T) {
+	ft := newFlowTable(time.Minute)
+	epochs := []*epochContext{{epochID: "0", seq: 0}, {epochID: "1", seq: 1}, {epochID: "2", seq: 2}}
+
+	tcp := uint8(layers.IPProtocolTCP)
+	client, server := net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.7")
+	flow := newFlowKey(tcp, client, 40000, server, 443)
+	if newFlowKey(tcp, server, 443, client, 40000) != flow {
+		t.Fatal("Both directions of a flow have different keys")
+	}
+	other := newFlowKey(tcp, client, 40000, net.ParseIP("198.51.100.8"), 443)
+
+	now := time.Now().UnixNano()
+	second := int64(time.Second)
+	if e := ft.epoch(flow, now, epochs[0]); e != epochs[0] {
+		t.Errorf("New flow in epoch %s", e.epochID)
+	}
+	// Rotation
+	if e := ft.epoch(flow, now+second, epochs[1]); e != epochs[0] {
+		t.Errorf("Active flow moved to epoch %s", e.epochID)
+	}
+	if e := ft.epoch(other, now+second, epochs[1]); e != epochs[1] {
+		t.Errorf("New flow in epoch %s", e.epochID)
+	}
+	// Second rotation
+	if e := ft.epoch(flow, now+2*second, epochs[2]); e != epochs[2] {
+		t.Errorf("Flow kept epoch %s after two rotations", e.epochID)
+	}
+	if e := ft.epoch(other, now+2*second, epochs[2]); e != epochs[1] {
+		t.Errorf("Active flow moved to epoch %s", e.epochID)
+	}
+	// Idle for longer than the timeout
+	if e := ft.epoch(other, now+2*int64(time.Minute), epochs[2]); e != epochs[2] {
+		t.Errorf("Idle flow kept epoch %s", e.epochID)
+	}
+
+	ft.expire(now + 10*int64(time.Minute))
+	for i := range ft.shards {
+		if len(ft.shards[i].flows) != 0 {
+			t.Error("Idle flows not expired")
+		}
+	}
+	if ft.size.Load() != 0 {
+		t.Errorf("%d flows counted after expiry", ft.size.Load())
+	}
+
+	// Flows are only tracked in the timeout before a rotation
+	now += 20 * int64(time.Minute)
+	ft.track(time.Unix(0, now+int64(time.Hour)))
+	if e := ft.epoch(flow, now, epochs[2]); e != epochs[2] || ft.size.Load() != 0 {
+		t.Errorf("Flow tracked far from a rotation, %d flows", ft.size.Load())
+	}
+	now += int64(time.Hour) - second
+	ft.epoch(flow, now, epochs[2])
+	ft.track(time.Unix(0, now+int64(24*time.Hour)))
+	next := &epochContext{epochID: "3", seq: 3}
+	if e := ft.epoch(flow, now+2*second, next); e != epochs[2] || ft.size.Load() != 1 {
+		t.Errorf("Flow active at a rotation moved to epoch %s", e.epochID)
+	}
+	// Flows that are not kept in the previous epoch are forgotten
+	if e := ft.epoch(other, now+2*second, next); e != next || ft.size.Load() != 1 {
+		t.Errorf("New flow tracked after a rotation, %d flows", ft.size.Load())
+	}
+}
+
+// benchmarkFlowTable looks up the epoch of many flows from parallel threads,
+// tracking them or not.
+func benchmarkFlowTable(b *testing.B, tracking bool) {
+	ft := newFlowTable(time.Minute)
+	now := time.Now()
+	if tracking {
+		ft.track(now)
+	} else {
+		ft.track(now.Add(time.Hour))
+	}
+	epoch := &epochContext{epochID: "0"}
+	tcp := uint8(layers.IPProtocolTCP)
+	server := net.ParseIP("198.51.100.7")
+	b.RunParallel(func(pb *testing.PB) {
+		client := net.IPv4(192, 0, 2, 1)
+		for i := 0; pb.Next(); i++ {
+			client[15] = byte(i)
+			ft.epoch(newFlowKey(tcp, client, uint16(i>>8), server, 443), now.UnixNano(), epoch)
+		}
+	})
+}
+
+func BenchmarkFlowTable(b *testing.B) {
+	benchmarkFlowTable(b, false)
+}
+
+func BenchmarkFlowTableTracking(b *testing.B) {
+	benchmarkFlowTable(b, true)
+}
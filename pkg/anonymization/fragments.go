@@ -0,0 +1,166 @@
+package anonymization
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+const (
+	// Time after which a fragmented datagram is forgotten if not configured
+	defaultFragmentTimeout = 30 * time.Second
+	// Maximum number of fragmented datagrams remembered
+	maxFragmentEntries = 1 << 16
+)
+
+// fragmentKey identifies the fragments of a datagram
+type fragmentKey struct {
+	src      [net.IPv6len]byte
+	dst      [net.IPv6len]byte
+	protocol uint8
+	id       uint32
+}
+
+func newFragmentKey(pkt *network.Packet, srcIP, dstIP net.IP) fragmentKey {
+	var key fragmentKey
+	copy(key.src[:], srcIP.To16())
+	copy(key.dst[:], dstIP.To16())
+	key.protocol = uint8(pkt.Frag.Protocol)
+	key.id = pkt.Frag.ID
+	return key
+}
+
+// fragmentEntry is the handling of a fragmented datagram, decided on its first
+// fragment so that the later ones are handled alike even without ports.
+type fragmentEntry struct {
+	srcRule *PolicyRule
+	dstRule *PolicyRule
+	epoch   *epochContext
+	// Number of bytes of the IP payload to keep, -1 for all
+	keep     int
+	lastSeen int64
+}
+
+// fragmentTable remembers the handling of the datagrams whose first fragment
+// was seen.
+type fragmentTable struct {
+	mu         sync.Mutex
+	timeout    int64
+	lastExpiry int64
+	entries    map[fragmentKey]fragmentEntry
+}
+
+func newFragmentTable(timeout time.Duration) *fragmentTable {
+	if timeout <= 0 {
+		timeout = defaultFragmentTimeout
+	}
+	return &fragmentTable{timeout: int64(timeout), entries: make(map[fragmentKey]fragmentEntry)}
+}
+
+// get returns the handling of the datagram of a fragment seen at now.
+func (ft *fragmentTable) get(key fragmentKey, now int64) (fragmentEntry, bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	e, ok := ft.entries[key]
+	if !ok || now-e.lastSeen > ft.timeout {
+		return fragmentEntry{}, false
+	}
+	e.lastSeen = now
+	ft.entries[key] = e
+	return e, true
+}
+
+// add remembers the handling of a datagram whose first fragment is seen at now.
+// Datagrams idle since longer than the timeout are forgotten meanwhile.
+func (ft *fragmentTable) add(key fragmentKey, e fragmentEntry, now int64) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if now-ft.lastExpiry > ft.timeout {
+		for k, old := range ft.entries {
+			if now-old.lastSeen > ft.timeout {
+				delete(ft.entries, k)
+			}
+		}
+		ft.lastExpiry = now
+	}
+	if len(ft.entries) >= maxFragmentEntries {
+		return
+	}
+	e.lastSeen = now
+	ft.entries[key] = e
+}
+
+// isFirstFragment tells whether a fragment starts its datagram.
+func isFirstFragment(pkt *network.Packet) bool {
+	return pkt.IsFrag && pkt.Frag.Offset == 0
+}
+
+// datagramKeep returns the number of bytes of the IP payload of a datagram to
+// keep, decided on its first fragment: the transport header and the payload
+// allowed by the payload rules, or -1 for all. QUIC payloads are not kept.
+func (am *AModule) datagramKeep(pkt *network.Packet) int {
+	switch {
+	case pkt.IsTCP:
+		if limit := am.payload.Limit(pkt); limit >= 0 {
+			return len(pkt.Tcp.Contents) + limit
+		}
+		return -1
+	case pkt.IsUDP:
+		if isQUIC(pkt.Udp.LayerPayload()) {
+			// The Initial packets can not be scrubbed across fragments
+			return 8
+		}
+		if limit := am.payload.Limit(pkt); limit >= 0 {
+			return 8 + limit
+		}
+		return -1
+	case pkt.Frag.Protocol == layers.IPProtocolICMPv4 || pkt.Frag.Protocol == layers.IPProtocolICMPv6:
+		// Only the ICMP header, the body of fragmented messages is not parsed
+		return 8
+	}
+	return 0
+}
+
+// fragmentData returns the part of the data of a fragment to keep, the bytes
+// among the first keep bytes of the IP payload of its datagram.
+func fragmentData(pkt *network.Packet, keep int) []byte {
+	data := pkt.Frag.Data
+	if keep < 0 {
+		return data
+	}
+	keep -= pkt.Frag.Offset
+	if keep <= 0 {
+		return nil
+	}
+	if keep < len(data) {
+		return data[:keep]
+	}
+	return data
+}
+
+// updateFragmentChecksum returns the data of a first fragment with the
+// transport checksum updated for the new addresses. The checksum covers the
+// whole datagram, so it can not be recomputed.
+func updateFragmentChecksum(pkt *network.Packet, data []byte, srcIP, dstIP, newSrcIP, newDstIP net.IP) []byte {
+	csumOff := -1
+	if pkt.IsTCP {
+		csumOff = 16
+	} else if pkt.IsUDP && pkt.Udp.Checksum != 0 {
+		csumOff = 6
+	}
+	if csumOff < 0 || len(data) < csumOff+2 {
+		return data
+	}
+	// The data is shared with the original packet
+	data = append([]byte(nil), data...)
+	csum := updateAddrChecksum(binary.BigEndian.Uint16(data[csumOff:]), pkt.IsIPv4, srcIP, dstIP, newSrcIP, newDstIP)
+	if csum == 0 && pkt.IsUDP {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(data[csumOff:], csum)
+	return data
+}
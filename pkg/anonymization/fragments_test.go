@@ -0,0 +1,99 @@
+package anonymization
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// serializeTestFragments splits a TCP segment with 40 bytes of payload in two
+// IPv4 fragments.
+func serializeTestFragments(t *testing.T) (first, second []byte) {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: 42, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("198.51.100.7")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, PSH: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, tcp, gopacket.Payload(bytes.Repeat([]byte{'x'}, 40))); err != nil {
+		t.Fatal(err)
+	}
+	segment := buf.Bytes()
+
+	fragment := func(offset, end int, more bool) []byte {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		frag := *ip
+		frag.FragOffset = uint16(offset / 8)
+		if more {
+			frag.Flags = layers.IPv4MoreFragments
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, opts, eth, &frag, gopacket.Payload(segment[offset:end])); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	return fragment(0, 32, true), fragment(32, len(segment), false)
+}
+
+// TestFragments tests that the later fragments of a datagram are handled like
+// the first one.
+func TestFragments(t *testing.T) {
+	policy, err := NewPolicy([]PolicyRule{
+		{Net: mustCIDR("198.51.100.0/24"), Protocol: "tcp", Ports: []uint16{80}, Action: ActionAnonymize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	am := NewAModule(AModuleConfiguration{
+		Key:       []byte("0123456789abcdef0123456789abcdef"),
+		Anonymize: true,
+		LocalNets: []string{"192.0.2.0/24"},
+		Policy:    policy,
+		Checksums: ChecksumsRecompute,
+	})
+	first, second := serializeTestFragments(t)
+
+	var outputs []*layers.IPv4
+	for _, data := range [][]byte{first, second} {
+		pkt := decodeTestPacket(t, data)
+		if !pkt.IsFrag {
+			t.Fatal("Fragment not decoded as such")
+		}
+		if err := am.Anonymize(pkt); err != nil {
+			t.Fatal(err)
+		}
+		out := gopacket.NewPacket(pkt.OutBuf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+		outputs = append(outputs, out.Layer(layers.LayerTypeIPv4).(*layers.IPv4))
+	}
+
+	for i, ip := range outputs {
+		if ip.SrcIP.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("Fragment %d: local source not anonymized", i)
+		}
+		// Only anonymized by the rule of port 80
+		if ip.DstIP.Equal(net.ParseIP("198.51.100.7")) {
+			t.Errorf("Fragment %d: destination not anonymized", i)
+		}
+		if ip.Id != 42 {
+			t.Errorf("Fragment %d: identification %d", i, ip.Id)
+		}
+	}
+	if !outputs[0].SrcIP.Equal(outputs[1].SrcIP) || !outputs[0].DstIP.Equal(outputs[1].DstIP) {
+		t.Error("Fragments of a datagram anonymized differently")
+	}
+	// The TCP header is kept, the payload is stripped
+	if len(outputs[0].Payload) != 20 || outputs[0].Flags != layers.IPv4MoreFragments {
+		t.Errorf("First fragment with %d bytes of data and flags %v", len(outputs[0].Payload), outputs[0].Flags)
+	}
+	if len(outputs[1].Payload) != 0 || outputs[1].FragOffset != 4 {
+		t.Errorf("Second fragment with %d bytes of data and offset %d", len(outputs[1].Payload), outputs[1].FragOffset)
+	}
+}
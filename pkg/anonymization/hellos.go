@@ -0,0 +1,106 @@
+package anonymization
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Time after which the rest of a split ClientHello is forgotten
+	helloTimeout = int64(30 * time.Second)
+	// Maximum number of split ClientHello messages remembered
+	maxHelloEntries = 1 << 16
+)
+
+// helloKey identifies a direction of a TCP connection
+type helloKey struct {
+	src     [net.IPv6len]byte
+	dst     [net.IPv6len]byte
+	srcPort uint16
+	dstPort uint16
+}
+
+func newHelloKey(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) helloKey {
+	key := helloKey{srcPort: srcPort, dstPort: dstPort}
+	copy(key.src[:], srcIP.To16())
+	copy(key.dst[:], dstIP.To16())
+	return key
+}
+
+// helloEntry is the sequence space of the TLS record of a ClientHello that
+// does not end in the TCP segment starting it
+type helloEntry struct {
+	start    uint32
+	end      uint32
+	lastSeen int64
+}
+
+// helloTable remembers the ClientHello messages split over several TCP
+// segments, whose rest can not be parsed without the start, so that it is
+// zeroed in the following segments, retransmitted or not.
+type helloTable struct {
+	mu         sync.Mutex
+	lastExpiry int64
+	// Number of entries, so that segments are not looked up while there are
+	// none
+	size    atomic.Int64
+	entries map[helloKey]helloEntry
+}
+
+func newHelloTable() *helloTable {
+	return &helloTable{entries: make(map[helloKey]helloEntry)}
+}
+
+// add remembers a ClientHello record of n bytes starting at seq, seen at now.
+// Records idle since longer than the timeout are forgotten meanwhile.
+func (ht *helloTable) add(key helloKey, seq uint32, n int, now int64) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if now-ht.lastExpiry > helloTimeout {
+		for k, old := range ht.entries {
+			if now-old.lastSeen > helloTimeout {
+				delete(ht.entries, k)
+			}
+		}
+		ht.lastExpiry = now
+	}
+	if _, ok := ht.entries[key]; !ok && len(ht.entries) >= maxHelloEntries {
+		return
+	}
+	ht.entries[key] = helloEntry{start: seq, end: seq + uint32(n), lastSeen: now}
+	ht.size.Store(int64(len(ht.entries)))
+}
+
+// scrub returns a copy of the payload of a TCP segment starting at seq and
+// seen at now, with the bytes of a split ClientHello zeroed. It returns false
+// if the segment carries none.
+func (ht *helloTable) scrub(key helloKey, seq uint32, payload []byte, now int64) ([]byte, bool) {
+	if len(payload) == 0 || ht.size.Load() == 0 {
+		return payload, false
+	}
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	e, ok := ht.entries[key]
+	if !ok || now-e.lastSeen > helloTimeout {
+		return payload, false
+	}
+	// Offsets of the record in the payload, in the sequence space
+	from := int64(int32(e.start - seq))
+	if from < 0 {
+		from = 0
+	}
+	to := int64(int32(e.end - seq))
+	if to > int64(len(payload)) {
+		to = int64(len(payload))
+	}
+	if from >= to {
+		return payload, false
+	}
+	e.lastSeen = now
+	ht.entries[key] = e
+	out := append([]byte(nil), payload...)
+	zero(out[from:to])
+	return out, true
+}
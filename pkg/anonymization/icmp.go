@@ -0,0 +1,184 @@
+package anonymization
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+// Number of bytes of the transport header of a quoted packet that are kept,
+// the minimum quoted by ICMP (RFC 792). Ports are kept, the rest of the
+// quoted packet is stripped like any other payload.
+const quotedTransportBytes = 8
+
+// icmpQuote is the original packet quoted by an ICMP or ICMPv6 error message
+type icmpQuote struct {
+	// Quoted bytes, as in the message
+	data []byte
+	ipv4 bool
+	// Length of the quoted IP header
+	ipLen    int
+	protocol uint8
+	srcIP    net.IP
+	dstIP    net.IP
+	srcPort  uint16
+	dstPort  uint16
+}
+
+// parseICMPQuote returns the packet quoted by an ICMP or ICMPv6 error message,
+// or nil for other messages and quotes too short to hold an IP header.
+func parseICMPQuote(pkt *network.Packet) *icmpQuote {
+	var data []byte
+	if pkt.IsICMP4 {
+		switch pkt.Icmp4.TypeCode.Type() {
+		case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect,
+			layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+			data = pkt.Icmp4.Payload
+		default:
+			return nil
+		}
+	} else if pkt.IsICMP6 {
+		switch pkt.Icmp6.TypeCode.Type() {
+		case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig,
+			layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+			// After the unused, MTU or pointer field
+			if len(pkt.Icmp6.Payload) < 4 {
+				return nil
+			}
+			data = pkt.Icmp6.Payload[4:]
+		default:
+			return nil
+		}
+	} else {
+		return nil
+	}
+	return newICMPQuote(data)
+}
+
+// newICMPQuote parses the packet quoted by an ICMP or ICMPv6 error message from
+// the quoted bytes, or returns nil if they are too short to hold an IP header.
+func newICMPQuote(data []byte) *icmpQuote {
+	q := &icmpQuote{data: data}
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		q.ipv4 = true
+		q.ipLen = int(data[0]&0x0f) * 4
+		if q.ipLen < 20 || len(data) < q.ipLen {
+			return nil
+		}
+		q.protocol = data[9]
+		q.srcIP, q.dstIP = net.IP(data[12:16]), net.IP(data[16:20])
+	case len(data) >= 40 && data[0]>>4 == 6:
+		q.ipLen = 40
+		q.protocol = data[6]
+		q.srcIP, q.dstIP = net.IP(data[8:24]), net.IP(data[24:40])
+	default:
+		return nil
+	}
+	if (q.protocol == uint8(layers.IPProtocolTCP) || q.protocol == uint8(layers.IPProtocolUDP)) && len(data) >= q.ipLen+4 {
+		q.srcPort = binary.BigEndian.Uint16(data[q.ipLen:])
+		q.dstPort = binary.BigEndian.Uint16(data[q.ipLen+2:])
+	}
+	return q
+}
+
+// rewrite returns the kept part of the quote, the IP header and the first
+// bytes of the transport header, with the new addresses. The checksums of the
+// quoted headers are updated if updateChecksums is set.
+func (q *icmpQuote) rewrite(newSrcIP, newDstIP net.IP, updateChecksums bool) []byte {
+	end := q.ipLen + quotedTransportBytes
+	if end > len(q.data) {
+		end = len(q.data)
+	}
+	out := append([]byte(nil), q.data[:end]...)
+	if q.ipv4 {
+		copy(out[12:], newSrcIP.To4())
+		copy(out[16:], newDstIP.To4())
+	} else {
+		copy(out[8:], newSrcIP.To16())
+		copy(out[24:], newDstIP.To16())
+	}
+	if !updateChecksums {
+		return out
+	}
+
+	if q.ipv4 {
+		csum := binary.BigEndian.Uint16(out[10:])
+		binary.BigEndian.PutUint16(out[10:], updateAddrChecksum(csum, true, q.srcIP, q.dstIP, newSrcIP, newDstIP))
+	}
+	// The quoted TCP checksum is beyond the kept bytes
+	if q.protocol == uint8(layers.IPProtocolUDP) && end >= q.ipLen+8 {
+		if csum := binary.BigEndian.Uint16(out[q.ipLen+6:]); csum != 0 {
+			csum = updateAddrChecksum(csum, q.ipv4, q.srcIP, q.dstIP, newSrcIP, newDstIP)
+			if csum == 0 {
+				csum = 0xffff
+			}
+			binary.BigEndian.PutUint16(out[q.ipLen+6:], csum)
+		}
+	}
+	return out
+}
+
+// anonymizeICMP anonymizes the addresses carried in the body of an ICMP or
+// ICMPv6 message, the gateway of redirects and the addresses of quoted
+// packets, and returns the part of the body to keep. Quoted addresses follow
+// the same rules as the addresses of the packet. It returns false if the
+// quoted packet is dropped by the policy.
+func (am *AModule) anonymizeICMP(epoch *epochContext, pkt *network.Packet, quote *icmpQuote) ([]byte, bool) {
+	if pkt.IsICMP4 && pkt.Icmp4.TypeCode.Type() == layers.ICMPv4TypeRedirect {
+		gateway := net.IP(pkt.Icmp4.Contents[4:8])
+		rule := am.policy.Lookup(gateway, "", 0)
+		if addr := am.anonymizeAddr(epoch, rule, gateway, am.anonymizedByDefault(gateway)); addr != nil {
+			addr = addr.To4()
+			pkt.Icmp4.Id = binary.BigEndian.Uint16(addr)
+			pkt.Icmp4.Seq = binary.BigEndian.Uint16(addr[2:])
+		}
+	}
+
+	var body []byte
+	if pkt.IsICMP6 {
+		// The first word of the body is part of the header of every message
+		body = pkt.Icmp6.Payload
+		if len(body) > 4 {
+			body = body[:4]
+		}
+		body = append([]byte(nil), body...)
+	}
+	if quote == nil {
+		return body, true
+	}
+
+	protocol := ipProtocolName(quote.protocol)
+	srcRule := am.policy.Lookup(quote.srcIP, protocol, quote.srcPort)
+	dstRule := am.policy.Lookup(quote.dstIP, protocol, quote.dstPort)
+	if srcRule != nil && srcRule.Action == ActionDrop || dstRule != nil && dstRule.Action == ActionDrop {
+		return nil, false
+	}
+	newSrcIP, newDstIP := quote.srcIP, quote.dstIP
+	if addr := am.anonymizeAddr(epoch, srcRule, quote.srcIP, am.anonymizedByDefault(quote.srcIP)); addr != nil {
+		newSrcIP = addr
+	}
+	if addr := am.anonymizeAddr(epoch, dstRule, quote.dstIP, am.anonymizedByDefault(quote.dstIP)); addr != nil {
+		newDstIP = addr
+	}
+	return append(body, quote.rewrite(newSrcIP, newDstIP, am.checksums != ChecksumsKeep)...), true
+}
+
+// updateICMPChecksum updates the checksum of an ICMP or ICMPv6 message for the
+// new addresses of the packet and the rewritten header and body. The body is a
+// rewrite of the beginning of the original one.
+func updateICMPChecksum(pkt *network.Packet, srcIP, dstIP, newSrcIP, newDstIP net.IP, body []byte) {
+	if pkt.IsICMP4 {
+		var rest [4]byte
+		binary.BigEndian.PutUint16(rest[:], pkt.Icmp4.Id)
+		binary.BigEndian.PutUint16(rest[2:], pkt.Icmp4.Seq)
+		csum := updateChecksum(pkt.Icmp4.Checksum, pkt.Icmp4.Contents[4:8], rest[:])
+		pkt.Icmp4.Checksum = updateChecksum(csum, pkt.Icmp4.Payload[:len(body)], body)
+	} else if pkt.IsICMP6 {
+		// The ICMPv6 checksum covers the pseudo-header
+		csum := updateAddrChecksum(pkt.Icmp6.Checksum, false, srcIP, dstIP, newSrcIP, newDstIP)
+		pkt.Icmp6.Checksum = updateChecksum(csum, pkt.Icmp6.Payload[:len(body)], body)
+	}
+}
@@ -0,0 +1,114 @@
+package anonymization
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// serializeTestICMPError builds a destination unreachable error sent by a
+// router for the UDP test packet.
+func serializeTestICMPError(t *testing.T, ipv6 bool) []byte {
+	// Without the Ethernet header and padding
+	quote := serializeTestPacket(t, ipv6, false, nil)[14:]
+	if ipv6 {
+		quote = quote[:48]
+	} else {
+		quote = quote[:28]
+	}
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	var l []gopacket.SerializableLayer
+	if ipv6 {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6,
+			SrcIP: net.ParseIP("2001:db8:2::1"), DstIP: net.ParseIP("2001:db8::1")}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)}
+		icmp.SetNetworkLayerForChecksum(ip6)
+		l = []gopacket.SerializableLayer{eth, ip6, icmp, gopacket.Payload(append(make([]byte, 4), quote...))}
+	} else {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4,
+			SrcIP: net.ParseIP("198.51.100.1"), DstIP: net.ParseIP("192.0.2.1")}
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)}
+		l = []gopacket.SerializableLayer{eth, ip4, icmp, gopacket.Payload(quote)}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestICMPError tests that the addresses of packets quoted by ICMP errors are
+// anonymized like the ones of the packet, with valid checksums.
+func TestICMPError(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		var outputs [][]byte
+		for _, mode := range []string{ChecksumsRecompute, ChecksumsPreserveLength} {
+			am := NewAModule(AModuleConfiguration{
+				Key:       []byte("0123456789abcdef0123456789abcdef"),
+				Anonymize: true,
+				LocalNets: []string{"192.0.2.0/24", "2001:db8::/48"},
+				Checksums: mode,
+				InPlace:   true,
+			})
+			data := serializeTestICMPError(t, ipv6)
+			pkt := decodeTestPacket(t, append([]byte(nil), data...))
+			if err := am.Anonymize(pkt); err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, pkt.OutBuf.Bytes())
+		}
+		// The quote is complete, so the incremental updates give the same
+		// checksums as the full computation
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("IPv6 %t: %x != %x", ipv6, outputs[1], outputs[0])
+		}
+
+		out := gopacket.NewPacket(outputs[0], layers.LayerTypeEthernet, gopacket.Default)
+		var src, dst net.IP
+		var msg, quote []byte
+		if ipv6 {
+			ip := out.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+			src, dst = ip.SrcIP, ip.DstIP
+			msg = ip.Payload
+			quote = msg[8:]
+			if csum := transportChecksum(src, dst, uint8(layers.IPProtocolICMPv6), msg); csum != 0 {
+				t.Errorf("Invalid ICMPv6 checksum")
+			}
+			if !bytes.Equal(quote[8:24], dst) {
+				t.Errorf("Quoted source %s instead of %s", net.IP(quote[8:24]), dst)
+			}
+			if csum := transportChecksum(quote[8:24], quote[24:40], uint8(layers.IPProtocolUDP), quote[40:]); csum != 0 {
+				t.Errorf("Invalid quoted UDP checksum")
+			}
+		} else {
+			ip := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			src, dst = ip.SrcIP, ip.DstIP
+			msg = ip.Payload
+			quote = msg[8:]
+			if csum := checksumFold(checksumAdd(0, msg)); csum != 0 {
+				t.Errorf("Invalid ICMP checksum")
+			}
+			if !bytes.Equal(quote[12:16], dst) {
+				t.Errorf("Quoted source %s instead of %s", net.IP(quote[12:16]), dst)
+			}
+			if csum := checksumFold(checksumAdd(0, quote[:20])); csum != 0 {
+				t.Errorf("Invalid quoted IPv4 checksum")
+			}
+			if csum := transportChecksum(quote[12:16], quote[16:20], uint8(layers.IPProtocolUDP), quote[20:]); csum != 0 {
+				t.Errorf("Invalid quoted UDP checksum")
+			}
+		}
+		if dst.Equal(net.ParseIP("192.0.2.1")) || dst.Equal(net.ParseIP("2001:db8::1")) {
+			t.Errorf("Destination %s not anonymized", dst)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package anonymization
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+// minFrameSize is the size of an Ethernet frame without FCS
+const minFrameSize = 60
+
+var errRawBuffer = errors.New("packets rewritten in place can not grow")
+
+// rawBuffer is a SerializeBuffer over the bytes of a packet rewritten in place.
+type rawBuffer struct {
+	data []byte
+}
+
+func (b *rawBuffer) Bytes() []byte {
+	return b.data
+}
+
+func (b *rawBuffer) PrependBytes(num int) ([]byte, error) {
+	return nil, errRawBuffer
+}
+
+func (b *rawBuffer) AppendBytes(num int) ([]byte, error) {
+	return nil, errRawBuffer
+}
+
+func (b *rawBuffer) Clear() error {
+	b.data = b.data[:0]
+	return nil
+}
+
+func (b *rawBuffer) Layers() []gopacket.LayerType {
+	return nil
+}
+
+func (b *rawBuffer) PushLayer(gopacket.LayerType) {}
+
+// offset returns the offset of a layer in the packet. Layers decoded by the
+// reader are subslices of the raw data, so the capacities give the offset.
+func offset(data []byte, contents []byte) int {
+	return cap(data) - cap(contents)
+}
+
+// rewriteInPlace rewrites the addresses of the packet directly in its raw data,
+// truncates the payload to the kept part and updates the checksums
+// incrementally. The output is the same as the one of the full serialization
+// for packets with valid checksums.
+// It returns false, leaving the packet untouched, if the headers must change
+// shape, e.g. to remove VLAN tags when the link layer is not preserved, and
+// for packets other than unfragmented TCP and UDP.
+func (am *AModule) rewriteInPlace(pkt *network.Packet, mac *MACAnonymizer, srcIP, dstIP, newSrcIP, newDstIP net.IP, payload []byte) bool {
+	// ICMP messages are rebuilt, as only part of their body is kept, and so
+	// are fragments, whose transport header is part of their data, and
+	// packets with IPv6 extension headers, which may be stripped, and tunnels,
+	// whose carried packet is rebuilt
+	if !pkt.IsTCP && !pkt.IsUDP || pkt.IsFrag || pkt.IsIPv6 && network.IsIPv6Extension(pkt.Ip6.NextHeader) || pkt.Tunnel.Inner != nil {
+		return false
+	}
+	data := pkt.RawData
+	eth := pkt.Eth
+	if len(eth.Contents) != 14 || offset(data, eth.Contents) != 0 {
+		return false
+	}
+	// Without the original link layer, only untagged frames keep their shape
+	if !am.preserveLinkLayer && !(pkt.IsIPv4 && eth.EthernetType == layers.EthernetTypeIPv4) && !(pkt.IsIPv6 && eth.EthernetType == layers.EthernetTypeIPv6) {
+		return false
+	}
+
+	var ipOff int
+	var src, dst []byte
+	if pkt.IsIPv4 {
+		ipOff = offset(data, pkt.Ip4.Contents)
+		src, dst = newSrcIP.To4(), newDstIP.To4()
+	} else {
+		ipOff = offset(data, pkt.Ip6.Contents)
+		src, dst = newSrcIP.To16(), newDstIP.To16()
+	}
+	var l4Off, csumOff int
+	var protocol uint8
+	if pkt.IsTCP {
+		l4Off = offset(data, pkt.Tcp.Contents)
+		csumOff = l4Off + 16
+		protocol = uint8(layers.IPProtocolTCP)
+	} else {
+		l4Off = offset(data, pkt.Udp.Contents)
+		csumOff = l4Off + 6
+		protocol = uint8(layers.IPProtocolUDP)
+	}
+	end := l4Off + 8
+	if pkt.IsTCP {
+		end = l4Off + len(pkt.Tcp.Contents)
+	}
+	end += len(payload)
+	// Frames are padded to the minimum Ethernet frame size
+	frameEnd := end
+	if frameEnd < minFrameSize {
+		frameEnd = minFrameSize
+	}
+	if frameEnd > len(data) || csumOff+2 > end {
+		return false
+	}
+
+	am.rewriteLinkHeader(data[:ipOff], mac)
+	addrOff := ipOff + 8
+	if pkt.IsIPv4 {
+		addrOff = ipOff + 12
+	}
+	copy(data[addrOff:], src)
+	copy(data[addrOff+len(src):], dst)
+
+	switch am.checksums {
+	case ChecksumsRecompute:
+		if pkt.IsIPv4 {
+			ihl := int(data[ipOff]&0x0f) * 4
+			binary.BigEndian.PutUint16(data[ipOff+2:], uint16(end-ipOff))
+			binary.BigEndian.PutUint16(data[ipOff+10:], 0)
+			binary.BigEndian.PutUint16(data[ipOff+10:], checksumFold(checksumAdd(0, data[ipOff:ipOff+ihl])))
+		} else {
+			binary.BigEndian.PutUint16(data[ipOff+4:], uint16(end-ipOff-40))
+		}
+		if pkt.IsUDP {
+			binary.BigEndian.PutUint16(data[l4Off+4:], uint16(end-l4Off))
+		}
+		binary.BigEndian.PutUint16(data[csumOff:], 0)
+		csum := transportChecksum(src, dst, protocol, data[l4Off:end])
+		if csum == 0 && pkt.IsUDP {
+			csum = 0xffff
+		}
+		binary.BigEndian.PutUint16(data[csumOff:], csum)
+		pkt.Ci.Length = frameEnd
+	case ChecksumsPreserveLength:
+		if pkt.IsIPv4 {
+			csum := binary.BigEndian.Uint16(data[ipOff+10:])
+			binary.BigEndian.PutUint16(data[ipOff+10:], updateAddrChecksum(csum, true, srcIP, dstIP, newSrcIP, newDstIP))
+		}
+		if csum := binary.BigEndian.Uint16(data[csumOff:]); pkt.IsTCP || csum != 0 {
+			csum = updateAddrChecksum(csum, pkt.IsIPv4, srcIP, dstIP, newSrcIP, newDstIP)
+			if csum == 0 && pkt.IsUDP {
+				csum = 0xffff
+			}
+			binary.BigEndian.PutUint16(data[csumOff:], csum)
+		}
+	}
+	for i := end; i < frameEnd; i++ {
+		data[i] = 0
+	}
+	if pkt.Ci.Length < frameEnd {
+		pkt.Ci.Length = frameEnd
+	}
+
+	pkt.OutBuf = &rawBuffer{data: data[:frameEnd]}
+	return true
+}
@@ -0,0 +1,150 @@
+package anonymization
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+func serializeTestPacket(t *testing.T, ipv6, tcp bool, payload []byte) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	var ip gopacket.SerializableLayer
+	var nl gopacket.NetworkLayer
+	if ipv6 {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP,
+			SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8:1::2")}
+		if tcp {
+			ip6.NextHeader = layers.IPProtocolTCP
+		}
+		ip, nl = ip6, ip6
+	} else {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Id: 1234, Protocol: layers.IPProtocolUDP,
+			SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("198.51.100.7")}
+		if tcp {
+			ip4.Protocol = layers.IPProtocolTCP
+		}
+		ip, nl = ip4, ip4
+	}
+	var l4 gopacket.SerializableLayer
+	if tcp {
+		t := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, PSH: true, Window: 1024}
+		t.SetNetworkLayerForChecksum(nl)
+		l4 = t
+	} else {
+		u := &layers.UDP{SrcPort: 40000, DstPort: 53}
+		u.SetNetworkLayerForChecksum(nl)
+		l4 = u
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, l4, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeTestPacket decodes a packet the same way as the reader.
+func decodeTestPacket(t *testing.T, data []byte) *network.Packet {
+	return decodeTestLayers(t, layers.LayerTypeEthernet, data)
+}
+
+// decodeTestLayers decodes a packet starting with the layer first, and the
+// packet carried by its tunnel.
+func decodeTestLayers(t *testing.T, first gopacket.LayerType, data []byte) *network.Packet {
+	pkt := network.NewPacket()
+	parser := gopacket.NewDecodingLayerParser(first, pkt.Eth, new(layers.Dot1Q), new(network.MPLSStack), pkt.Ip4, pkt.Ip6, pkt.Ip6Ext, pkt.Tcp, pkt.Udp, pkt.Icmp4, pkt.Icmp6, pkt.Payload)
+	decoded := []gopacket.LayerType{}
+	parser.DecodeLayers(data, &decoded)
+	for _, typ := range decoded {
+		switch typ {
+		case layers.LayerTypeIPv4:
+			pkt.IsIPv4 = true
+			pkt.SrcIP, pkt.DstIP = pkt.Ip4.SrcIP.String(), pkt.Ip4.DstIP.String()
+			if network.IsFragment(pkt.Ip4) {
+				pkt.IsFrag = true
+				pkt.Frag = network.Fragment{Offset: int(pkt.Ip4.FragOffset) * 8, ID: uint32(pkt.Ip4.Id), Protocol: pkt.Ip4.Protocol, Data: pkt.Ip4.Payload}
+				if pkt.Frag.Offset == 0 && pkt.Frag.Protocol == layers.IPProtocolTCP && pkt.Tcp.DecodeFromBytes(pkt.Frag.Data, gopacket.NilDecodeFeedback) == nil {
+					pkt.IsTCP = true
+					pkt.SrcPort, pkt.DstPort = uint16(pkt.Tcp.SrcPort), uint16(pkt.Tcp.DstPort)
+				} else if pkt.Frag.Offset == 0 && pkt.Frag.Protocol == layers.IPProtocolUDP && pkt.Udp.DecodeFromBytes(pkt.Frag.Data, gopacket.NilDecodeFeedback) == nil {
+					pkt.IsUDP = true
+					pkt.SrcPort, pkt.DstPort = uint16(pkt.Udp.SrcPort), uint16(pkt.Udp.DstPort)
+				}
+			}
+		case layers.LayerTypeIPv6:
+			pkt.IsIPv6 = true
+			pkt.SrcIP, pkt.DstIP = pkt.Ip6.SrcIP.String(), pkt.Ip6.DstIP.String()
+		case layers.LayerTypeTCP:
+			pkt.IsTCP = true
+			pkt.SrcPort, pkt.DstPort = uint16(pkt.Tcp.SrcPort), uint16(pkt.Tcp.DstPort)
+		case layers.LayerTypeUDP:
+			pkt.IsUDP = true
+			pkt.SrcPort, pkt.DstPort = uint16(pkt.Udp.SrcPort), uint16(pkt.Udp.DstPort)
+			pkt.IsDNS = pkt.SrcPort == 53 || pkt.DstPort == 53
+		case layers.LayerTypeICMPv4:
+			pkt.IsICMP4 = true
+		case layers.LayerTypeICMPv6:
+			pkt.IsICMP6 = true
+		}
+	}
+	if tunnel, ok := network.ParseTunnel(pkt); ok {
+		tunnel.Inner = decodeTestLayers(t, tunnel.First, tunnel.Data)
+		pkt.Tunnel = tunnel
+	}
+	if !pkt.IsTCP && !pkt.IsUDP && !pkt.IsICMP4 && !pkt.IsICMP6 && !pkt.IsFrag && pkt.Tunnel.Inner == nil {
+		t.Fatal("Could not decode the test packet")
+	}
+	pkt.RawData = data
+	pkt.Ci.Length = len(data)
+	pkt.Ci.CaptureLength = len(data)
+	return pkt
+}
+
+// TestRewriteInPlace tests that the in place rewriting produces the same
+// packets as the full serialization.
+func TestRewriteInPlace(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	payload := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	for i, checksums := range []string{ChecksumsKeep, ChecksumsRecompute, ChecksumsPreserveLength} {
+		for _, ipv6 := range []bool{false, true} {
+			for _, tcp := range []bool{false, true} {
+				conf := AModuleConfiguration{
+					Key:       key,
+					Anonymize: true,
+					LocalNets: []string{"192.0.2.0/24", "2001:db8::/48"},
+					Checksums: checksums,
+					MACMode:   []string{MACZero, MACHashOUI, MACHash}[i],
+				}
+				slow := NewAModule(conf)
+				conf.InPlace = true
+				fast := NewAModule(conf)
+
+				data := serializeTestPacket(t, ipv6, tcp, payload)
+				want := decodeTestPacket(t, append([]byte(nil), data...))
+				got := decodeTestPacket(t, append([]byte(nil), data...))
+				if err := slow.Anonymize(want); err != nil {
+					t.Fatal(err)
+				}
+				if err := fast.Anonymize(got); err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := got.OutBuf.(*rawBuffer); !ok {
+					t.Errorf("%s ipv6=%v tcp=%v: packet not rewritten in place", checksums, ipv6, tcp)
+				}
+				if !bytes.Equal(got.OutBuf.Bytes(), want.OutBuf.Bytes()) || got.Ci.Length != want.Ci.Length {
+					t.Errorf("%s ipv6=%v tcp=%v:\n%x (%d)\n!=\n%x (%d)", checksums, ipv6, tcp,
+						got.OutBuf.Bytes(), got.Ci.Length, want.OutBuf.Bytes(), want.Ci.Length)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package anonymization
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+const (
+	// Extension headers are kept, with their addresses anonymized
+	ExtensionsKeep = "keep"
+	// Hop-by-hop and destination options headers are removed
+	ExtensionsStripOptions = "strip-options"
+	// Every extension header but the fragment header is removed
+	ExtensionsStrip = "strip"
+)
+
+// Type of the home address destination option (RFC 6275)
+const homeAddressOption = 0xc9
+
+// ParseExtensionsMode validates the handling of IPv6 extension headers, keep if
+// empty.
+func ParseExtensionsMode(mode string) (string, error) {
+	switch mode = strings.ToLower(mode); mode {
+	case "":
+		return ExtensionsKeep, nil
+	case ExtensionsKeep, ExtensionsStripOptions, ExtensionsStrip:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown IPv6 extension headers handling %q", mode)
+}
+
+// extensionChain is the rewritten chain of extension headers of an IPv6 packet
+type extensionChain struct {
+	// Headers to write after the IPv6 header
+	data []byte
+	// Protocol of the first header written
+	next layers.IPProtocol
+	// Number of bytes of headers removed
+	stripped int
+	// Final destination of the original and anonymized packets, covered by
+	// the transport checksum instead of the destination address when a
+	// routing header has segments left
+	finalDst    net.IP
+	newFinalDst net.IP
+	// Home address of the original and anonymized packets, covered by the
+	// transport checksum instead of the source address when a destination
+	// options header has a home address option (RFC 6275)
+	homeAddr    net.IP
+	newHomeAddr net.IP
+}
+
+// routingAddresses returns the offsets of the addresses of a routing header,
+// and the offset of the final destination if segments are left or -1. Routing
+// types 0 (RFC 2460), 2 (RFC 6275) and 4 (segment routing, RFC 8754) are
+// supported.
+func routingAddresses(data []byte) (offsets []int, final int) {
+	n := 0
+	switch data[2] {
+	case 0:
+		n = int(data[1]) / 2
+	case 2:
+		n = 1
+	case 4:
+		n = int(data[4]) + 1
+		if n > int(data[1])/2 {
+			n = int(data[1]) / 2
+		}
+	}
+	for i := 0; i < n && 8+16*(i+1) <= len(data); i++ {
+		offsets = append(offsets, 8+16*i)
+	}
+	final = -1
+	if data[3] > 0 && len(offsets) > 0 {
+		// The segment list of segment routing headers is in reverse order
+		final = offsets[len(offsets)-1]
+		if data[2] == 4 {
+			final = offsets[0]
+		}
+	}
+	return offsets, final
+}
+
+// homeAddresses returns the offsets of the home address options of a
+// destination options header.
+func homeAddresses(data []byte) (offsets []int) {
+	for i := 2; i < len(data); {
+		if data[i] == 0 {
+			// Pad1 has no length
+			i++
+			continue
+		}
+		if i+2 > len(data) {
+			break
+		}
+		length := int(data[i+1])
+		if data[i] == homeAddressOption && length == net.IPv6len && i+2+length <= len(data) {
+			offsets = append(offsets, i+2)
+		}
+		i += 2 + length
+	}
+	return offsets
+}
+
+// rewriteExtensions anonymizes the addresses of the extension headers of an
+// IPv6 packet, the segments of routing headers and the home address options,
+// and removes the headers stripped by the configuration. Segments are handled
+// like the destination of the packet, and home addresses like its source. The
+// final destination and home address of the anonymized packet are the ones of
+// its kept headers. It returns nil if the packet has no extension headers.
+func (am *AModule) rewriteExtensions(epoch *epochContext, pkt *network.Packet, protocol string, srcIP, dstIP, newSrcIP, newDstIP net.IP) *extensionChain {
+	if !pkt.IsIPv6 || !network.IsIPv6Extension(pkt.Ip6.NextHeader) {
+		return nil
+	}
+	data := pkt.RawData[offset(pkt.RawData, pkt.Ip6.Contents)+len(pkt.Ip6.Contents):]
+	headers, upper, err := network.ParseIPv6Extensions(pkt.Ip6.NextHeader, data, nil)
+	if err != nil {
+		return nil
+	}
+	anonymize := func(b []byte, port uint16) {
+		addr := net.IP(append([]byte(nil), b...))
+		rule := am.policy.Lookup(addr, protocol, port)
+		if newAddr := am.anonymizeAddr(epoch, rule, addr, am.anonymizedByDefault(addr)); newAddr != nil {
+			copy(b, newAddr.To16())
+		}
+	}
+
+	chain := &extensionChain{next: upper, finalDst: dstIP, newFinalDst: newDstIP, homeAddr: srcIP, newHomeAddr: newSrcIP}
+	var kept []network.IPv6ExtensionHeader
+	for _, h := range headers {
+		h.Data = append([]byte(nil), h.Data...)
+		strip := am.extensions == ExtensionsStrip && h.Type != layers.IPProtocolIPv6Fragment ||
+			am.extensions == ExtensionsStripOptions && (h.Type == layers.IPProtocolIPv6HopByHop || h.Type == layers.IPProtocolIPv6Destination)
+		switch h.Type {
+		case layers.IPProtocolIPv6Routing:
+			offsets, final := routingAddresses(h.Data)
+			if final >= 0 {
+				chain.finalDst = net.IP(append([]byte(nil), h.Data[final:final+net.IPv6len]...))
+			}
+			for _, off := range offsets {
+				anonymize(h.Data[off:off+net.IPv6len], pkt.DstPort)
+			}
+			if final >= 0 && !strip {
+				chain.newFinalDst = net.IP(h.Data[final : final+net.IPv6len])
+			}
+		case layers.IPProtocolIPv6Destination:
+			for _, off := range homeAddresses(h.Data) {
+				chain.homeAddr = net.IP(append([]byte(nil), h.Data[off:off+net.IPv6len]...))
+				anonymize(h.Data[off:off+net.IPv6len], pkt.SrcPort)
+				if !strip {
+					chain.newHomeAddr = net.IP(h.Data[off : off+net.IPv6len])
+				}
+			}
+		}
+
+		if strip {
+			chain.stripped += len(h.Data)
+			continue
+		}
+		kept = append(kept, h)
+	}
+
+	// Link the remaining headers, the fragment header ends the chain
+	for i := range kept {
+		if i+1 < len(kept) {
+			kept[i].Data[0] = byte(kept[i+1].Type)
+		} else if kept[i].Type != layers.IPProtocolIPv6Fragment {
+			kept[i].Data[0] = byte(upper)
+		}
+		chain.data = append(chain.data, kept[i].Data...)
+	}
+	if len(kept) > 0 {
+		chain.next = kept[0].Type
+	}
+	return chain
+}
@@ -0,0 +1,229 @@
+package anonymization
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+// serializeTestSRH serializes a TCP segment sent through the segment routing
+// header of an IPv6 packet, preceded by a destination options header. The
+// segment is on its way to 2001:db8::1, its final destination is 2001:db8::7.
+func serializeTestSRH(t *testing.T) []byte {
+	src := net.ParseIP("2001:db8::2")
+	segments := []net.IP{net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1")}
+
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 1, ACK: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(&layers.IPv6{SrcIP: src, DstIP: segments[0], NextHeader: layers.IPProtocolTCP})
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, tcp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Destination options with a PadN option, then the segment routing header
+	ext := []byte{byte(layers.IPProtocolIPv6Routing), 0, 1, 4, 0, 0, 0, 0}
+	ext = append(ext, byte(layers.IPProtocolTCP), 4, 4, 1, 1, 0, 0, 0)
+	for _, s := range segments {
+		ext = append(ext, s.To16()...)
+	}
+	ext = append(ext, buf.Bytes()...)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Destination, SrcIP: src, DstIP: segments[1]}
+	buf = gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip6, gopacket.Payload(ext)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestIPv6Extensions tests that the segments of routing headers are anonymized
+// like the destination, that the transport checksum stays valid for the final
+// destination and that headers are stripped as configured.
+func TestIPv6Extensions(t *testing.T) {
+	expected := map[string][]layers.IPProtocol{
+		ExtensionsKeep:         {layers.IPProtocolIPv6Destination, layers.IPProtocolIPv6Routing},
+		ExtensionsStripOptions: {layers.IPProtocolIPv6Routing},
+		ExtensionsStrip:        nil,
+	}
+	policy, err := NewPolicy([]PolicyRule{
+		{Net: mustCIDR("2001:db8::/48"), Action: ActionAnonymize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The payload is kept, so that the checksum can be verified in every mode
+	payload, err := NewPayloadPolicy([]PayloadRule{{Mode: PayloadFull}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, checksums := range []string{ChecksumsRecompute, ChecksumsPreserveLength} {
+		for mode, types := range expected {
+			am := NewAModule(AModuleConfiguration{
+				Key:        []byte("0123456789abcdef0123456789abcdef"),
+				Anonymize:  true,
+				Policy:     policy,
+				Payload:    payload,
+				Checksums:  checksums,
+				Extensions: mode,
+			})
+			pkt := decodeTestPacket(t, serializeTestSRH(t))
+			if err := am.Anonymize(pkt); err != nil {
+				t.Fatal(err)
+			}
+			out := gopacket.NewPacket(pkt.OutBuf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+			ip6 := out.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+
+			headers, upper, err := network.ParseIPv6Extensions(ip6.NextHeader, ip6.Payload, nil)
+			if err != nil || upper != layers.IPProtocolTCP || len(headers) != len(types) {
+				t.Fatalf("%s/%s: %d headers before %v, %v", checksums, mode, len(headers), upper, err)
+			}
+			finalDst := ip6.DstIP
+			for i, h := range headers {
+				if h.Type != types[i] {
+					t.Errorf("%s/%s: header %d of type %v", checksums, mode, i, h.Type)
+				}
+				if h.Type == layers.IPProtocolIPv6Routing {
+					if !net.IP(h.Data[24:40]).Equal(ip6.DstIP) {
+						t.Errorf("%s/%s: active segment %s, destination %s", checksums, mode, net.IP(h.Data[24:40]), ip6.DstIP)
+					}
+					finalDst = net.IP(h.Data[8:24])
+				}
+			}
+			if ip6.DstIP.Equal(net.ParseIP("2001:db8::1")) || finalDst.Equal(net.ParseIP("2001:db8::7")) {
+				t.Errorf("%s/%s: addresses not anonymized", checksums, mode)
+			}
+
+			// The checksum covers the anonymized final destination, or the
+			// destination once the routing header is stripped
+			offset := 0
+			for _, h := range headers {
+				offset += len(h.Data)
+			}
+			tcp := &layers.TCP{}
+			if err := tcp.DecodeFromBytes(ip6.Payload[offset:], gopacket.NilDecodeFeedback); err != nil {
+				t.Fatal(err)
+			}
+			checksum := tcp.Checksum
+			tcp.SetNetworkLayerForChecksum(&layers.IPv6{SrcIP: ip6.SrcIP, DstIP: finalDst, NextHeader: layers.IPProtocolTCP})
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, tcp, gopacket.Payload(tcp.Payload)); err != nil {
+				t.Fatal(err)
+			}
+			if tcp.Checksum != checksum {
+				t.Errorf("%s/%s: checksum %#x, expected %#x", checksums, mode, checksum, tcp.Checksum)
+			}
+		}
+	}
+}
+
+// serializeTestHAO serializes a TCP segment sent by a mobile node from its
+// care-of address 2001:db8:1::9, with its home address 2001:db9::1:2:3:4 in a
+// destination options header.
+func serializeTestHAO(t *testing.T) []byte {
+	src, dst, home := net.ParseIP("2001:db8:1::9"), net.ParseIP("2001:db8::1"), net.ParseIP("2001:db9::1:2:3:4")
+
+	// The checksum covers the home address instead of the source
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 1, ACK: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(&layers.IPv6{SrcIP: home, DstIP: dst, NextHeader: layers.IPProtocolTCP})
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, tcp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A PadN option aligns the home address option on 8n+6
+	ext := []byte{byte(layers.IPProtocolTCP), 2, 1, 2, 0, 0, homeAddressOption, net.IPv6len}
+	ext = append(ext, home.To16()...)
+	ext = append(ext, buf.Bytes()...)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Destination, SrcIP: src, DstIP: dst}
+	buf = gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip6, gopacket.Payload(ext)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestHomeAddress tests that home address options are anonymized like the
+// source, and that the transport checksum stays valid for the home address,
+// or for the source once the option is stripped.
+func TestHomeAddress(t *testing.T) {
+	// The rule of the home address only applies to the source port
+	policy, err := NewPolicy([]PolicyRule{
+		{Net: mustCIDR("2001:db8::/32"), Action: ActionAnonymize},
+		{Net: mustCIDR("2001:db9::/48"), Action: ActionAnonymize},
+		{Net: mustCIDR("2001:db9::/64"), Ports: []uint16{40000}, Action: ActionTruncate, Truncate: AlgorithmSpec{Bits6: 64}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := NewPayloadPolicy([]PayloadRule{{Mode: PayloadFull}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, checksums := range []string{ChecksumsRecompute, ChecksumsPreserveLength} {
+		for _, mode := range []string{ExtensionsKeep, ExtensionsStripOptions} {
+			am := NewAModule(AModuleConfiguration{
+				Key:        []byte("0123456789abcdef0123456789abcdef"),
+				Anonymize:  true,
+				Policy:     policy,
+				Payload:    payload,
+				Checksums:  checksums,
+				Extensions: mode,
+			})
+			pkt := decodeTestPacket(t, serializeTestHAO(t))
+			if err := am.Anonymize(pkt); err != nil {
+				t.Fatal(err)
+			}
+			out := gopacket.NewPacket(pkt.OutBuf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+			ip6 := out.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+			headers, upper, err := network.ParseIPv6Extensions(ip6.NextHeader, ip6.Payload, nil)
+			if err != nil || upper != layers.IPProtocolTCP {
+				t.Fatalf("%s/%s: headers before %v, %v", checksums, mode, upper, err)
+			}
+
+			home := ip6.SrcIP
+			offset := 0
+			for _, h := range headers {
+				if h.Type == layers.IPProtocolIPv6Destination {
+					home = net.IP(h.Data[8:24])
+					if !home.Equal(net.ParseIP("2001:db9::")) {
+						t.Errorf("%s/%s: home address anonymized to %s", checksums, mode, home)
+					}
+				}
+				offset += len(h.Data)
+			}
+			if mode == ExtensionsKeep && len(headers) != 1 || mode == ExtensionsStripOptions && len(headers) != 0 {
+				t.Fatalf("%s/%s: %d headers", checksums, mode, len(headers))
+			}
+
+			tcp := &layers.TCP{}
+			if err := tcp.DecodeFromBytes(ip6.Payload[offset:], gopacket.NilDecodeFeedback); err != nil {
+				t.Fatal(err)
+			}
+			checksum := tcp.Checksum
+			tcp.SetNetworkLayerForChecksum(&layers.IPv6{SrcIP: home, DstIP: ip6.DstIP, NextHeader: layers.IPProtocolTCP})
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, tcp, gopacket.Payload(tcp.Payload)); err != nil {
+				t.Fatal(err)
+			}
+			if tcp.Checksum != checksum {
+				t.Errorf("%s/%s: checksum %#x, expected %#x", checksums, mode, checksum, tcp.Checksum)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package anonymization
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoKey is returned by LoadKey when no key source is configured.
+var ErrNoKey = errors.New("no anonymization key configured")
+
+// ParseKey decodes Crypto-PAn keying material. The key can be provided as hex,
+// base64 or raw bytes and must decode to exactly Size bytes. Data that decodes
+// as hex or base64 is never interpreted as a raw key.
+func ParseKey(data []byte) ([]byte, error) {
+	text := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(text); err == nil {
+		if len(key) != Size {
+			return nil, KeySizeError(len(key))
+		}
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil {
+		if len(key) != Size {
+			return nil, KeySizeError(len(key))
+		}
+		return key, nil
+	}
+	if len(data) == Size {
+		key := make([]byte, Size)
+		copy(key, data)
+		return key, nil
+	}
+
+	return nil, KeySizeError(len(data))
+}
+
+// KeyFile is the content of a key file written by keygen.
+type KeyFile struct {
+	// Identifier of the key epoch the key belongs to
+	EpochID string
+	// Time the key was created
+	Created time.Time
+	// Key encoded as hex
+	Key string
+}
+
+// NewKeyFile creates a key file for the given epoch with a fresh random key.
+func NewKeyFile(epochID string) *KeyFile {
+	return &KeyFile{
+		EpochID: epochID,
+		Created: time.Now().UTC(),
+		Key:     hex.EncodeToString(CreateRandomKey()),
+	}
+}
+
+// WriteKeyFile writes kf to path, readable only by the owner. An existing file
+// is never overwritten.
+func WriteKeyFile(path string, kf *KeyFile) error {
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadKeyFile reads a key file. Files that are not in the keygen format are
+// accepted as long as they contain a valid key, in which case EpochID is empty.
+// Files of exactly Size bytes are never parsed as JSON, as raw keys may start
+// with any byte.
+func ReadKeyFile(path string) (*KeyFile, []byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Warnf("Key file %s is accessible by other users (%s)", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kf := &KeyFile{}
+	if trimmed := bytes.TrimSpace(data); len(data) != Size && len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, kf); err != nil {
+			return nil, nil, fmt.Errorf("key file %s: %w", path, err)
+		}
+		data = []byte(kf.Key)
+	}
+
+	key, err := ParseKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	return kf, key, nil
+}
+
+// LoadKey returns the key from the first configured source, and the
+// identifier of its epoch if the key file written by keygen records one. The
+// key file takes precedence over the inline key, which takes precedence over
+// the environment variable. ErrNoKey is returned if none of them is set.
+func LoadKey(keyFile string, key string, keyEnv string) ([]byte, string, error) {
+	if keyFile != "" {
+		kf, ret, err := ReadKeyFile(keyFile)
+		if err != nil {
+			return nil, "", err
+		}
+		return ret, kf.EpochID, nil
+	}
+
+	if key != "" {
+		ret, err := ParseKey([]byte(key))
+		if err != nil {
+			return nil, "", fmt.Errorf("inline key: %w", err)
+		}
+		return ret, "", nil
+	}
+
+	if keyEnv != "" {
+		value, ok := os.LookupEnv(keyEnv)
+		if !ok || value == "" {
+			return nil, "", fmt.Errorf("environment variable %s is not set", keyEnv)
+		}
+		ret, err := ParseKey([]byte(value))
+		if err != nil {
+			return nil, "", fmt.Errorf("environment variable %s: %w", keyEnv, err)
+		}
+		return ret, "", nil
+	}
+
+	return nil, "", ErrNoKey
+}
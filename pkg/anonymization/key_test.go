@@ -0,0 +1,79 @@
+package anonymization
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestParseKey makes sure every supported encoding decodes to the same key
+// and that keys of the wrong size are rejected.
+func TestParseKey(t *testing.T) {
+	for _, in := range [][]byte{
+		testKey,
+		[]byte(hex.EncodeToString(testKey)),
+		[]byte(hex.EncodeToString(testKey) + "\n"),
+		[]byte(base64.StdEncoding.EncodeToString(testKey)),
+	} {
+		key, err := ParseKey(in)
+		if err != nil {
+			t.Fatalf("ParseKey(%q) failed: %s", in, err)
+		}
+		if !bytes.Equal(key, testKey) {
+			t.Errorf("ParseKey(%q) = %x != %x", in, key, testKey)
+		}
+	}
+
+	if _, err := ParseKey([]byte(hex.EncodeToString(testKey[:16]))); err == nil {
+		t.Error("ParseKey accepted a short key")
+	}
+}
+
+// TestKeyFile makes sure a key file written by keygen can be loaded back and
+// is never overwritten.
+func TestKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.json")
+	kf := NewKeyFile("test")
+	if err := WriteKeyFile(path, kf); err != nil {
+		t.Fatal("WriteKeyFile failed:", err)
+	}
+	if err := WriteKeyFile(path, NewKeyFile("other")); err == nil {
+		t.Error("WriteKeyFile overwrote an existing file")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Key file has mode %s", info.Mode().Perm())
+	}
+
+	read, key, err := ReadKeyFile(path)
+	if err != nil {
+		t.Fatal("ReadKeyFile failed:", err)
+	}
+	if read.EpochID != "test" || hex.EncodeToString(key) != kf.Key {
+		t.Errorf("Read %s %x, wrote %s %s", read.EpochID, key, kf.EpochID, kf.Key)
+	}
+	if _, epochID, err := LoadKey(path, "", ""); err != nil || epochID != "test" {
+		t.Errorf("LoadKey returned epoch %q, %v", epochID, err)
+	}
+	am := NewAModule(AModuleConfiguration{Key: key, KeyEpochID: "test", Anonymize: true})
+	if am.EpochID() != "test" {
+		t.Errorf("Key of epoch test used in epoch %s", am.EpochID())
+	}
+
+	// Raw keys may look like the start of a JSON document
+	raw := append([]byte("{"), testKey[1:]...)
+	path = filepath.Join(t.TempDir(), "key.raw")
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, key, err := ReadKeyFile(path); err != nil || !bytes.Equal(key, raw) {
+		t.Errorf("Raw key starting with { read as %x, %v", key, err)
+	}
+}
@@ -0,0 +1,40 @@
+package anonymization
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+// linkHeader returns the link layer header of a packet, i.e. everything before
+// its IP header: Ethernet, VLAN tags and MPLS labels.
+func linkHeader(pkt *network.Packet) []byte {
+	if pkt.IsIPv4 {
+		return pkt.RawData[:offset(pkt.RawData, pkt.Ip4.Contents)]
+	}
+	return pkt.RawData[:offset(pkt.RawData, pkt.Ip6.Contents)]
+}
+
+// rewriteLinkHeader anonymizes the MAC addresses of a link layer header and
+// remaps the IDs of its 802.1Q and 802.1ad tags. MPLS labels are kept.
+func (am *AModule) rewriteLinkHeader(hdr []byte, mac *MACAnonymizer) {
+	if len(hdr) < 14 {
+		return
+	}
+	mac.Anonymize(net.HardwareAddr(hdr[0:6]), net.HardwareAddr(hdr[0:6]))
+	mac.Anonymize(net.HardwareAddr(hdr[6:12]), net.HardwareAddr(hdr[6:12]))
+
+	for off := 12; off+6 <= len(hdr); off += 4 {
+		etherType := layers.EthernetType(binary.BigEndian.Uint16(hdr[off:]))
+		if etherType != layers.EthernetTypeDot1Q && etherType != layers.EthernetTypeQinQ {
+			return
+		}
+		tci := binary.BigEndian.Uint16(hdr[off+2:])
+		if id, ok := am.vlanMap[tci&0x0fff]; ok {
+			// Priority and drop eligible bits are kept
+			binary.BigEndian.PutUint16(hdr[off+2:], tci&0xf000|id&0x0fff)
+		}
+	}
+}
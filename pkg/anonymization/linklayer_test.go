@@ -0,0 +1,72 @@
+package anonymization
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TestPreserveLinkLayer tests that VLAN tags and MPLS labels are kept, with
+// remapped VLAN IDs, both in place and with the full serialization.
+func TestPreserveLinkLayer(t *testing.T) {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeQinQ,
+	}
+	outer := &layers.Dot1Q{VLANIdentifier: 100, Priority: 5, Type: layers.EthernetTypeDot1Q}
+	inner := &layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeMPLSUnicast}
+	mpls := &layers.MPLS{Label: 1234, StackBottom: true, TTL: 64}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("198.51.100.7")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, outer, inner, mpls, ip, tcp, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	conf := AModuleConfiguration{
+		Key:               []byte("0123456789abcdef0123456789abcdef"),
+		Anonymize:         true,
+		LocalNets:         []string{"192.0.2.0/24"},
+		MACMode:           MACHash,
+		PreserveLinkLayer: true,
+		VLANMap:           map[uint16]uint16{100: 7},
+	}
+	slow := NewAModule(conf)
+	conf.InPlace = true
+	fast := NewAModule(conf)
+
+	want := decodeTestPacket(t, append([]byte(nil), data...))
+	got := decodeTestPacket(t, append([]byte(nil), data...))
+	if err := slow.Anonymize(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := fast.Anonymize(got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.OutBuf.(*rawBuffer); !ok {
+		t.Error("Tagged packet not rewritten in place")
+	}
+	if !bytes.Equal(got.OutBuf.Bytes(), want.OutBuf.Bytes()) {
+		t.Errorf("%x != %x", got.OutBuf.Bytes(), want.OutBuf.Bytes())
+	}
+
+	out := want.OutBuf.Bytes()
+	if tci := binary.BigEndian.Uint16(out[14:]); tci != 5<<13|7 {
+		t.Errorf("Outer tag %#04x instead of VLAN 7 with priority 5", tci)
+	}
+	if tci := binary.BigEndian.Uint16(out[18:]); tci != 200 {
+		t.Errorf("Inner tag %#04x instead of VLAN 200", tci)
+	}
+	if !bytes.Equal(out[22:26], data[22:26]) {
+		t.Error("MPLS label not kept")
+	}
+}
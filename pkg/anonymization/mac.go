@@ -0,0 +1,100 @@
+package anonymization
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	// MAC addresses are replaced with zeros
+	MACZero = "zero"
+	// MAC addresses are kept
+	MACKeep = "keep"
+	// The vendor OUI is kept and the rest of the address is hashed
+	MACHashOUI = "hash-oui"
+	// The whole address is hashed
+	MACHash = "hash"
+
+	macKeyInfo = "traffic-anonymization mac address key"
+)
+
+// ParseMACMode validates the MAC address handling, zero if empty.
+func ParseMACMode(mode string) (string, error) {
+	switch mode = strings.ToLower(mode); mode {
+	case "":
+		return MACZero, nil
+	case MACZero, MACKeep, MACHashOUI, MACHash:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown MAC address handling %q", mode)
+}
+
+// MACAnonymizer anonymizes MAC addresses with a keyed HMAC-SHA256. The
+// individual/group bit is kept so that broadcast and multicast frames stay
+// recognizable.
+type MACAnonymizer struct {
+	mode string
+	pool sync.Pool
+}
+
+// NewMACAnonymizer creates a MAC anonymizer for one of the MAC* modes and an
+// epoch key.
+func NewMACAnonymizer(mode string, key []byte) *MACAnonymizer {
+	ret := &MACAnonymizer{mode: mode}
+	if mode == MACHashOUI || mode == MACHash {
+		macKey := hkdf(key, nil, []byte(macKeyInfo), sha256.Size)
+		ret.pool.New = func() interface{} {
+			return hmac.New(sha256.New, macKey)
+		}
+	}
+	return ret
+}
+
+// Anonymize writes the anonymized value of the MAC address mac to out, which
+// may be the same slice.
+func (m *MACAnonymizer) Anonymize(out, mac net.HardwareAddr) {
+	switch m.mode {
+	case MACKeep:
+		copy(out, mac)
+		return
+	case MACZero:
+		for i := range out {
+			out[i] = 0
+		}
+		return
+	}
+	if isBroadcast(mac) {
+		copy(out, mac)
+		return
+	}
+
+	h := m.pool.Get().(hash.Hash)
+	h.Reset()
+	h.Write(mac)
+	sum := h.Sum(nil)
+	m.pool.Put(h)
+
+	if m.mode == MACHashOUI {
+		copy(out[:3], mac[:3])
+		copy(out[3:], sum[:3])
+		return
+	}
+	group := mac[0] & 0x01
+	copy(out, sum[:6])
+	// Locally administered, as the address is not assigned to a vendor
+	out[0] = out[0]&^0x03 | 0x02 | group
+}
+
+func isBroadcast(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package anonymization
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// TestMACAnonymizer tests the properties kept by the MAC address modes.
+func TestMACAnonymizer(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	host, _ := net.ParseMAC("00:1b:21:3a:4f:5e")
+	multicast, _ := net.ParseMAC("01:00:5e:00:00:fb")
+	broadcast, _ := net.ParseMAC("ff:ff:ff:ff:ff:ff")
+
+	anonymize := func(m *MACAnonymizer, mac net.HardwareAddr) net.HardwareAddr {
+		out := make(net.HardwareAddr, 6)
+		m.Anonymize(out, mac)
+		return out
+	}
+
+	if out := anonymize(NewMACAnonymizer(MACZero, key), host); !bytes.Equal(out, make([]byte, 6)) {
+		t.Errorf("zero: %s", out)
+	}
+	if out := anonymize(NewMACAnonymizer(MACKeep, key), host); !bytes.Equal(out, host) {
+		t.Errorf("keep: %s", out)
+	}
+
+	oui := NewMACAnonymizer(MACHashOUI, key)
+	out := anonymize(oui, host)
+	if !bytes.Equal(out[:3], host[:3]) || bytes.Equal(out, host) {
+		t.Errorf("hash-oui: %s -> %s", host, out)
+	}
+	if again := anonymize(NewMACAnonymizer(MACHashOUI, key), host); !bytes.Equal(out, again) {
+		t.Errorf("hash-oui: %s != %s with the same key", out, again)
+	}
+	if other := anonymize(NewMACAnonymizer(MACHashOUI, CreateRandomKey()), host); bytes.Equal(out, other) {
+		t.Errorf("hash-oui: %s with different keys", out)
+	}
+
+	full := NewMACAnonymizer(MACHash, key)
+	if out := anonymize(full, host); out[0]&0x03 != 0x02 {
+		t.Errorf("hash: %s is not a locally administered unicast address", out)
+	}
+	if out := anonymize(full, multicast); out[0]&0x01 != 0x01 {
+		t.Errorf("hash: %s is not a multicast address", out)
+	}
+	if out := anonymize(full, broadcast); !bytes.Equal(out, broadcast) {
+		t.Errorf("hash: broadcast anonymized to %s", out)
+	}
+}
@@ -0,0 +1,50 @@
+package anonymization
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+// passThrough outputs a packet as captured, truncated after the part of its
+// payload kept by the payload rules. Addresses, lengths and checksums are left
+// untouched, so the truncation only shows in the capture length. Only TCP and
+// UDP payloads, including fragmented ones, are truncated.
+func (am *AModule) passThrough(pkt *network.Packet) {
+	data := pkt.RawData
+	end := len(data)
+	if pkt.IsFrag {
+		key := newFragmentKey(pkt, net.ParseIP(pkt.SrcIP), net.ParseIP(pkt.DstIP))
+		now := time.Now().UnixNano()
+		keep := 0
+		if isFirstFragment(pkt) {
+			keep = am.datagramKeep(pkt)
+			am.fragments.add(key, fragmentEntry{keep: keep}, now)
+		} else if e, ok := am.fragments.get(key, now); ok {
+			keep = e.keep
+		}
+		if kept := fragmentData(pkt, keep); len(kept) < len(pkt.Frag.Data) {
+			end = offset(data, pkt.Frag.Data) + len(kept)
+		}
+	} else if pkt.IsTCP || pkt.IsUDP {
+		var payload []byte
+		if pkt.IsTCP {
+			payload = pkt.Tcp.LayerPayload()
+		} else {
+			payload = pkt.Udp.LayerPayload()
+		}
+		if kept := am.payload.Payload(pkt); len(kept) < len(payload) {
+			end = offset(data, payload) + len(kept)
+		}
+	}
+
+	if am.inPlace {
+		pkt.OutBuf = &rawBuffer{data: data[:end]}
+		return
+	}
+	pkt.OutBuf = gopacket.NewSerializeBufferExpectedSize(end, 0)
+	out, _ := pkt.OutBuf.AppendBytes(end)
+	copy(out, data)
+}
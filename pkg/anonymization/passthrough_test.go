@@ -0,0 +1,38 @@
+package anonymization
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestPassThrough tests that packets passed through are written as captured,
+// truncated after the payload kept by the payload rules.
+func TestPassThrough(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	full, err := NewPayloadPolicy([]PayloadRule{{Mode: PayloadFull}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inPlace := range []bool{false, true} {
+		data := serializeTestPacket(t, false, true, payload)
+		headers := len(data) - len(payload)
+
+		am := NewAModule(AModuleConfiguration{InPlace: inPlace})
+		pkt := decodeTestPacket(t, data)
+		if err := am.Anonymize(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pkt.OutBuf.Bytes(), data[:headers]) {
+			t.Errorf("In place %v: payload not stripped, %d bytes written", inPlace, len(pkt.OutBuf.Bytes()))
+		}
+
+		am = NewAModule(AModuleConfiguration{InPlace: inPlace, Payload: full})
+		pkt = decodeTestPacket(t, data)
+		if err := am.Anonymize(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pkt.OutBuf.Bytes(), data) {
+			t.Errorf("In place %v: packet not written as captured", inPlace)
+		}
+	}
+}
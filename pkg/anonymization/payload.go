@@ -0,0 +1,190 @@
+package anonymization
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+const (
+	// Only headers are kept
+	PayloadHeaders = "headers"
+	// The first Bytes bytes of the payload are kept
+	PayloadBytes = "bytes"
+	// The payload is kept only for handshake packets
+	PayloadHandshake = "handshake"
+	// The whole payload is kept
+	PayloadFull = "full"
+)
+
+const (
+	ApplicationDNS  = "dns"
+	ApplicationTLS  = "tls"
+	ApplicationQUIC = "quic"
+)
+
+// PayloadRule selects how much of the payload of matching packets is kept.
+type PayloadRule struct {
+	// Transport protocol the rule applies to (tcp or udp), any if empty
+	Protocol string
+	// Ports the rule applies to, either as source or destination. Any if empty
+	Ports []uint16
+	// Application the rule applies to (dns, tls or quic), any if empty
+	Application string
+	// One of the Payload* constants
+	Mode string
+	// Number of bytes kept by PayloadBytes
+	Bytes int
+}
+
+// DefaultPayloadRules keeps TLS and QUIC handshakes and DNS over UDP, and
+// strips every other payload.
+func DefaultPayloadRules() []PayloadRule {
+	return []PayloadRule{
+		{Protocol: "udp", Application: ApplicationDNS, Mode: PayloadFull},
+		{Protocol: "tcp", Application: ApplicationTLS, Mode: PayloadHandshake},
+		{Protocol: "udp", Application: ApplicationQUIC, Mode: PayloadHandshake},
+	}
+}
+
+// PayloadPolicy is an ordered list of payload rules. The first matching rule
+// applies, and payloads matching no rule are stripped.
+type PayloadPolicy struct {
+	rules []PayloadRule
+}
+
+// NewPayloadPolicy validates the rules and builds the policy. Without rules the
+// default rules are used.
+func NewPayloadPolicy(rules []PayloadRule) (*PayloadPolicy, error) {
+	if len(rules) == 0 {
+		rules = DefaultPayloadRules()
+	}
+	p := &PayloadPolicy{}
+	for i, r := range rules {
+		r.Protocol = strings.ToLower(r.Protocol)
+		r.Application = strings.ToLower(r.Application)
+		r.Mode = strings.ToLower(r.Mode)
+		if r.Protocol != "" && r.Protocol != "tcp" && r.Protocol != "udp" {
+			return nil, fmt.Errorf("payload rule %d: unknown protocol %q", i, r.Protocol)
+		}
+		switch r.Application {
+		case "", ApplicationDNS:
+		case ApplicationTLS:
+			if r.Protocol == "udp" {
+				return nil, fmt.Errorf("payload rule %d: %s runs over tcp", i, r.Application)
+			}
+		case ApplicationQUIC:
+			if r.Protocol == "tcp" {
+				return nil, fmt.Errorf("payload rule %d: %s runs over udp", i, r.Application)
+			}
+		default:
+			return nil, fmt.Errorf("payload rule %d: unknown application %q", i, r.Application)
+		}
+		switch r.Mode {
+		case PayloadHeaders, PayloadHandshake, PayloadFull:
+		case PayloadBytes:
+			if r.Bytes <= 0 {
+				return nil, fmt.Errorf("payload rule %d: %s requires a positive number of bytes", i, r.Mode)
+			}
+		default:
+			return nil, fmt.Errorf("payload rule %d: unknown mode %q", i, r.Mode)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func (r *PayloadRule) matches(pkt *network.Packet) bool {
+	if r.Protocol == "tcp" && !pkt.IsTCP || r.Protocol == "udp" && !pkt.IsUDP {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		found := false
+		for _, p := range r.Ports {
+			if p == pkt.SrcPort || p == pkt.DstPort {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	switch r.Application {
+	case ApplicationDNS:
+		return pkt.IsDNS
+	case ApplicationTLS:
+		return pkt.IsTCP && isTLSRecord(pkt.Tcp.LayerPayload())
+	case ApplicationQUIC:
+		return pkt.IsUDP && isQUICLongHeader(pkt.Udp.LayerPayload())
+	}
+	return true
+}
+
+// isHandshake tells whether the packet is part of the handshake of the rule
+// application. Every DNS message is considered part of the handshake.
+func (r *PayloadRule) isHandshake(pkt *network.Packet) bool {
+	switch {
+	case r.Application == ApplicationDNS:
+		return true
+	case pkt.IsTCP:
+		return isTLSHandshake(pkt.Tcp)
+	case pkt.IsUDP:
+		return isQUICHandshake(pkt.Udp)
+	}
+	return false
+}
+
+// Payload returns the part of the transport payload of the packet to keep.
+func (p *PayloadPolicy) Payload(pkt *network.Packet) []byte {
+	var payload []byte
+	if pkt.IsTCP {
+		payload = pkt.Tcp.LayerPayload()
+	} else if pkt.IsUDP {
+		payload = pkt.Udp.LayerPayload()
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	if limit := p.Limit(pkt); limit >= 0 && limit < len(payload) {
+		return payload[:limit]
+	}
+	return payload
+}
+
+// Limit returns the number of bytes of the transport payload of the packet to
+// keep, or -1 to keep it all. The payload may be incomplete, as in the first
+// fragment of a datagram.
+func (p *PayloadPolicy) Limit(pkt *network.Packet) int {
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !r.matches(pkt) {
+			continue
+		}
+		switch r.Mode {
+		case PayloadFull:
+			return -1
+		case PayloadBytes:
+			return r.Bytes
+		case PayloadHandshake:
+			if r.isHandshake(pkt) {
+				return -1
+			}
+		}
+		return 0
+	}
+	return 0
+}
+
+// isTLSRecord tells whether a TCP payload starts with a TLS record header
+func isTLSRecord(bp []byte) bool {
+	// Content types go from ChangeCipherSpec (20) to Heartbeat (24)
+	return len(bp) >= 5 && bp[0] >= 20 && bp[0] <= 24 && bp[1] == 3 && bp[2] <= 4
+}
+
+// isQUICLongHeader tells whether a UDP payload starts with a QUIC long header.
+// Short header packets carry no version and can not be recognized.
+func isQUICLongHeader(bp []byte) bool {
+	return len(bp) >= 5 && bp[0]&0x80 != 0
+}
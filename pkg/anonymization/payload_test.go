@@ -0,0 +1,66 @@
+package anonymization
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+func newTestPacket(tcp bool, srcPort, dstPort uint16, payload []byte) *network.Packet {
+	pkt := network.NewPacket()
+	pkt.SrcPort = srcPort
+	pkt.DstPort = dstPort
+	if tcp {
+		pkt.IsTCP = true
+		pkt.Tcp.Payload = payload
+	} else {
+		pkt.IsUDP = true
+		pkt.Udp.Payload = payload
+		pkt.IsDNS = srcPort == 53 || dstPort == 53
+	}
+	return pkt
+}
+
+// TestPayloadPolicy tests the default rules and the first N bytes mode.
+func TestPayloadPolicy(t *testing.T) {
+	clientHello := []byte{22, 3, 1, 0, 10, 1, 0, 0, 6, 3, 3}
+	appData := []byte{23, 3, 3, 0, 4, 1, 2, 3, 4}
+	http := []byte("GET / HTTP/1.1\r\n")
+	dns := []byte{0x12, 0x34, 1, 0, 0, 1}
+
+	def, err := NewPayloadPolicy(nil)
+	if err != nil {
+		t.Fatal("NewPayloadPolicy failed:", err)
+	}
+	custom, err := NewPayloadPolicy([]PayloadRule{
+		{Protocol: "tcp", Ports: []uint16{80}, Mode: PayloadBytes, Bytes: 4},
+		{Application: ApplicationTLS, Mode: PayloadFull},
+	})
+	if err != nil {
+		t.Fatal("NewPayloadPolicy failed:", err)
+	}
+
+	for _, tc := range []struct {
+		policy *PayloadPolicy
+		pkt    *network.Packet
+		want   []byte
+	}{
+		{def, newTestPacket(true, 40000, 443, clientHello), clientHello},
+		{def, newTestPacket(true, 443, 40000, appData), nil},
+		{def, newTestPacket(true, 40000, 80, http), nil},
+		{def, newTestPacket(false, 40000, 53, dns), dns},
+		{def, newTestPacket(true, 40000, 53, dns), nil},
+		{custom, newTestPacket(true, 40000, 80, http), http[:4]},
+		{custom, newTestPacket(true, 443, 40000, appData), appData},
+		{custom, newTestPacket(false, 40000, 53, dns), nil},
+	} {
+		if got := tc.policy.Payload(tc.pkt); !bytes.Equal(got, tc.want) {
+			t.Errorf("ports %d->%d: %v != %v", tc.pkt.SrcPort, tc.pkt.DstPort, got, tc.want)
+		}
+	}
+
+	if _, err := NewPayloadPolicy([]PayloadRule{{Mode: PayloadBytes}}); err == nil {
+		t.Error("NewPayloadPolicy accepted bytes without a length")
+	}
+}
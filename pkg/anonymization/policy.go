@@ -0,0 +1,122 @@
+package anonymization
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ActionPass      = "pass"
+	ActionAnonymize = "anonymize"
+	ActionTruncate  = "truncate"
+	ActionDrop      = "drop"
+)
+
+// PolicyRule is the action applied to the addresses of a network, optionally
+// restricted to a transport protocol and to some ports.
+type PolicyRule struct {
+	// Network the rule applies to
+	Net *net.IPNet
+	// Transport protocol the rule applies to (tcp or udp), any if empty
+	Protocol string
+	// Ports the rule applies to, any if empty. The port is the one used by
+	// the address being matched
+	Ports []uint16
+	// One of the Action* constants
+	Action string
+	// Truncation applied by ActionTruncate
+	Truncate AlgorithmSpec
+
+	truncator AddressAnonymizer
+}
+
+func (r *PolicyRule) matches(addr net.IP, protocol string, port uint16) bool {
+	if r.Protocol != "" && r.Protocol != protocol {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		found := false
+		for _, p := range r.Ports {
+			if p == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return r.Net.Contains(addr)
+}
+
+// Policy is a table of rules evaluated with longest prefix match. Among rules
+// with the same prefix length the first one in the configuration wins.
+type Policy struct {
+	rules []*PolicyRule
+}
+
+// NewPolicy validates the rules and builds the policy table.
+func NewPolicy(rules []PolicyRule) (*Policy, error) {
+	p := &Policy{}
+	for i := range rules {
+		r := rules[i]
+		r.Action = strings.ToLower(r.Action)
+		r.Protocol = strings.ToLower(r.Protocol)
+		if r.Net == nil {
+			return nil, fmt.Errorf("policy rule %d has no network", i)
+		}
+		if r.Protocol != "" && r.Protocol != "tcp" && r.Protocol != "udp" {
+			return nil, fmt.Errorf("policy rule for %s: unknown protocol %q", r.Net, r.Protocol)
+		}
+		switch r.Action {
+		case ActionPass, ActionAnonymize, ActionDrop:
+		case ActionTruncate:
+			r.Truncate.Algorithm = AlgorithmTruncate
+			t, err := NewAddressAnonymizer(r.Truncate, nil)
+			if err != nil {
+				return nil, fmt.Errorf("policy rule for %s: %w", r.Net, err)
+			}
+			r.truncator = t
+		default:
+			return nil, fmt.Errorf("policy rule for %s: unknown action %q", r.Net, r.Action)
+		}
+		p.rules = append(p.rules, &r)
+	}
+
+	sort.SliceStable(p.rules, func(i, j int) bool {
+		oi, _ := p.rules[i].Net.Mask.Size()
+		oj, _ := p.rules[j].Net.Mask.Size()
+		return oi > oj
+	})
+	return p, nil
+}
+
+// Lookup returns the rule applying to an address used with the given protocol
+// and port, or nil if no rule applies. A nil policy has no rules.
+func (p *Policy) Lookup(addr net.IP, protocol string, port uint16) *PolicyRule {
+	if p == nil {
+		return nil
+	}
+	for _, r := range p.rules {
+		if r.matches(addr, protocol, port) {
+			return r
+		}
+	}
+	return nil
+}
+
+// ipProtocolName returns the name of a transport protocol used by the rules,
+// empty for protocols other than TCP and UDP.
+func ipProtocolName(protocol uint8) string {
+	switch protocol {
+	case uint8(layers.IPProtocolTCP):
+		return "tcp"
+	case uint8(layers.IPProtocolUDP):
+		return "udp"
+	}
+	return ""
+}
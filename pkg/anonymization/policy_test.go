@@ -0,0 +1,53 @@
+package anonymization
+
+import (
+	"net"
+	"testing"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// TestPolicyLookup tests longest prefix match and port restrictions.
+func TestPolicyLookup(t *testing.T) {
+	p, err := NewPolicy([]PolicyRule{
+		{Net: mustCIDR("140.77.0.0/16"), Action: ActionAnonymize},
+		{Net: mustCIDR("140.77.1.53/32"), Protocol: "udp", Ports: []uint16{53}, Action: ActionPass},
+		{Net: mustCIDR("140.77.250.0/24"), Action: ActionDrop},
+		{Net: mustCIDR("140.77.12.0/24"), Action: ActionTruncate},
+	})
+	if err != nil {
+		t.Fatal("NewPolicy failed:", err)
+	}
+
+	for _, tc := range []struct {
+		addr     string
+		protocol string
+		port     uint16
+		action   string
+	}{
+		{"140.77.1.53", "udp", 53, ActionPass},
+		{"140.77.1.53", "tcp", 53, ActionAnonymize},
+		{"140.77.1.53", "udp", 443, ActionAnonymize},
+		{"140.77.250.1", "tcp", 22, ActionDrop},
+		{"140.77.12.34", "tcp", 80, ActionTruncate},
+		{"8.8.8.8", "udp", 53, ""},
+	} {
+		action := ""
+		if r := p.Lookup(net.ParseIP(tc.addr), tc.protocol, tc.port); r != nil {
+			action = r.Action
+		}
+		if action != tc.action {
+			t.Errorf("%s %s/%d: %q != %q", tc.addr, tc.protocol, tc.port, action, tc.action)
+		}
+	}
+
+	if _, err := NewPolicy([]PolicyRule{{Net: mustCIDR("10.0.0.0/8"), Action: "hide"}}); err == nil {
+		t.Error("NewPolicy accepted an unknown action")
+	}
+}
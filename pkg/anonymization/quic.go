@@ -0,0 +1,352 @@
+package anonymization
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	quicVersionNegotiation = 0x00000000
+	quicVersion1           = 0x00000001
+	quicVersion2           = 0x6b3343cf
+
+	// Frames allowed in Initial packets (RFC 9000, section 17.2.2)
+	quicFramePadding         = 0x00
+	quicFramePing            = 0x01
+	quicFrameAck             = 0x02
+	quicFrameAckECN          = 0x03
+	quicFrameCrypto          = 0x06
+	quicFrameConnectionClose = 0x1c
+
+	// Maximum length of connection IDs
+	quicMaxConnIDLen = 20
+	// Size of the sample of the header protection, taken 4 bytes after the
+	// start of the packet number
+	quicSampleSize = 16
+)
+
+// quicVersion describes the long header packets of a QUIC version
+type quicVersion struct {
+	// Packet types of Initial and Retry packets
+	initial, retry byte
+	// Salt and label prefix of the keys of Initial packets, nil if their
+	// decryption is not supported
+	salt  []byte
+	label string
+}
+
+var (
+	quicV1 = &quicVersion{initial: 0, retry: 3, label: "quic ",
+		salt: []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+			0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}}
+	quicV2 = &quicVersion{initial: 1, retry: 0, label: "quicv2 ",
+		salt: []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+			0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}}
+	// Drafts have the packet types of version 1 and salts of their own
+	quicDraft = &quicVersion{initial: 0, retry: 3}
+)
+
+// isGoogleQUIC tells whether a version is a Google QUIC version, such as Q050
+// or T051, whose handshake may not even be encrypted.
+func isGoogleQUIC(version uint32) bool {
+	return version>>24 == 'Q' || version>>24 == 'T'
+}
+
+// isQUIC tells whether a UDP payload starts with a long header packet of a
+// known QUIC version.
+func isQUIC(bp []byte) bool {
+	if !isQUICLongHeader(bp) {
+		return false
+	}
+	version := binary.BigEndian.Uint32(bp[1:])
+	return version == quicVersionNegotiation || version == quicVersion1 || version == quicVersion2 ||
+		version>>24 == 0xff || isGoogleQUIC(version)
+}
+
+// scrubQUIC returns a copy of a UDP payload starting with QUIC long header
+// packets, with the ClientHello carried by the Initial packets of the client
+// scrubbed like the ClientHello of TLS records. Anyone can decrypt Initial
+// packets with the keys derived from their destination connection ID, so they
+// are decrypted, scrubbed and encrypted again, keeping their length. The
+// Initial packets that can not be decrypted with the keys of the client, such
+// as the Initial packets of the server, of draft versions or that are cut, and
+// the packets of Google QUIC, are removed with the rest of the payload. It
+// returns false for other payloads.
+func scrubQUIC(payload []byte, sni *SNIAnonymizer) ([]byte, bool) {
+	if !isQUIC(payload) {
+		return payload, false
+	}
+	out := append([]byte(nil), payload...)
+	// Short header packets, which end the datagram, are protected with keys
+	// from the handshake
+	for off := 0; off < len(out) && isQUICLongHeader(out[off:]); {
+		var v *quicVersion
+		switch version := binary.BigEndian.Uint32(out[off+1:]); {
+		case version == quicVersionNegotiation:
+			// Followed by the list of supported versions
+			return out, true
+		case version == quicVersion1:
+			v = quicV1
+		case version == quicVersion2:
+			v = quicV2
+		case version>>24 == 0xff:
+			v = quicDraft
+		default:
+			return out[:off], true
+		}
+		p, ok := parseQUICPacket(out[off:], v)
+		if !ok {
+			return out[:off], true
+		}
+		if p.typ == v.retry {
+			// Retry packets have no length and end the datagram
+			return out, true
+		}
+		if p.typ == v.initial && !scrubQUICInitial(out[off:off+p.end], p, v, sni) {
+			return out[:off], true
+		}
+		off += p.end
+	}
+	return out, true
+}
+
+// quicPacket locates the fields of a long header packet
+type quicPacket struct {
+	typ  byte
+	dcid []byte
+	// Offset of the packet number and end of the packet
+	pnOffset, end int
+}
+
+// parseQUICPacket parses the long header packet starting data.
+func parseQUICPacket(data []byte, v *quicVersion) (quicPacket, bool) {
+	p := quicPacket{typ: data[0] >> 4 & 3}
+	r := &quicReader{data: data, off: 5}
+	if dcidLen := r.byte(); dcidLen <= quicMaxConnIDLen {
+		p.dcid = r.bytes(uint64(dcidLen))
+	} else {
+		return p, false
+	}
+	if scidLen := r.byte(); scidLen <= quicMaxConnIDLen {
+		r.bytes(uint64(scidLen))
+	} else {
+		return p, false
+	}
+	if p.typ == v.retry {
+		p.end = len(data)
+		return p, !r.failed
+	}
+	if p.typ == v.initial {
+		// Token
+		r.bytes(r.varint())
+	}
+	length := r.varint()
+	p.pnOffset = r.off
+	r.bytes(length)
+	p.end = r.off
+	return p, !r.failed
+}
+
+// quicKeys are the keys protecting the packets sent in one direction
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newQUICClientInitialKeys derives the keys protecting the Initial packets
+// sent by a client to a destination connection ID (RFC 9001, section 5.2).
+func newQUICClientInitialKeys(v *quicVersion, dcid []byte) (*quicKeys, error) {
+	secret := hkdfExpandLabel(hkdfExtract(dcid, v.salt), "client in", sha256.Size)
+	block, err := aes.NewCipher(hkdfExpandLabel(secret, v.label+"key", 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(secret, v.label+"hp", 16))
+	if err != nil {
+		return nil, err
+	}
+	return &quicKeys{aead: aead, iv: hkdfExpandLabel(secret, v.label+"iv", 12), hp: hp}, nil
+}
+
+// hkdfExpandLabel is the HKDF-Expand-Label function of TLS 1.3 (RFC 8446,
+// section 7.1) with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := append([]byte{byte(length >> 8), byte(length), byte(len(label))}, label...)
+	return hkdfExpand(secret, append(info, 0), length)
+}
+
+// scrubQUICInitial scrubs in place the Initial packet of a client, or returns
+// false if it can not be decrypted or parsed.
+func scrubQUICInitial(packet []byte, p quicPacket, v *quicVersion, sni *SNIAnonymizer) bool {
+	if v.salt == nil || p.pnOffset+4+quicSampleSize > len(packet) {
+		return false
+	}
+	keys, err := newQUICClientInitialKeys(v, p.dcid)
+	if err != nil {
+		return false
+	}
+
+	// Remove the header protection
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, packet[p.pnOffset+4:])
+	first := packet[0] ^ mask[0]&0x0f
+	pnLen := int(first&3) + 1
+	header := append([]byte(nil), packet[:p.pnOffset+pnLen]...)
+	header[0] = first
+	// The packet number of Initial packets is small enough to be used as
+	// truncated
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < pnLen; i++ {
+		header[p.pnOffset+i] ^= mask[1+i]
+		nonce[len(nonce)-pnLen+i] ^= header[p.pnOffset+i]
+	}
+
+	plain, err := keys.aead.Open(nil, nonce, packet[len(header):], header)
+	if err != nil || !scrubQUICFrames(plain, sni) {
+		return false
+	}
+	copy(packet[len(header):], keys.aead.Seal(nil, nonce, plain, header))
+
+	// The sample changed with the payload
+	keys.hp.Encrypt(mask, packet[p.pnOffset+4:])
+	packet[0] = first ^ mask[0]&0x0f
+	for i := 0; i < pnLen; i++ {
+		packet[p.pnOffset+i] = header[p.pnOffset+i] ^ mask[1+i]
+	}
+	return true
+}
+
+// quicCrypto is the data of a CRYPTO frame
+type quicCrypto struct {
+	offset uint64
+	data   []byte
+}
+
+// scrubQUICFrames scrubs in place the ClientHello carried by the CRYPTO frames
+// of the payload of an Initial packet, or returns false if the frames can not
+// be parsed.
+func scrubQUICFrames(plain []byte, sni *SNIAnonymizer) bool {
+	var frames []quicCrypto
+	r := &quicReader{data: plain}
+	for r.off < len(plain) && !r.failed {
+		switch typ := r.varint(); typ {
+		case quicFramePadding, quicFramePing:
+		case quicFrameAck, quicFrameAckECN:
+			// Largest acknowledged, delay, range count and first range
+			r.varint()
+			r.varint()
+			count := r.varint()
+			r.varint()
+			for i := uint64(0); i < count && !r.failed; i++ {
+				r.varint()
+				r.varint()
+			}
+			if typ == quicFrameAckECN {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case quicFrameCrypto:
+			offset := r.varint()
+			frames = append(frames, quicCrypto{offset: offset, data: r.bytes(r.varint())})
+		case quicFrameConnectionClose:
+			// Error code, frame type and reason
+			r.varint()
+			r.varint()
+			r.bytes(r.varint())
+		default:
+			return false
+		}
+	}
+	if r.failed {
+		return false
+	}
+	scrubQUICCrypto(frames, sni)
+	return true
+}
+
+// scrubQUICCrypto scrubs the ClientHello carried by CRYPTO frames, which may
+// be split in several frames in any order. The data after a gap, or of other
+// messages, can not be parsed and is zeroed, as is an extension to scrub that
+// is cut by the end of the data.
+func scrubQUICCrypto(frames []quicCrypto, sni *SNIAnonymizer) {
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].offset < frames[j].offset
+	})
+	end := uint64(0)
+	for _, f := range frames {
+		if f.offset > end {
+			break
+		}
+		if f.offset+uint64(len(f.data)) > end {
+			end = f.offset + uint64(len(f.data))
+		}
+	}
+
+	// The message is scrubbed behind the header of the record carrying it
+	// over TCP
+	record := make([]byte, 5+end)
+	copy(record, []byte{tlsRecordHandshake, 3, 1, byte(end >> 8), byte(end)})
+	for _, f := range frames {
+		if f.offset < end {
+			copy(record[5+f.offset:], f.data)
+		}
+	}
+	scrubbed := make([]byte, len(record))
+	if out, ok := scrubClientHello(record, sni); ok {
+		copy(scrubbed, out)
+	}
+	for _, f := range frames {
+		start := f.offset
+		if start > end {
+			start = end
+		}
+		zero(f.data[copy(f.data, scrubbed[5+start:]):])
+	}
+}
+
+// quicReader reads the fields of QUIC packets. Reading past the end of the
+// data makes it fail.
+type quicReader struct {
+	data   []byte
+	off    int
+	failed bool
+}
+
+func (r *quicReader) byte() byte {
+	if r.failed || r.off >= len(r.data) {
+		r.failed = true
+		return 0
+	}
+	r.off++
+	return r.data[r.off-1]
+}
+
+// varint reads a variable-length integer (RFC 9000, section 16).
+func (r *quicReader) varint() uint64 {
+	first := r.byte()
+	n := 1 << (first >> 6)
+	v := uint64(first & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(r.byte())
+	}
+	return v
+}
+
+func (r *quicReader) bytes(n uint64) []byte {
+	if r.failed || n > uint64(len(r.data)-r.off) {
+		r.failed = true
+		return nil
+	}
+	r.off += int(n)
+	return r.data[r.off-int(n) : r.off]
+}
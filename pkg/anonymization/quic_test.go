@@ -0,0 +1,289 @@
+package anonymization
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The client Initial packet of RFC 9001, appendix A.2
+const (
+	testQUICDCID  = "8394c8f03e515708"
+	testQUICHello = "060040f1010000ed0303ebf8fa56f12939b9584a3896472ec40bb863cfd3e86804fe3a" +
+		"47f06a2b69484c00000413011302010000c000000010000e00000b6578616d706c652e636f6d" +
+		"ff01000100000a00080006001d0017001800100007000504616c706e00050005010000000000" +
+		"3300260024001d00209370b2c9caa47fbabaf4559fedba753de171fa71f50f1ce15d43e994ec" +
+		"74d748002b0003020304000d0010000e0403050306030203080408050806002d00020101001c" +
+		"00024001003900320408ffffffffffffffff05048000ffff07048000ffff0801100104800075" +
+		"300901100f088394c8f03e51570806048000ffff"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testQUICInitial builds the Initial packet of a client with a packet number
+// of 4 bytes, carrying frames padded to size bytes.
+func testQUICInitial(t *testing.T, v *quicVersion, version uint32, dcid []byte, pn uint32, frames []byte, size int) []byte {
+	plain := make([]byte, size)
+	copy(plain, frames)
+	header := []byte{0xc0 | v.initial<<4 | 3, 0, 0, 0, 0, byte(len(dcid))}
+	binary.BigEndian.PutUint32(header[1:], version)
+	header = append(header, dcid...)
+	// Source connection ID, token and length
+	length := 4 + size + 16
+	header = append(header, 0, 0, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint32(header, pn)
+
+	keys, err := newQUICClientInitialKeys(v, dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < 4; i++ {
+		nonce[len(nonce)-4+i] ^= header[pnOffset+i]
+	}
+	packet := keys.aead.Seal(append([]byte(nil), header...), nonce, plain, header)
+	mask := make([]byte, 16)
+	keys.hp.Encrypt(mask, packet[pnOffset+4:])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// openTestQUICInitial returns the frames of the Initial packet of a client.
+func openTestQUICInitial(t *testing.T, v *quicVersion, packet []byte) []byte {
+	p, ok := parseQUICPacket(packet, v)
+	if !ok || p.typ != v.initial {
+		t.Fatal("Not an Initial packet")
+	}
+	keys, err := newQUICClientInitialKeys(v, p.dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := make([]byte, 16)
+	keys.hp.Encrypt(mask, packet[p.pnOffset+4:])
+	header := append([]byte(nil), packet[:p.pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	if header[0]&3 != 3 {
+		t.Fatal("Wrong packet number length")
+	}
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < 4; i++ {
+		header[p.pnOffset+i] ^= mask[1+i]
+		nonce[len(nonce)-4+i] ^= header[p.pnOffset+i]
+	}
+	plain, err := keys.aead.Open(nil, nonce, packet[len(header):p.end], header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+// testCryptoFrame builds a CRYPTO frame.
+func testCryptoFrame(offset int, data []byte) []byte {
+	return append([]byte{quicFrameCrypto, 0x40 | byte(offset>>8), byte(offset), 0x40 | byte(len(data)>>8), byte(len(data))}, data...)
+}
+
+// testCryptoData returns the data of the CRYPTO frames built by
+// testCryptoFrame, indexed by offset, among padding and PING frames.
+func testCryptoData(plain []byte) map[int][]byte {
+	data := make(map[int][]byte)
+	for off := 0; off < len(plain); {
+		if plain[off] != quicFrameCrypto {
+			// Padding and PING frames
+			off++
+			continue
+		}
+		offset := int(binary.BigEndian.Uint16(plain[off+1:]) & 0x3fff)
+		length := int(binary.BigEndian.Uint16(plain[off+3:]) & 0x3fff)
+		data[offset] = plain[off+5 : off+5+length]
+		off += 5 + length
+	}
+	return data
+}
+
+// TestQUICInitialKeys tests the derivation of the keys of Initial packets
+// against RFC 9001, appendix A.
+func TestQUICInitialKeys(t *testing.T) {
+	secret := hkdfExpandLabel(hkdfExtract(unhex(t, testQUICDCID), quicV1.salt), "client in", 32)
+	for _, test := range []struct {
+		label string
+		n     int
+		want  string
+	}{
+		{"quic key", 16, "1f369613dd76d5467730efcbe3b1a22d"},
+		{"quic iv", 12, "fa044b2f42a3fd3b46fb255c"},
+		{"quic hp", 16, "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if got := hex.EncodeToString(hkdfExpandLabel(secret, test.label, test.n)); got != test.want {
+			t.Errorf("%s %s instead of %s", test.label, got, test.want)
+		}
+	}
+
+	packet := testQUICInitial(t, quicV1, quicVersion1, unhex(t, testQUICDCID), 2, unhex(t, testQUICHello), 1162)
+	if got := hex.EncodeToString(packet[:22+16]); got != "c000000001088394c8f03e5157080000449e7b9aec34"+"d1b1c98dd7689fb8ec11d242b123dc9b" {
+		t.Errorf("Protected packet starting with %s", got)
+	}
+}
+
+// TestScrubQUIC tests that the ClientHello of the Initial packets of clients
+// is scrubbed and that the packets that can not be scrubbed are removed.
+func TestScrubQUIC(t *testing.T) {
+	sni := NewSNIAnonymizer(SNIHash, []byte("0123456789abcdef0123456789abcdef"))
+	dcid := unhex(t, testQUICDCID)
+
+	// The Initial packet of the RFC
+	hello := unhex(t, testQUICHello)
+	packet := testQUICInitial(t, quicV1, quicVersion1, dcid, 2, hello, 1162)
+	out, ok := scrubQUIC(packet, sni)
+	if !ok || len(out) != len(packet) {
+		t.Fatalf("RFC Initial scrubbed to %d bytes", len(out))
+	}
+	plain := openTestQUICInitial(t, quicV1, out)
+	want := bytes.Replace(hello, []byte("example.com"), sni.Anonymize([]byte("example.com")), 1)
+	if !bytes.Equal(plain[:len(hello)], want) || bytes.Contains(plain, []byte("example.com")) {
+		t.Errorf("RFC Initial scrubbed to %x", plain[:len(hello)])
+	}
+
+	// A ClientHello in two CRYPTO frames out of order, with a continuation
+	// frame after a gap, followed by a Handshake packet
+	record := testClientHello("x.com")
+	scrubbed, _ := scrubClientHello(record, sni)
+	msg := record[5:]
+	frames := bytes.Join([][]byte{
+		testCryptoFrame(100, msg[100:]),
+		{quicFramePing},
+		testCryptoFrame(0, msg[:100]),
+		testCryptoFrame(len(msg)+10, []byte("session ticket")),
+	}, nil)
+	handshake := append([]byte{0xe0, 0, 0, 0, 1, 0, 0, 0x40, 30}, bytes.Repeat([]byte{0x42}, 30)...)
+	for _, v := range []struct {
+		name    string
+		v       *quicVersion
+		version uint32
+	}{{"v1", quicV1, quicVersion1}, {"v2", quicV2, quicVersion2}} {
+		packet := testQUICInitial(t, v.v, v.version, dcid, 0, frames, 1200)
+		binary.BigEndian.PutUint32(handshake[1:], v.version)
+		// Handshake packets are of type 2 in QUIC v1 and 3 in QUIC v2
+		handshake[0] = 0xc0 | (v.v.initial+2)<<4
+		datagram := append(append([]byte(nil), packet...), handshake...)
+
+		out, ok := scrubQUIC(datagram, sni)
+		if !ok || len(out) != len(datagram) {
+			t.Fatalf("%s: datagram scrubbed to %d bytes", v.name, len(out))
+		}
+		if !bytes.Equal(out[len(packet):], handshake) {
+			t.Errorf("%s: Handshake packet changed", v.name)
+		}
+		data := testCryptoData(openTestQUICInitial(t, v.v, out[:len(packet)]))
+		if got := append(append([]byte(nil), data[0]...), data[100]...); !bytes.Equal(got, scrubbed[5:]) {
+			t.Errorf("%s: ClientHello scrubbed to %x", v.name, got)
+		}
+		if !bytes.Equal(data[len(msg)+10], make([]byte, len("session ticket"))) {
+			t.Errorf("%s: continuation frame kept", v.name)
+		}
+	}
+
+	// Initial packets that can not be decrypted with the keys of the client
+	server := testQUICInitial(t, quicV1, quicVersion1, dcid, 0, hello, 1162)
+	server[len(server)-1] ^= 1
+	draft := testQUICInitial(t, quicV1, 0xff00001d, dcid, 0, hello, 1162)
+	for _, test := range []struct {
+		name     string
+		datagram []byte
+		want     []byte
+	}{
+		{"server", append(append([]byte(nil), handshake...), server...), handshake},
+		{"draft", draft, nil},
+		{"cut", packet[:len(packet)-1], nil},
+		{"google", append([]byte{0xc3, 'Q', '0', '5', '0'}, hello...), nil},
+	} {
+		if out, ok := scrubQUIC(test.datagram, sni); !ok || !bytes.Equal(out, test.want) {
+			t.Errorf("%s: datagram scrubbed to %x", test.name, out)
+		}
+	}
+	unknown := append([]byte{0xc3, 0x1a, 0x2a, 0x3a, 0x4a}, hello...)
+	if out, ok := scrubQUIC(unknown, sni); ok || !bytes.Equal(out, unknown) {
+		t.Error("Payload of unknown version scrubbed")
+	}
+}
+
+// TestQUIC tests that the ClientHello of QUIC Initial packets is scrubbed
+// under each checksum mode, and that it is not kept in fragments.
+func TestQUIC(t *testing.T) {
+	full, err := NewPayloadPolicy([]PayloadRule{{Mode: PayloadFull}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := testClientHello("x.com")
+	packet := testQUICInitial(t, quicV1, quicVersion1, unhex(t, testQUICDCID), 0, testCryptoFrame(0, record[5:]), 1200)
+	data := serializeTestPacket(t, false, false, packet)
+
+	for _, checksums := range []string{ChecksumsKeep, ChecksumsRecompute, ChecksumsPreserveLength} {
+		am := NewAModule(AModuleConfiguration{
+			Key:       []byte("0123456789abcdef0123456789abcdef"),
+			Anonymize: true,
+			LocalNets: []string{"192.0.2.0/24"},
+			Payload:   full,
+			Checksums: checksums,
+		})
+		pkt := decodeTestPacket(t, append([]byte(nil), data...))
+		if err := am.Anonymize(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if len(pkt.OutBuf.Bytes()) != len(pkt.RawData) {
+			t.Errorf("%s: %d bytes written instead of %d", checksums, len(pkt.OutBuf.Bytes()), len(pkt.RawData))
+		}
+		out := gopacket.NewPacket(pkt.OutBuf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+		ip := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		plain := openTestQUICInitial(t, quicV1, ip.Payload[8:])
+		for _, field := range []string{"x.com", "session ticket", "psk identity"} {
+			if bytes.Contains(plain, []byte(field)) {
+				t.Errorf("%s: %s kept", checksums, field)
+			}
+		}
+		if checksums == ChecksumsKeep {
+			if !bytes.Equal(ip.Payload[6:8], data[14+20+6:][:2]) {
+				t.Errorf("%s: checksum changed", checksums)
+			}
+		} else if csum := transportChecksum(ip.SrcIP.To4(), ip.DstIP.To4(), uint8(layers.IPProtocolUDP), ip.Payload); csum != 0 {
+			t.Errorf("%s: wrong UDP checksum", checksums)
+		}
+	}
+
+	// Only the UDP header of the first fragment is kept
+	am := NewAModule(AModuleConfiguration{
+		Key:       []byte("0123456789abcdef0123456789abcdef"),
+		Anonymize: true,
+		LocalNets: []string{"192.0.2.0/24"},
+		Payload:   full,
+	})
+	ip := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	frag := *ip
+	frag.Flags = layers.IPv4MoreFragments
+	buf := gopacket.NewSerializeBuffer()
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{6, 7, 8, 9, 10, 11}, EthernetType: layers.EthernetTypeIPv4}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, &frag, gopacket.Payload(ip.Payload[:512])); err != nil {
+		t.Fatal(err)
+	}
+	pkt := decodeTestPacket(t, buf.Bytes())
+	if err := am.Anonymize(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(pkt.OutBuf.Bytes(), packet[:16]) {
+		t.Error("QUIC payload of the first fragment kept")
+	}
+}
@@ -0,0 +1,193 @@
+package anonymization
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// byteChange is the replacement of bytes of a packet rewritten in place
+type byteChange struct {
+	off      int
+	old, new []byte
+}
+
+// checksumField is a checksum of a packet rewritten in place
+type checksumField struct {
+	// Offset of the field
+	off int
+	// Bytes of the packet covered by the checksum
+	start, end int
+	// Changes of the pseudo-header, for transport and ICMPv6 checksums
+	pseudo []byteChange
+	// A zero UDP checksum means that there is none
+	udp bool
+}
+
+// addrRewriter maps the addresses of a packet in place
+type addrRewriter struct {
+	data    []byte
+	mapAddr func(net.IP) net.IP
+	changes []byteChange
+	fields  []checksumField
+}
+
+// RewriteAddresses replaces in place every IP address of a packet decoded from
+// its first layer with mapAddr, including the addresses of tunneled packets,
+// of packets quoted by ICMP and ICMPv6 error messages and of ICMP redirect
+// gateways, and updates incrementally the checksums covering them. The
+// checksums of packets truncated by the capture are updated as well.
+func RewriteAddresses(data []byte, first gopacket.Decoder, mapAddr func(net.IP) net.IP) {
+	r := &addrRewriter{data: data, mapAddr: mapAddr}
+	packet := gopacket.NewPacket(data, first, gopacket.NoCopy)
+	// Changes of the addresses of the innermost IP header so far
+	var pseudo []byteChange
+	for _, l := range packet.Layers() {
+		off := offset(data, l.LayerContents())
+		end := off + len(l.LayerContents()) + len(l.LayerPayload())
+		switch l := l.(type) {
+		case *layers.IPv4:
+			pseudo = r.rewriteIP(off, true)
+			r.fields = append(r.fields, checksumField{off: off + 10, start: off, end: off + len(l.Contents)})
+			if l.Flags&layers.IPv4MoreFragments != 0 && l.FragOffset == 0 {
+				// The transport checksum of a first fragment covers the whole
+				// datagram, only its pseudo-header changes
+				r.addTransportField(off+len(l.Contents), end, uint8(l.Protocol), pseudo)
+			}
+		case *layers.IPv6:
+			pseudo = r.rewriteIP(off, false)
+		case *layers.TCP:
+			r.fields = append(r.fields, checksumField{off: off + 16, start: off, end: end, pseudo: pseudo})
+		case *layers.UDP:
+			r.fields = append(r.fields, checksumField{off: off + 6, start: off, end: end, pseudo: pseudo, udp: true})
+		case *layers.GRE:
+			if l.ChecksumPresent {
+				r.fields = append(r.fields, checksumField{off: off + 4, start: off, end: end})
+			}
+		case *layers.ICMPv4:
+			r.fields = append(r.fields, checksumField{off: off + 2, start: off, end: end})
+			switch l.TypeCode.Type() {
+			case layers.ICMPv4TypeRedirect:
+				if end >= off+8 {
+					r.rewriteAddr(off+4, net.IPv4len)
+				}
+				r.rewriteQuote(off+8, end)
+			case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench,
+				layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+				r.rewriteQuote(off+8, end)
+			}
+		case *layers.ICMPv6:
+			r.fields = append(r.fields, checksumField{off: off + 2, start: off, end: end, pseudo: pseudo})
+			switch l.TypeCode.Type() {
+			case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig,
+				layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+				r.rewriteQuote(off+8, end)
+			}
+		}
+	}
+	r.updateChecksums()
+}
+
+// rewriteAddr maps the address of n bytes at off and returns the change.
+func (r *addrRewriter) rewriteAddr(off, n int) byteChange {
+	c := byteChange{off: off, old: append([]byte(nil), r.data[off:off+n]...)}
+	addr := r.mapAddr(net.IP(c.old))
+	if n == net.IPv4len {
+		c.new = addr.To4()
+	} else {
+		c.new = addr.To16()
+	}
+	copy(r.data[off:], c.new)
+	r.changes = append(r.changes, c)
+	return c
+}
+
+// rewriteIP maps the addresses of the IPv4 or IPv6 header at off and returns
+// the changes of the pseudo-header.
+func (r *addrRewriter) rewriteIP(off int, ipv4 bool) []byteChange {
+	if ipv4 {
+		return []byteChange{r.rewriteAddr(off+12, net.IPv4len), r.rewriteAddr(off+16, net.IPv4len)}
+	}
+	return []byteChange{r.rewriteAddr(off+8, net.IPv6len), r.rewriteAddr(off+24, net.IPv6len)}
+}
+
+// rewriteQuote maps the addresses of the packet quoted between off and end by
+// an ICMP error message.
+func (r *addrRewriter) rewriteQuote(off, end int) {
+	if off >= end {
+		return
+	}
+	q := newICMPQuote(r.data[off:end])
+	if q == nil {
+		return
+	}
+	pseudo := r.rewriteIP(off, q.ipv4)
+	if q.ipv4 {
+		r.fields = append(r.fields, checksumField{off: off + 10, start: off, end: off + q.ipLen})
+	}
+	r.addTransportField(off+q.ipLen, end, q.protocol, pseudo)
+}
+
+// addTransportField adds the TCP or UDP checksum of a segment between off and
+// end whose pseudo-header changes, if the segment holds it.
+func (r *addrRewriter) addTransportField(off, end int, protocol uint8, pseudo []byteChange) {
+	switch layers.IPProtocol(protocol) {
+	case layers.IPProtocolTCP:
+		if off+18 <= end {
+			r.fields = append(r.fields, checksumField{off: off + 16, start: off, end: end, pseudo: pseudo})
+		}
+	case layers.IPProtocolUDP:
+		if off+8 <= end {
+			r.fields = append(r.fields, checksumField{off: off + 6, start: off, end: end, pseudo: pseudo, udp: true})
+		}
+	}
+}
+
+// updateChecksums updates the checksums for the changes of the bytes they
+// cover. Checksums are updated from the end of the packet, so that the
+// changes of the checksums of carried packets are covered by the outer ones.
+func (r *addrRewriter) updateChecksums() {
+	sort.Slice(r.fields, func(i, j int) bool {
+		return r.fields[i].off > r.fields[j].off
+	})
+	for _, f := range r.fields {
+		old := binary.BigEndian.Uint16(r.data[f.off:])
+		if f.udp && old == 0 {
+			continue
+		}
+		csum := old
+		for _, c := range f.pseudo {
+			csum = updateChecksum(csum, c.old, c.new)
+		}
+		for _, c := range r.changes {
+			if c.off >= f.start && c.off < f.end {
+				csum = updateAlignedChecksum(csum, c.off-f.start, c.old, c.new)
+			}
+		}
+		if f.udp && csum == 0 {
+			csum = 0xffff
+		}
+		c := byteChange{off: f.off, old: make([]byte, 2), new: make([]byte, 2)}
+		binary.BigEndian.PutUint16(c.old, old)
+		binary.BigEndian.PutUint16(c.new, csum)
+		copy(r.data[f.off:], c.new)
+		r.changes = append(r.changes, c)
+	}
+}
+
+// updateAlignedChecksum updates a checksum for the replacement of old by new at
+// offset off of the covered bytes, which may be odd.
+func updateAlignedChecksum(csum uint16, off int, old, new []byte) uint16 {
+	if off%2 == 1 {
+		old = append([]byte{0}, old...)
+		new = append([]byte{0}, new...)
+	}
+	if len(old)%2 == 1 {
+		old = append(old[:len(old):len(old)], 0)
+		new = append(new[:len(new):len(new)], 0)
+	}
+	return updateChecksum(csum, old, new)
+}
@@ -0,0 +1,90 @@
+package anonymization
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testMapAddr flips bits of the last bytes of addresses.
+func testMapAddr(addr net.IP) net.IP {
+	ret := append(net.IP(nil), addr...)
+	ret[len(ret)-1] ^= 0xa5
+	ret[len(ret)-2] ^= 0x3c
+	return ret
+}
+
+// serializeTestRewrite builds test packets with their addresses mapped by
+// mapAddr: TCP over IPv4, ICMP and ICMPv6 errors quoting UDP, and TCP over
+// GRE with a checksum.
+func serializeTestRewrite(t *testing.T, mapAddr func(net.IP) net.IP) [][]byte {
+	serialize := func(l ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	ipv4 := func(src, dst string, protocol layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol,
+			SrcIP: mapAddr(net.ParseIP(src).To4()), DstIP: mapAddr(net.ParseIP(dst).To4())}
+	}
+	ipv6 := func(src, dst string, protocol layers.IPProtocol) *layers.IPv6 {
+		return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: protocol,
+			SrcIP: mapAddr(net.ParseIP(src)), DstIP: mapAddr(net.ParseIP(dst))}
+	}
+	tcp := func(ip gopacket.NetworkLayer) *layers.TCP {
+		l := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, Window: 1024}
+		l.SetNetworkLayerForChecksum(ip)
+		return l
+	}
+	udp := func(ip gopacket.NetworkLayer) *layers.UDP {
+		l := &layers.UDP{SrcPort: 40000, DstPort: 53}
+		l.SetNetworkLayerForChecksum(ip)
+		return l
+	}
+
+	ip4 := ipv4("192.0.2.1", "198.51.100.7", layers.IPProtocolTCP)
+	plain := serialize(ip4, tcp(ip4), gopacket.Payload("payload"))
+
+	quoted4 := ipv4("192.0.2.1", "198.51.100.7", layers.IPProtocolUDP)
+	quote4 := serialize(quoted4, udp(quoted4), gopacket.Payload("query"))[:28]
+	icmp4 := serialize(ipv4("198.51.100.1", "192.0.2.1", layers.IPProtocolICMPv4),
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)},
+		gopacket.Payload(quote4))
+
+	quoted6 := ipv6("2001:db8::1", "2001:db8:1::2", layers.IPProtocolUDP)
+	quote6 := serialize(quoted6, udp(quoted6), gopacket.Payload("query"))[:48]
+	ip6 := ipv6("2001:db8:2::1", "2001:db8::1", layers.IPProtocolICMPv6)
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)}
+	icmp.SetNetworkLayerForChecksum(ip6)
+	icmp6 := serialize(ip6, icmp, gopacket.Payload(append(make([]byte, 4), quote6...)))
+
+	inner := ipv4("192.0.2.1", "198.51.100.7", layers.IPProtocolTCP)
+	gre := serialize(ipv4("203.0.113.1", "203.0.113.2", layers.IPProtocolGRE),
+		&layers.GRE{ChecksumPresent: true, Protocol: layers.EthernetTypeIPv4},
+		inner, tcp(inner), gopacket.Payload("payload"))
+
+	return [][]byte{plain, icmp4, icmp6, gre}
+}
+
+// TestRewriteAddresses tests that the addresses of packets, tunnels and ICMP
+// quotes are rewritten with valid checksums.
+func TestRewriteAddresses(t *testing.T) {
+	orig := serializeTestRewrite(t, func(addr net.IP) net.IP { return addr })
+	expected := serializeTestRewrite(t, testMapAddr)
+	for i, data := range orig {
+		first := layers.LayerTypeIPv4
+		if data[0]>>4 == 6 {
+			first = layers.LayerTypeIPv6
+		}
+		RewriteAddresses(data, first, testMapAddr)
+		if !bytes.Equal(data, expected[i]) {
+			t.Errorf("Packet %d rewritten as\n%x\ninstead of\n%x", i, data, expected[i])
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package anonymization
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	RotationNever    = "never"
+	RotationHourly   = "hourly"
+	RotationDaily    = "daily"
+	RotationWeekly   = "weekly"
+	RotationInterval = "interval"
+)
+
+// RotationPolicy defines when key epochs start.
+type RotationPolicy struct {
+	// One of the Rotation* constants
+	Kind string
+	// Length of the epochs for hourly and interval rotation
+	Interval time.Duration
+	// Hour of the day when daily and weekly epochs start. Interval epochs
+	// are aligned to this hour on 1970-01-01
+	Hour int
+	// Time zone used to interpret Hour
+	Location *time.Location
+}
+
+// ParseRotationPolicy builds a rotation policy. rotation is one of "never",
+// "hourly", "daily", "weekly" or a number of hours such as "6h". An empty
+// rotation means daily. timezone is an IANA time zone name, empty for the
+// local time zone.
+func ParseRotationPolicy(rotation string, hour int, timezone string) (*RotationPolicy, error) {
+	p := &RotationPolicy{Hour: hour, Location: time.Local}
+	if hour < 0 || hour > 23 {
+		return nil, fmt.Errorf("invalid rotation hour %d", hour)
+	}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		p.Location = loc
+	}
+
+	switch strings.ToLower(rotation) {
+	case "", RotationDaily:
+		p.Kind = RotationDaily
+	case RotationWeekly:
+		p.Kind = RotationWeekly
+	case RotationNever:
+		p.Kind = RotationNever
+	case RotationHourly:
+		p.Kind = RotationHourly
+		p.Interval = time.Hour
+	default:
+		d, err := time.ParseDuration(rotation)
+		if err != nil || d <= 0 || d%time.Hour != 0 {
+			return nil, fmt.Errorf("invalid rotation %q, expected never, hourly, daily, weekly or a number of hours", rotation)
+		}
+		p.Kind = RotationInterval
+		p.Interval = d
+	}
+	return p, nil
+}
+
+// Never returns whether keys are never rotated.
+func (p *RotationPolicy) Never() bool {
+	return p.Kind == RotationNever
+}
+
+// EpochStart returns the start of the epoch containing now. When keys are
+// never rotated there is a single epoch starting at the Unix epoch.
+func (p *RotationPolicy) EpochStart(now time.Time) time.Time {
+	now = now.In(p.Location)
+	switch p.Kind {
+	case RotationDaily:
+		start := time.Date(now.Year(), now.Month(), now.Day(), p.Hour, 0, 0, 0, p.Location)
+		if now.Before(start) {
+			start = start.AddDate(0, 0, -1)
+		}
+		return start
+	case RotationWeekly:
+		// Weekly epochs start on Monday
+		offset := (int(now.Weekday()) + 6) % 7
+		start := time.Date(now.Year(), now.Month(), now.Day()-offset, p.Hour, 0, 0, 0, p.Location)
+		if now.Before(start) {
+			start = start.AddDate(0, 0, -7)
+		}
+		return start
+	case RotationHourly, RotationInterval:
+		anchor := time.Date(1970, 1, 1, p.Hour, 0, 0, 0, p.Location)
+		n := now.Sub(anchor) / p.Interval
+		if now.Before(anchor.Add(n * p.Interval)) {
+			n--
+		}
+		return anchor.Add(n * p.Interval)
+	default:
+		return time.Unix(0, 0).In(p.Location)
+	}
+}
+
+// Next returns the start of the epoch following the one starting at start.
+// It must not be called when keys are never rotated.
+func (p *RotationPolicy) Next(start time.Time) time.Time {
+	switch p.Kind {
+	case RotationDaily:
+		return start.AddDate(0, 0, 1)
+	case RotationWeekly:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.Add(p.Interval)
+	}
+}
@@ -0,0 +1,38 @@
+package anonymization
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRotationPolicy checks the epoch boundaries of the supported policies.
+func TestRotationPolicy(t *testing.T) {
+	now := time.Date(2024, 3, 6, 1, 30, 0, 0, time.UTC) // Wednesday
+	for _, tc := range []struct {
+		rotation string
+		start    string
+		next     string
+	}{
+		{"daily", "2024-03-05T02:00:00Z", "2024-03-06T02:00:00Z"},
+		{"weekly", "2024-03-04T02:00:00Z", "2024-03-11T02:00:00Z"},
+		{"hourly", "2024-03-06T01:00:00Z", "2024-03-06T02:00:00Z"},
+		{"6h", "2024-03-05T20:00:00Z", "2024-03-06T02:00:00Z"},
+		{"never", "1970-01-01T00:00:00Z", ""},
+	} {
+		p, err := ParseRotationPolicy(tc.rotation, 2, "UTC")
+		if err != nil {
+			t.Fatalf("ParseRotationPolicy(%s) failed: %s", tc.rotation, err)
+		}
+		start := p.EpochStart(now)
+		if EpochID(start) != tc.start {
+			t.Errorf("%s: start %s != %s", tc.rotation, EpochID(start), tc.start)
+		}
+		if !p.Never() && EpochID(p.Next(start)) != tc.next {
+			t.Errorf("%s: next %s != %s", tc.rotation, EpochID(p.Next(start)), tc.next)
+		}
+	}
+
+	if _, err := ParseRotationPolicy("90m", 2, "UTC"); err == nil {
+		t.Error("ParseRotationPolicy accepted a rotation that is not a number of hours")
+	}
+}
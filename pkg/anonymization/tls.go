@@ -0,0 +1,298 @@
+package anonymization
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// Server names are replaced with a keyed hash
+	SNIHash = "hash"
+	// The labels of server names before their registrable domain are
+	// replaced with a keyed hash
+	SNIDomain = "domain"
+	// Server names are kept
+	SNIKeep = "keep"
+
+	sniKeyInfo = "traffic-anonymization server name key"
+)
+
+const (
+	tlsRecordHandshake = 22
+	tlsClientHello     = 1
+	// Offset of the session ID of a ClientHello: record and handshake
+	// headers, version and random
+	tlsClientHelloFixed = 5 + 4 + 2 + 32
+
+	tlsExtServerName             = 0
+	tlsExtSessionTicket          = 35
+	tlsExtPreSharedKey           = 41
+	tlsExtEncryptedClientHello   = 0xfe0d
+	tlsServerNameTypeHostName    = 0
+	tlsEncryptedClientHelloOuter = 0
+)
+
+// ParseSNIMode validates the server name handling, hash if empty.
+func ParseSNIMode(mode string) (string, error) {
+	switch mode = strings.ToLower(mode); mode {
+	case "":
+		return SNIHash, nil
+	case SNIHash, SNIDomain, SNIKeep:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown server name handling %q", mode)
+}
+
+// SNIAnonymizer anonymizes the server names of TLS ClientHello messages
+type SNIAnonymizer struct {
+	mode string
+	pool sync.Pool
+}
+
+// NewSNIAnonymizer creates a server name anonymizer for one of the SNI* modes
+// and an epoch key.
+func NewSNIAnonymizer(mode string, key []byte) *SNIAnonymizer {
+	ret := &SNIAnonymizer{mode: mode}
+	if mode != SNIKeep {
+		sniKey := hkdf(key, nil, []byte(sniKeyInfo), sha256.Size)
+		ret.pool.New = func() interface{} {
+			return hmac.New(sha256.New, sniKey)
+		}
+	}
+	return ret
+}
+
+// Anonymize returns the anonymized value of a server name, of the same length
+// so that the TCP stream keeps its sequence space. Names that are public
+// suffixes or registrable domains are kept by the domain mode.
+func (s *SNIAnonymizer) Anonymize(name []byte) []byte {
+	// Names are case insensitive
+	lower := strings.ToLower(string(name))
+	switch s.mode {
+	case SNIHash:
+		return s.hash(lower, len(name))
+	case SNIDomain:
+		domain, err := publicsuffix.EffectiveTLDPlusOne(lower)
+		if err != nil || len(domain) == len(lower) {
+			return name
+		}
+		// The dot before the domain is kept
+		prefix := len(lower) - len(domain) - 1
+		return append(s.hash(lower, prefix), lower[prefix:]...)
+	}
+	return name
+}
+
+// hash returns n hexadecimal digits of the keyed hash of a lower case name,
+// extended with a counter for long names.
+func (s *SNIAnonymizer) hash(name string, n int) []byte {
+	h := s.pool.Get().(hash.Hash)
+	defer s.pool.Put(h)
+	out := make([]byte, 0, n+hex.EncodedLen(sha256.Size))
+	digits := make([]byte, hex.EncodedLen(sha256.Size))
+	for counter := byte(0); len(out) < n; counter++ {
+		h.Reset()
+		h.Write([]byte{counter})
+		h.Write([]byte(name))
+		hex.Encode(digits, h.Sum(nil))
+		out = append(out, digits...)
+	}
+	return out[:n]
+}
+
+// isClientHello tells whether a TCP payload starts with a TLS ClientHello.
+func isClientHello(payload []byte) bool {
+	return len(payload) > 5 && payload[0] == tlsRecordHandshake && payload[1] == 3 && payload[5] == tlsClientHello
+}
+
+// clientHelloLen returns the length of the TLS record of the ClientHello
+// starting a payload.
+func clientHelloLen(payload []byte) int {
+	return 5 + int(binary.BigEndian.Uint16(payload[3:]))
+}
+
+// scrubClientHello returns a copy of a TCP payload starting with a TLS
+// ClientHello, with its server name anonymized and its session ID, session
+// ticket, PSK identities and encrypted ClientHello zeroed. The cipher suites,
+// the extensions and their order, the versions and all the lengths are kept.
+// The payload may end before the message: an extension to scrub that is cut
+// is removed with the rest of the payload, so the copy is never longer than
+// the payload. It returns false for other payloads.
+func scrubClientHello(payload []byte, sni *SNIAnonymizer) ([]byte, bool) {
+	if !isClientHello(payload) {
+		return payload, false
+	}
+	out := append([]byte(nil), payload...)
+
+	// Session ID, cipher suites and compression methods
+	off := tlsClientHelloFixed
+	for i, lenBytes := range []int{1, 2, 1} {
+		n, ok := readLength(out, off, lenBytes)
+		if !ok {
+			if i == 0 {
+				// The session ID is cut
+				return out[:off], true
+			}
+			return out, true
+		}
+		if i == 0 {
+			zero(out[off+1 : off+1+n])
+		}
+		off += lenBytes + n
+	}
+	off += 2
+	if off > len(out) {
+		return out, true
+	}
+	// Other records may follow the message
+	extsEnd := off + int(binary.BigEndian.Uint16(out[off-2:]))
+
+	for off+4 <= len(out) && off+4 <= extsEnd {
+		typ := binary.BigEndian.Uint16(out[off:])
+		length := int(binary.BigEndian.Uint16(out[off+2:]))
+		start, end := off+4, off+4+length
+		switch typ {
+		case tlsExtServerName, tlsExtSessionTicket, tlsExtPreSharedKey, tlsExtEncryptedClientHello:
+		default:
+			off = end
+			continue
+		}
+		if end > len(out) {
+			// The rest of the extension is beyond the payload
+			return out[:off], true
+		}
+
+		data := out[start:end]
+		var ok bool
+		switch typ {
+		case tlsExtServerName:
+			ok = scrubServerNames(data, sni)
+		case tlsExtSessionTicket:
+			zero(data)
+			ok = true
+		case tlsExtPreSharedKey:
+			ok = scrubPSKIdentities(data)
+		case tlsExtEncryptedClientHello:
+			ok = scrubEncryptedClientHello(data)
+		}
+		if !ok {
+			// Malformed extensions are removed with the rest of the payload
+			return out[:off], true
+		}
+		off = end
+	}
+	return out, true
+}
+
+// scrubFragmentClientHello scrubs the ClientHello starting the TCP payload in
+// the data of a first fragment. The TCP checksum, which covers the whole
+// datagram, is updated for the scrubbed bytes if update is set.
+func scrubFragmentClientHello(pkt *network.Packet, data []byte, sni *SNIAnonymizer, update bool) ([]byte, bool) {
+	hdrLen := len(pkt.Tcp.Contents)
+	if hdrLen < 20 || len(data) <= hdrLen {
+		return data, false
+	}
+	payload, ok := scrubClientHello(data[hdrLen:], sni)
+	if !ok {
+		return data, false
+	}
+	out := append(append(make([]byte, 0, hdrLen+len(payload)), data[:hdrLen]...), payload...)
+	if update {
+		csum, ok := updatePrefixChecksum(binary.BigEndian.Uint16(out[16:]), data[hdrLen:], payload)
+		if !ok {
+			// The checksum still covers the original payload
+			return out[:hdrLen], true
+		}
+		binary.BigEndian.PutUint16(out[16:], csum)
+	}
+	return out, true
+}
+
+// scrubServerNames anonymizes the host names of a server name extension, or
+// returns false if it is malformed.
+func scrubServerNames(data []byte, sni *SNIAnonymizer) bool {
+	n, ok := readLength(data, 0, 2)
+	if !ok || 2+n != len(data) {
+		return false
+	}
+	for off := 2; off < len(data); {
+		nameLen, ok := readLength(data, off+1, 2)
+		if !ok {
+			return false
+		}
+		if name := data[off+3 : off+3+nameLen]; data[off] == tlsServerNameTypeHostName {
+			copy(name, sni.Anonymize(name))
+		}
+		off += 3 + nameLen
+	}
+	return true
+}
+
+// scrubPSKIdentities zeroes the identities of a pre-shared key extension,
+// which are session tickets or external key identities. The binders are kept.
+func scrubPSKIdentities(data []byte) bool {
+	n, ok := readLength(data, 0, 2)
+	if !ok {
+		return false
+	}
+	identities := data[2 : 2+n]
+	for off := 0; off < len(identities); {
+		idLen, ok := readLength(identities, off, 2)
+		if !ok || off+2+idLen+4 > len(identities) {
+			return false
+		}
+		zero(identities[off+2 : off+2+idLen])
+		// Followed by the obfuscated ticket age
+		off += 2 + idLen + 4
+	}
+	return true
+}
+
+// scrubEncryptedClientHello zeroes the encapsulated key and the encrypted
+// ClientHello of an outer encrypted ClientHello extension. The cipher suite
+// and the configuration identifier are kept.
+func scrubEncryptedClientHello(data []byte) bool {
+	if len(data) == 0 || data[0] != tlsEncryptedClientHelloOuter {
+		// The inner extension is a single type byte
+		return true
+	}
+	// Type, cipher suite and configuration identifier
+	off := 1 + 4 + 1
+	for i := 0; i < 2; i++ {
+		n, ok := readLength(data, off, 2)
+		if !ok {
+			return false
+		}
+		zero(data[off+2 : off+2+n])
+		off += 2 + n
+	}
+	return true
+}
+
+// readLength reads a length field of lenBytes bytes at off, and checks that
+// the field and the data it announces are in data.
+func readLength(data []byte, off, lenBytes int) (int, bool) {
+	if off+lenBytes > len(data) {
+		return 0, false
+	}
+	n := 0
+	for _, b := range data[off : off+lenBytes] {
+		n = n<<8 | int(b)
+	}
+	return n, off+lenBytes+n <= len(data)
+}
+
+func zero(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
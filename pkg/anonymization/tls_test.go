@@ -0,0 +1,328 @@
+package anonymization
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testClientHello builds a TLS 1.3 ClientHello for name with a session ticket
+// and a pre-shared key identity.
+func testClientHello(name string) []byte {
+	vector := func(lenBytes int, data ...[]byte) []byte {
+		body := bytes.Join(data, nil)
+		out := make([]byte, lenBytes, lenBytes+len(body))
+		for i, n := lenBytes-1, len(body); i >= 0; i, n = i-1, n>>8 {
+			out[i] = byte(n)
+		}
+		return append(out, body...)
+	}
+	ext := func(typ uint16, data ...[]byte) []byte {
+		return append([]byte{byte(typ >> 8), byte(typ)}, vector(2, data...)...)
+	}
+
+	exts := bytes.Join([][]byte{
+		ext(10, vector(2, []byte{0, 0x1d, 0, 0x17})),
+		ext(tlsExtServerName, vector(2, []byte{tlsServerNameTypeHostName}, vector(2, []byte(name)))),
+		ext(tlsExtSessionTicket, []byte("session ticket")),
+		ext(43, vector(1, []byte{3, 4})),
+		ext(tlsExtPreSharedKey, vector(2, vector(2, []byte("psk identity")), []byte{1, 2, 3, 4}),
+			vector(2, vector(1, bytes.Repeat([]byte{0xbb}, 32)))),
+	}, nil)
+	hello := bytes.Join([][]byte{
+		{3, 3},
+		bytes.Repeat([]byte{0xaa}, 32),
+		vector(1, bytes.Repeat([]byte{0xcc}, 32)),
+		vector(2, []byte{0x13, 0x01, 0x13, 0x02}),
+		vector(1, []byte{0}),
+		vector(2, exts),
+	}, nil)
+	return append([]byte{tlsRecordHandshake, 3, 1}, vector(2, append([]byte{tlsClientHello}, vector(3, hello)...))...)
+}
+
+// testExtensions returns the types and data of the extensions of a ClientHello
+// built by testClientHello.
+func testExtensions(t *testing.T, hello []byte) (types []uint16, data [][]byte) {
+	if int(binary.BigEndian.Uint16(hello[3:])) != len(hello)-5 || int(hello[7])<<8|int(hello[8]) != len(hello)-9 {
+		t.Fatal("Wrong record or message length")
+	}
+	off := tlsClientHelloFixed + 33 + 6 + 2 + 2
+	if int(binary.BigEndian.Uint16(hello[off-2:])) != len(hello)-off {
+		t.Fatal("Wrong extensions length")
+	}
+	for off < len(hello) {
+		length := int(binary.BigEndian.Uint16(hello[off+2:]))
+		types = append(types, binary.BigEndian.Uint16(hello[off:]))
+		data = append(data, hello[off+4:off+4+length])
+		off += 4 + length
+	}
+	return types, data
+}
+
+// TestScrubClientHello tests that the identifying fields of ClientHello
+// messages are scrubbed and that the rest of the message is kept.
+func TestScrubClientHello(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	orig := testClientHello("www.example.co.uk")
+	origTypes, origData := testExtensions(t, orig)
+
+	hashed := string(NewSNIAnonymizer(SNIHash, key).Anonymize([]byte("WWW.example.co.uk")))
+	if len(hashed) != len("www.example.co.uk") || strings.Trim(hashed, "0123456789abcdef") != "" {
+		t.Errorf("Hashed server name %q", hashed)
+	}
+	if short := NewSNIAnonymizer(SNIHash, key).Anonymize([]byte("x.com")); len(short) != 5 {
+		t.Errorf("Short server name hashed to %q", short)
+	}
+	domain := string(NewSNIAnonymizer(SNIDomain, key).Anonymize([]byte("www.example.co.uk")))
+	if !strings.HasSuffix(domain, ".example.co.uk") || domain == "www.example.co.uk" || len(domain) != len(hashed) {
+		t.Errorf("Server name reduced to %q", domain)
+	}
+
+	for mode, expected := range map[string]string{
+		SNIHash:   hashed,
+		SNIDomain: domain,
+		SNIKeep:   "www.example.co.uk",
+	} {
+		out, ok := scrubClientHello(orig, NewSNIAnonymizer(mode, key))
+		if !ok || len(out) != len(orig) {
+			t.Fatalf("%s: ClientHello not recognized or resized to %d bytes", mode, len(out))
+		}
+		types, data := testExtensions(t, out)
+		if len(types) != len(origTypes) {
+			t.Fatalf("%s: %d extensions instead of %d", mode, len(types), len(origTypes))
+		}
+		for i, typ := range types {
+			if typ != origTypes[i] {
+				t.Errorf("%s: extension %d of type %d instead of %d", mode, i, typ, origTypes[i])
+			}
+			switch typ {
+			case tlsExtServerName:
+				if name := string(data[i][5:]); name != expected {
+					t.Errorf("%s: server name %q, expected %q", mode, name, expected)
+				}
+			case tlsExtSessionTicket:
+				if !bytes.Equal(data[i], make([]byte, len(data[i]))) {
+					t.Errorf("%s: session ticket not zeroed", mode)
+				}
+			case tlsExtPreSharedKey:
+				if bytes.Contains(data[i], []byte("psk identity")) || !bytes.Equal(data[i][len(data[i])-32:], origData[i][len(origData[i])-32:]) {
+					t.Errorf("%s: PSK identity not zeroed or binder changed", mode)
+				}
+			default:
+				if !bytes.Equal(data[i], origData[i]) {
+					t.Errorf("%s: extension %d changed", mode, typ)
+				}
+			}
+		}
+		// Version, random and cipher suites
+		if !bytes.Equal(out[:tlsClientHelloFixed+1], orig[:tlsClientHelloFixed+1]) ||
+			!bytes.Equal(out[tlsClientHelloFixed+33:][:6], orig[tlsClientHelloFixed+33:][:6]) {
+			t.Errorf("%s: fixed fields changed", mode)
+		}
+		if !bytes.Equal(out[tlsClientHelloFixed+1:][:32], make([]byte, 32)) {
+			t.Errorf("%s: session ID not zeroed", mode)
+		}
+	}
+
+	// An extension cut by the end of the payload is removed
+	cut := bytes.Index(orig, []byte("www.example")) + 3
+	out, _ := scrubClientHello(orig[:cut], NewSNIAnonymizer(SNIHash, key))
+	if bytes.Contains(out, []byte("www")) || len(out) >= cut {
+		t.Errorf("Cut server name kept in %d bytes", len(out))
+	}
+}
+
+// checkTCPChecksum checks the checksum of a TCP segment sent from src to dst.
+func checkTCPChecksum(t *testing.T, name string, src, dst net.IP, segment []byte) {
+	if len(src) == net.IPv4len || src.To4() != nil {
+		src, dst = src.To4(), dst.To4()
+	}
+	if csum := transportChecksum(src, dst, uint8(layers.IPProtocolTCP), segment); csum != 0 {
+		t.Errorf("%s: wrong TCP checksum", name)
+	}
+}
+
+// TestClientHello tests that the ClientHello of TCP segments and of first
+// fragments is scrubbed under each checksum mode.
+func TestClientHello(t *testing.T) {
+	full, err := NewPayloadPolicy([]PayloadRule{{Mode: PayloadFull}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Followed by an application data record, in the second fragment
+	hello := append(testClientHello("x.com"), 23, 3, 3, 0, 11)
+	hello = append(hello, bytes.Repeat([]byte{0xdd}, 11)...)
+	data := serializeTestPacket(t, false, true, hello)
+	first, second := serializeTestClientHelloFragments(t, hello)
+
+	for _, checksums := range []string{ChecksumsKeep, ChecksumsRecompute, ChecksumsPreserveLength} {
+		am := NewAModule(AModuleConfiguration{
+			Key:       []byte("0123456789abcdef0123456789abcdef"),
+			Anonymize: true,
+			LocalNets: []string{"192.0.2.0/24"},
+			Payload:   full,
+			Checksums: checksums,
+		})
+		for _, frag := range []bool{false, true} {
+			name := checksums
+			pkt := decodeTestPacket(t, append([]byte(nil), data...))
+			if frag {
+				name += " fragment"
+				pkt = decodeTestPacket(t, append([]byte(nil), first...))
+			}
+			if err := am.Anonymize(pkt); err != nil {
+				t.Fatal(err)
+			}
+			if len(pkt.OutBuf.Bytes()) != len(pkt.RawData) || pkt.Ci.Length != len(pkt.RawData) {
+				t.Errorf("%s: %d bytes written, length %d instead of %d", name, len(pkt.OutBuf.Bytes()), pkt.Ci.Length, len(pkt.RawData))
+			}
+			out := gopacket.NewPacket(pkt.OutBuf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+			ip := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if int(ip.Length) != len(ip.Contents)+len(ip.Payload) {
+				t.Errorf("%s: IP length %d for %d bytes", name, ip.Length, len(ip.Contents)+len(ip.Payload))
+			}
+			for _, field := range []string{"x.com", "session ticket", "psk identity"} {
+				if bytes.Contains(ip.Payload, []byte(field)) {
+					t.Errorf("%s: %s kept", name, field)
+				}
+			}
+
+			segment := ip.Payload
+			if frag {
+				// The checksum covers the whole datagram
+				orig := gopacket.NewPacket(second, layers.LayerTypeEthernet, gopacket.Default)
+				segment = append(append([]byte(nil), segment...), orig.Layer(layers.LayerTypeIPv4).LayerPayload()...)
+			}
+			if checksums == ChecksumsKeep {
+				if !bytes.Equal(segment[16:18], data[14+20+16:][:2]) {
+					t.Errorf("%s: checksum changed", name)
+				}
+			} else {
+				checkTCPChecksum(t, name, ip.SrcIP, ip.DstIP, segment)
+			}
+		}
+	}
+}
+
+// serializeTestClientHelloFragments splits a TCP segment carrying a ClientHello
+// in two IPv4 fragments, the second one with the last 8 bytes.
+func serializeTestClientHelloFragments(t *testing.T, hello []byte) (first, second []byte) {
+	packet := serializeTestPacket(t, false, true, hello)
+	ip := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	segment := ip.Payload
+	split := (len(segment) - 8) &^ 7
+
+	fragment := func(offset, end int, more bool) []byte {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		frag := *ip
+		frag.FragOffset = uint16(offset / 8)
+		if more {
+			frag.Flags = layers.IPv4MoreFragments
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, &frag, gopacket.Payload(segment[offset:end])); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	return fragment(0, split, true), fragment(split, len(segment), false)
+}
+
+// serializeTestSegment builds an IPv4 TCP segment starting at seq.
+func serializeTestSegment(t *testing.T, seq uint32, payload []byte) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Id: 1234, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("198.51.100.7")}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: seq, ACK: true, PSH: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestSplitClientHello tests that the rest of a ClientHello split over several
+// TCP segments or IP fragments is not kept.
+func TestSplitClientHello(t *testing.T) {
+	full, err := NewPayloadPolicy([]PayloadRule{{Mode: PayloadFull}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := testClientHello("x.com")
+	data := []byte("application data")
+	// The server name extension starts in the first segment and is removed
+	split := 100
+	first, _ := scrubClientHello(hello[:split], NewSNIAnonymizer(SNIHash, []byte("0123456789abcdef0123456789abcdef")))
+	for _, checksums := range []string{ChecksumsKeep, ChecksumsRecompute, ChecksumsPreserveLength} {
+		am := NewAModule(AModuleConfiguration{
+			Key:       []byte("0123456789abcdef0123456789abcdef"),
+			Anonymize: true,
+			LocalNets: []string{"192.0.2.0/24"},
+			Payload:   full,
+			Checksums: checksums,
+		})
+		for _, test := range []struct {
+			name    string
+			seq     uint32
+			payload []byte
+			want    []byte
+		}{
+			{"first", 1, hello[:split], first},
+			// Out of order, in the middle and after the message
+			{"last", uint32(1 + split + 50), append(append([]byte(nil), hello[split+50:]...), data...),
+				append(make([]byte, len(hello)-split-50), data...)},
+			{"middle", uint32(1 + split), hello[split : split+50], make([]byte, 50)},
+			{"retransmitted", uint32(1 + split), hello[split:], make([]byte, len(hello)-split)},
+			{"after", uint32(1 + len(hello)), data, data},
+		} {
+			name := checksums + " " + test.name
+			pkt := decodeTestPacket(t, serializeTestSegment(t, test.seq, test.payload))
+			if err := am.Anonymize(pkt); err != nil {
+				t.Fatal(err)
+			}
+			out := gopacket.NewPacket(pkt.OutBuf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+			ip := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			tcp := out.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if !bytes.HasPrefix(tcp.Payload, test.want) || len(bytes.Trim(tcp.Payload[len(test.want):], "\x00")) != 0 {
+				t.Errorf("%s: payload %x instead of %x", name, tcp.Payload, test.want)
+			}
+			if checksums == ChecksumsPreserveLength && len(tcp.Payload) == len(test.payload) {
+				checkTCPChecksum(t, name, ip.SrcIP, ip.DstIP, ip.Payload)
+			}
+		}
+	}
+
+	// The message is cut by the first fragment
+	am := NewAModule(AModuleConfiguration{
+		Key:       []byte("0123456789abcdef0123456789abcdef"),
+		Anonymize: true,
+		LocalNets: []string{"192.0.2.0/24"},
+		Payload:   full,
+	})
+	firstFrag, secondFrag := serializeTestClientHelloFragments(t, hello)
+	for _, frag := range [][]byte{firstFrag, secondFrag} {
+		pkt := decodeTestPacket(t, append([]byte(nil), frag...))
+		if err := am.Anonymize(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(pkt.OutBuf.Bytes(), []byte{0xbb, 0xbb, 0xbb, 0xbb}) {
+			t.Error("Rest of a fragmented ClientHello kept")
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package anonymization
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+// anonymizeTunnel anonymizes the packet carried by the tunnel of a packet at
+// nesting level depth, with the same rules as the packet, and returns the
+// tunnel header followed by the anonymized carried packet, and the number of
+// header bytes removed from the carried packet, e.g. VLAN tags or IPv6
+// extension headers, by which the lengths of the tunnel must be reduced when
+// they are not recomputed. It returns an error if the carried packet is
+// dropped by the policy.
+func (am *AModule) anonymizeTunnel(pkt *network.Packet, depth int) ([]byte, int, error) {
+	tunnel := &pkt.Tunnel
+	link := tunnel.First == layers.LayerTypeEthernet
+	origLen := ipLength(tunnel.Inner)
+	shrink := 0
+	if link && !am.preserveLinkLayer && (tunnel.Inner.IsIPv4 || tunnel.Inner.IsIPv6) {
+		// The link layer header is rebuilt without its tags and labels
+		shrink = len(linkHeader(tunnel.Inner)) - 14
+	}
+	if err := am.anonymizePacket(tunnel.Inner, depth+1, link); err != nil {
+		return nil, 0, err
+	}
+	shrink += origLen - ipLength(tunnel.Inner)
+	inner := tunnel.Inner.OutBuf.Bytes()
+	out := make([]byte, len(tunnel.Header)+len(inner))
+	copy(out, tunnel.Header)
+	copy(out[len(tunnel.Header):], inner)
+	if am.checksums == ChecksumsRecompute {
+		shrink = 0
+	}
+
+	switch tunnel.Kind {
+	case network.TunnelGTPU:
+		// The message length does not count the mandatory header
+		if am.checksums == ChecksumsRecompute {
+			binary.BigEndian.PutUint16(out[2:], uint16(len(out)-8))
+		} else {
+			binary.BigEndian.PutUint16(out[2:], binary.BigEndian.Uint16(out[2:])-uint16(shrink))
+		}
+	case network.TunnelGRE:
+		// The optional checksum covers the GRE header and the carried packet
+		if out[0]&0x80 == 0 {
+			break
+		}
+		switch am.checksums {
+		case ChecksumsRecompute:
+			binary.BigEndian.PutUint16(out[4:], 0)
+			binary.BigEndian.PutUint16(out[4:], checksumFold(checksumAdd(0, out)))
+		case ChecksumsPreserveLength:
+			// The checksum still covers the rest of the original carried
+			// packet, after the rewritten one
+			orig := append(append([]byte(nil), tunnel.Header...), tunnel.Data...)
+			csum, ok := replacePrefixChecksum(binary.BigEndian.Uint16(out[4:]), orig, len(out)+shrink, out)
+			if !ok {
+				log.Debugf("Stripping carried packet longer than the original")
+				return append([]byte(nil), tunnel.Header...), 0, nil
+			}
+			binary.BigEndian.PutUint16(out[4:], csum)
+		}
+	}
+	return out, shrink, nil
+}
+
+// ipLength returns the length of the IP packet of pkt given by its header, 0
+// if it is not an IP packet.
+func ipLength(pkt *network.Packet) int {
+	if pkt.IsIPv4 {
+		return int(pkt.Ip4.Length)
+	} else if pkt.IsIPv6 {
+		return 40 + int(pkt.Ip6.Length)
+	}
+	return 0
+}
@@ -0,0 +1,176 @@
+package anonymization
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/wontoniii/traffic-anonymization/pkg/network"
+)
+
+// Payload of the packets carried by test tunnels, long enough for their
+// Ethernet frames not to be padded
+const testTunnelPayload = "secret tunnel payload"
+
+// serializeTestTunnel serializes a UDP packet from 10.0.0.1 to 10.0.0.2
+// carried by a VXLAN, GTP-U or GRE tunnel between public addresses. The
+// Ethernet frames carried by VXLAN and GRE have a VLAN tag.
+func serializeTestTunnel(t *testing.T, kind string) []byte {
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	serialize := func(l ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	innerIP := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")}
+	innerUDP := &layers.UDP{SrcPort: 40000, DstPort: 2000}
+	innerUDP.SetNetworkLayerForChecksum(innerIP)
+	inner := serialize(innerIP, innerUDP, gopacket.Payload(testTunnelPayload))
+	tagged := func() []byte {
+		innerEth := *eth
+		innerEth.EthernetType = layers.EthernetTypeDot1Q
+		return serialize(&innerEth, &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4}, gopacket.Payload(inner))
+	}
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("198.51.100.7")}
+	switch kind {
+	case network.TunnelGRE:
+		ip.Protocol = layers.IPProtocolGRE
+		gre := &layers.GRE{ChecksumPresent: true, Protocol: layers.EthernetTypeTransparentEthernetBridging}
+		return serialize(eth, ip, gre, gopacket.Payload(tagged()))
+	case network.TunnelVXLAN:
+		header := []byte{0x08, 0, 0, 0, 0, 0, 1, 0}
+		udp := &layers.UDP{SrcPort: 40000, DstPort: 4789}
+		udp.SetNetworkLayerForChecksum(ip)
+		return serialize(eth, ip, udp, gopacket.Payload(append(header, tagged()...)))
+	}
+	header := []byte{0x30, 0xff, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(inner)))
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 2152}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serialize(eth, ip, udp, gopacket.Payload(append(header, inner...)))
+}
+
+// TestTunnels tests that the packets carried by tunnels are anonymized with
+// the same rules as the outer packets, inside the rebuilt encapsulation, and
+// that the lengths and checksums of the tunnels describe the anonymized
+// packet under each checksum mode.
+func TestTunnels(t *testing.T) {
+	for _, checksums := range []string{ChecksumsKeep, ChecksumsRecompute, ChecksumsPreserveLength} {
+		am := NewAModule(AModuleConfiguration{
+			Key:         []byte("0123456789abcdef0123456789abcdef"),
+			Anonymize:   true,
+			PrivateNets: true,
+			Checksums:   checksums,
+		})
+		for _, kind := range []string{network.TunnelVXLAN, network.TunnelGTPU, network.TunnelGRE} {
+			name := checksums + " " + kind
+			data := serializeTestTunnel(t, kind)
+			orig := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			pkt := decodeTestPacket(t, append([]byte(nil), data...))
+			if pkt.Tunnel.Inner == nil {
+				t.Fatalf("%s: tunnel not decoded", name)
+			}
+			if err := am.Anonymize(pkt); err != nil {
+				t.Fatal(err)
+			}
+			outData := pkt.OutBuf.Bytes()
+			if bytes.Contains(outData, []byte(testTunnelPayload)) {
+				t.Errorf("%s: carried payload kept", name)
+			}
+			// Completed with the rest of the original packet when the lengths
+			// are not recomputed, the output is the anonymized packet with its
+			// payload, which must be consistent
+			full := outData
+			if checksums != ChecksumsRecompute {
+				if pkt.Ci.Length < len(outData) || pkt.Ci.Length-len(outData) > len(data) {
+					t.Fatalf("%s: %d bytes written, length %d", name, len(outData), pkt.Ci.Length)
+				}
+				full = append(append([]byte(nil), outData...), data[len(data)-(pkt.Ci.Length-len(outData)):]...)
+			}
+			out := gopacket.NewPacket(full, layers.LayerTypeEthernet, gopacket.Default)
+			if out.ErrorLayer() != nil {
+				t.Fatalf("%s: %v", name, out.ErrorLayer().Error())
+			}
+
+			var ips []*layers.IPv4
+			var udps []*layers.UDP
+			for _, l := range out.Layers() {
+				switch l := l.(type) {
+				case *layers.IPv4:
+					ips = append(ips, l)
+				case *layers.UDP:
+					udps = append(udps, l)
+				}
+			}
+			outerUDP := kind != network.TunnelGRE
+			if len(ips) != 2 || outerUDP && len(udps) != 2 || !outerUDP && len(udps) != 1 {
+				t.Fatalf("%s: %d IP and %d UDP layers", name, len(ips), len(udps))
+			}
+			// Public addresses are kept, private ones anonymized
+			if !ips[0].SrcIP.Equal(net.ParseIP("192.0.2.1")) || !ips[0].DstIP.Equal(net.ParseIP("198.51.100.7")) {
+				t.Errorf("%s: outer addresses %s > %s", name, ips[0].SrcIP, ips[0].DstIP)
+			}
+			if ips[1].SrcIP.Equal(net.ParseIP("10.0.0.1")) || ips[1].DstIP.Equal(net.ParseIP("10.0.0.2")) {
+				t.Errorf("%s: carried addresses not anonymized", name)
+			}
+			innerUDP := udps[len(udps)-1]
+			if innerUDP.DstPort != 2000 {
+				t.Errorf("%s: carried packet to port %d", name, innerUDP.DstPort)
+			}
+			if checksums != ChecksumsRecompute && string(innerUDP.Payload) != testTunnelPayload {
+				t.Errorf("%s: carried packet completed with %q", name, innerUDP.Payload)
+			}
+
+			// Lengths
+			if int(ips[0].Length) != len(full)-14 || int(ips[1].Length) != len(ips[1].Contents)+len(ips[1].Payload) {
+				t.Errorf("%s: IP lengths %d and %d for %d and %d bytes", name, ips[0].Length, ips[1].Length,
+					len(full)-14, len(ips[1].Contents)+len(ips[1].Payload))
+			}
+			if outerUDP && int(udps[0].Length) != len(udps[0].Contents)+len(udps[0].Payload) {
+				t.Errorf("%s: UDP length %d for %d bytes", name, udps[0].Length, len(udps[0].Contents)+len(udps[0].Payload))
+			}
+			if gtp, ok := out.Layer(layers.LayerTypeGTPv1U).(*layers.GTPv1U); ok && int(gtp.MessageLength) != len(gtp.Payload) {
+				t.Errorf("%s: GTP-U message length %d for %d bytes", name, gtp.MessageLength, len(gtp.Payload))
+			}
+
+			// Checksums
+			var csum, origCsum []byte
+			if outerUDP {
+				csum, origCsum = udps[0].Contents[6:8], orig.Layer(layers.LayerTypeUDP).LayerContents()[6:8]
+			} else {
+				csum, origCsum = out.Layer(layers.LayerTypeGRE).LayerContents()[4:6], orig.Layer(layers.LayerTypeGRE).LayerContents()[4:6]
+			}
+			if checksums == ChecksumsKeep {
+				if !bytes.Equal(csum, origCsum) {
+					t.Errorf("%s: checksum changed", name)
+				}
+				continue
+			}
+			for i, udp := range udps {
+				// GRE is not carried by UDP
+				ip := ips[len(ips)-len(udps)+i]
+				segment := append(append([]byte(nil), udp.Contents...), udp.Payload...)
+				if transportChecksum(ip.SrcIP.To4(), ip.DstIP.To4(), uint8(layers.IPProtocolUDP), segment) != 0 {
+					t.Errorf("%s: wrong UDP checksum at level %d", name, i)
+				}
+			}
+			if gre := out.Layer(layers.LayerTypeGRE); gre != nil && checksumFold(checksumAdd(checksumAdd(0, gre.LayerContents()), gre.LayerPayload())) != 0 {
+				t.Errorf("%s: wrong GRE checksum", name)
+			}
+		}
+	}
+}
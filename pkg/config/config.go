@@ -25,6 +25,56 @@ type InterfaceConfig struct {
 	Ifname string
 	// Filter
 	Filter string
+	// Whether to rotate output files when the key epoch changes instead of every hour
+	AlignEpochs bool
+}
+
+type NetAlgorithmConfig struct {
+	// Network the algorithm applies to
+	Net string
+	// Anonymization algorithm: cryptopan, cryptopan-msb, hmac, truncate, permutation or subnet
+	Algorithm string
+	// Number of low order IPv4 bits zeroed by truncate
+	TruncateBits int
+	// Number of low order IPv6 bits zeroed by truncate
+	TruncateBits6 int
+	// Fake prefix replacing the network prefix with subnet, empty to keep it
+	Prefix string
+}
+
+type PolicyRuleConfig struct {
+	// Network the rule applies to
+	Net string
+	// Transport protocol the rule applies to (tcp or udp), any if empty
+	Protocol string
+	// Ports the rule applies to, any if empty
+	Ports []int
+	// Action: pass, anonymize, truncate or drop
+	Action string
+	// Number of low order IPv4 bits zeroed by truncate
+	TruncateBits int
+	// Number of low order IPv6 bits zeroed by truncate
+	TruncateBits6 int
+}
+
+type PayloadRuleConfig struct {
+	// Transport protocol the rule applies to (tcp or udp), any if empty
+	Protocol string
+	// Ports the rule applies to, either as source or destination. Any if empty
+	Ports []int
+	// Application the rule applies to (dns, tls or quic), any if empty
+	Application string
+	// What to keep: headers, bytes, handshake or full
+	Mode string
+	// Number of payload bytes kept with bytes
+	Bytes int
+}
+
+type VLANMapConfig struct {
+	// Original VLAN ID
+	From int
+	// VLAN ID written in the output
+	To int
 }
 
 type MiscConfig struct {
@@ -33,6 +83,61 @@ type MiscConfig struct {
 	PrivateNets bool
 	LocalNets   []string
 	LogLevel    string
+	// Path of a file containing the anonymization key
+	KeyFile string
+	// Anonymization key encoded as hex or base64. Not marshalled to avoid
+	// leaking it in the logs
+	Key string `json:"-"`
+	// Name of the environment variable containing the anonymization key
+	KeyEnv string
+	// Whether to use the key as a master secret to derive a key per epoch
+	DeriveKeys bool
+	// Key rotation: never, hourly, daily, weekly or a number of hours (e.g. 6h)
+	Rotation string
+	// Time zone used for key rotation, local time zone if empty
+	Timezone string
+	// Archive where the key of every epoch is escrowed, escrow is disabled if empty
+	EscrowArchive string
+	// File containing the public key used to seal escrowed keys
+	EscrowPublicKey string
+	// Anonymization algorithm: cryptopan, cryptopan-msb, hmac, truncate or permutation
+	Algorithm string
+	// Number of low order IPv4 bits zeroed by truncate
+	TruncateBits int
+	// Number of low order IPv6 bits zeroed by truncate
+	TruncateBits6 int
+	// Algorithms used for specific networks
+	NetAlgorithms []NetAlgorithmConfig
+	// Whether to keep the prefix of local networks and only anonymize host bits
+	PreserveLocalNets bool
+	// Per network actions evaluated with longest prefix match
+	Policy []PolicyRuleConfig
+	// Payload retention rules, the first matching rule applies
+	Payload []PayloadRuleConfig
+	// Length and checksum handling: keep, recompute or preserve-length
+	Checksums string
+	// Whether to rewrite packets in place instead of serializing them again
+	InPlace bool
+	// Number of anonymized addresses to cache, 0 to disable the cache
+	CacheSize int
+	// Whether flows active at a rotation keep the key of the previous epoch
+	StickyFlows bool
+	// Idle time in seconds after which a flow is considered finished
+	FlowTimeout int
+	// MAC address handling: zero, keep, hash-oui or hash
+	MACs string
+	// Whether to keep the VLAN tags and MPLS labels of the original frames
+	PreserveLinkLayer bool
+	// VLAN IDs replaced in the preserved tags
+	VLANMap []VLANMapConfig
+	// Whether to reassemble fragmented IPv4 datagrams before anonymizing them
+	Reassemble bool
+	// Time in seconds after which incomplete datagrams are forgotten
+	FragmentTimeout int
+	// IPv6 extension headers handling: keep, strip-options or strip
+	IPv6Extensions string
+	// Server names of TLS ClientHello messages handling: hash, domain or keep
+	SNI string
 }
 
 type SysConfig struct {
@@ -69,9 +174,45 @@ func (conf *SysConfig) loadInterfacesConfig() {
 	conf.OutIf.ZeroCopy = viper.GetBool("OutInterface.ZeroCopy")
 	conf.OutIf.Ifname = viper.GetString("OutInterface.Ifname")
 	conf.OutIf.Filter = viper.GetString("OutInterface.Filter")
+	conf.OutIf.AlignEpochs = viper.GetBool("OutInterface.AlignEpochs")
 	conf.Misc.Anonymize = viper.GetBool("Misc.Anonymize")
 	conf.Misc.LoopTime = viper.GetInt("Misc.LoopTime")
 	conf.Misc.PrivateNets = viper.GetBool("Misc.PrivateNets")
 	conf.Misc.LocalNets = viper.GetStringSlice("Misc.LocalNets")
 	conf.Misc.LogLevel = viper.GetString("Misc.LogLevel")
+	conf.Misc.KeyFile = viper.GetString("Misc.KeyFile")
+	conf.Misc.Key = viper.GetString("Misc.Key")
+	conf.Misc.KeyEnv = viper.GetString("Misc.KeyEnv")
+	conf.Misc.DeriveKeys = viper.GetBool("Misc.DeriveKeys")
+	conf.Misc.Rotation = viper.GetString("Misc.Rotation")
+	conf.Misc.Timezone = viper.GetString("Misc.Timezone")
+	conf.Misc.EscrowArchive = viper.GetString("Misc.EscrowArchive")
+	conf.Misc.EscrowPublicKey = viper.GetString("Misc.EscrowPublicKey")
+	conf.Misc.Algorithm = viper.GetString("Misc.Algorithm")
+	conf.Misc.TruncateBits = viper.GetInt("Misc.TruncateBits")
+	conf.Misc.TruncateBits6 = viper.GetInt("Misc.TruncateBits6")
+	if err := viper.UnmarshalKey("Misc.NetAlgorithms", &conf.Misc.NetAlgorithms); err != nil {
+		panic(err)
+	}
+	conf.Misc.PreserveLocalNets = viper.GetBool("Misc.PreserveLocalNets")
+	if err := viper.UnmarshalKey("Misc.Policy", &conf.Misc.Policy); err != nil {
+		panic(err)
+	}
+	if err := viper.UnmarshalKey("Misc.Payload", &conf.Misc.Payload); err != nil {
+		panic(err)
+	}
+	conf.Misc.Checksums = viper.GetString("Misc.Checksums")
+	conf.Misc.InPlace = viper.GetBool("Misc.InPlace")
+	conf.Misc.CacheSize = viper.GetInt("Misc.CacheSize")
+	conf.Misc.StickyFlows = viper.GetBool("Misc.StickyFlows")
+	conf.Misc.FlowTimeout = viper.GetInt("Misc.FlowTimeout")
+	conf.Misc.MACs = viper.GetString("Misc.MACs")
+	conf.Misc.PreserveLinkLayer = viper.GetBool("Misc.PreserveLinkLayer")
+	if err := viper.UnmarshalKey("Misc.VLANMap", &conf.Misc.VLANMap); err != nil {
+		panic(err)
+	}
+	conf.Misc.Reassemble = viper.GetBool("Misc.Reassemble")
+	conf.Misc.FragmentTimeout = viper.GetInt("Misc.FragmentTimeout")
+	conf.Misc.IPv6Extensions = viper.GetString("Misc.IPv6Extensions")
+	conf.Misc.SNI = viper.GetString("Misc.SNI")
 }
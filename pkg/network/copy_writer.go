@@ -1,6 +1,7 @@
 package network
 
 import (
+	"fmt"
 	"os"
 	"strings"
 	"sync"
@@ -21,11 +22,20 @@ type CopyWriterHandle struct {
 	swapChans   []chan bool
 	wg          sync.WaitGroup
 	deadline    time.Time
+	// Whether files are rotated when the key epoch changes instead of every CYCLE_TIME
+	alignEpochs bool
+	// Key epoch of the file written by each receiver when aligned on epochs
+	epochIDs    [2]string
+	epochStarts [2]time.Time
+	// Index of the instance, as instances write files of the same epochs
+	instance int
 }
 
 type PacketCopyBuffer struct {
 	ci  gopacket.CaptureInfo
 	buf gopacket.SerializeBuffer
+	// Key epoch of the file started by a buffer without data
+	epochID string
 }
 
 func (h *CopyWriterHandle) Init(conf *HandleConfig) error {
@@ -43,6 +53,13 @@ func (h *CopyWriterHandle) Init(conf *HandleConfig) error {
 	h.bufferChans[1] = make(chan PacketCopyBuffer, 32768)
 	h.current = 0
 	h.deadline = time.Now().Add(CYCLE_TIME)
+	h.alignEpochs = conf.AlignEpochs
+	h.instance = conf.Instance
+	if h.alignEpochs {
+		go h.epochReceiver(0)
+		go h.epochReceiver(1)
+		return nil
+	}
 	go h.receiver(0, 0)
 	go h.receiver(1, CYCLE_TIME)
 	return nil
@@ -129,13 +146,77 @@ func (h *CopyWriterHandle) receiver(id, delay time.Duration) error {
 	}
 }
 
+// epochReceiver writes the packets handed to receiver id to a file per key
+// epoch, named after the instance and the epoch. A buffer without data starts
+// the file of the epoch it carries.
+func (h *CopyWriterHandle) epochReceiver(id int) {
+	defer h.wg.Done()
+	pkt := Packet{}
+	name := ""
+	var fh *FileHandle
+	closeFile := func() {
+		if fh == nil {
+			return
+		}
+		fh.Close()
+		if err := os.Rename(name, name+".pcap"); err != nil {
+			log.Panic("Error renaming file:", err)
+		}
+		fh = nil
+	}
+	write := func(copiedData PacketCopyBuffer) {
+		if copiedData.buf == nil {
+			closeFile()
+			name = fmt.Sprintf("%s_%d_%s", h.basename, h.instance, epochFileName(copiedData.epochID))
+			log.Infof("Moving %d to file %s", id, name)
+			fh = &FileHandle{}
+			fh.Init(&HandleConfig{W: true, Name: name})
+			return
+		}
+		pkt.Ci = copiedData.ci
+		pkt.OutBuf = copiedData.buf
+		fh.WritePacketData(&pkt)
+	}
+	for {
+		select {
+		case <-h.stopChans[id]:
+			for {
+				select {
+				case copiedData := <-h.bufferChans[id]:
+					write(copiedData)
+				default:
+					closeFile()
+					return
+				}
+			}
+		case copiedData := <-h.bufferChans[id]:
+			write(copiedData)
+		}
+	}
+}
+
+// epochFileName returns the part of a file name identifying a key epoch. Epoch
+// identifiers come from key files, so characters that could leave the
+// directory of the output or be misread by tools are replaced.
+func epochFileName(epochID string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			r == '-' || r == '_' || r == ':' || r == '.' {
+			return r
+		}
+		return '_'
+	}, epochID)
+}
+
 func (h *CopyWriterHandle) WritePacketData(pkt *Packet) error {
 	log.Debugf("Preparing to pass the packet to the other thread")
+	if h.alignEpochs {
+		return h.writeEpochPacket(pkt)
+	}
 	now := time.Now()
 	if now.After(h.deadline) {
 		log.Infof("Deadline is passed, moving from %d", h.current)
-		h.swapChans[h.current] <- true
-		h.current = (h.current + 1) % 2
+		h.swap()
 		h.deadline = now.Add(CYCLE_TIME)
 	}
 	// Write packet to file
@@ -147,6 +228,47 @@ func (h *CopyWriterHandle) WritePacketData(pkt *Packet) error {
 	return nil
 }
 
+// writeEpochPacket hands a packet to the receiver writing the file of its key
+// epoch. When a new epoch starts, the receiver of the previous file moves to a
+// file for it, while the late packets of flows kept in the epoch before are
+// still written to its file. Packets of older epochs are dropped, so that every
+// file only contains packets anonymized with the key of its epoch.
+func (h *CopyWriterHandle) writeEpochPacket(pkt *Packet) error {
+	id := h.current
+	switch pkt.EpochID {
+	case h.epochIDs[h.current]:
+	case h.epochIDs[1-h.current]:
+		id = 1 - h.current
+	default:
+		if h.epochIDs[h.current] != "" {
+			// Epoch identifiers may be arbitrary, epochs are ordered by start
+			if !pkt.EpochStart.After(h.epochStarts[h.current]) {
+				log.Debugf("Dropping packet of past key epoch %s", pkt.EpochID)
+				return nil
+			}
+			id = 1 - h.current
+			log.Infof("Key epoch changed to %s, moving from %d", pkt.EpochID, h.current)
+		}
+		// Buffers are written in order, so the previous file of the receiver
+		// only holds packets of its epoch
+		h.bufferChans[id] <- PacketCopyBuffer{epochID: pkt.EpochID}
+		h.epochIDs[id] = pkt.EpochID
+		h.epochStarts[id] = pkt.EpochStart
+		h.current = id
+	}
+	h.bufferChans[id] <- PacketCopyBuffer{
+		ci:  pkt.Ci,
+		buf: pkt.OutBuf,
+	}
+	return nil
+}
+
+// swap hands the current file over to the receiver writing the next one
+func (h *CopyWriterHandle) swap() {
+	h.swapChans[h.current] <- true
+	h.current = (h.current + 1) % 2
+}
+
 func (h *CopyWriterHandle) Stats() IfStats {
 	return IfStats{
 		PktRecv: 0,
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestAlignEpochs tests that files aligned on key epochs only contain the
+// packets of their epoch, late packets of the previous epoch included, and
+// that instances and epoch identifiers cannot clash with other files.
+func TestAlignEpochs(t *testing.T) {
+	dir := t.TempDir()
+	basename := filepath.Join(dir, "out")
+	h := &CopyWriterHandle{}
+	h.Init(&HandleConfig{Name: basename + ".pcap", AlignEpochs: true, Instance: 1})
+	// Another instance writing the same epoch
+	other := &CopyWriterHandle{}
+	other.Init(&HandleConfig{Name: basename + ".pcap", AlignEpochs: true})
+	buf := gopacket.NewSerializeBuffer()
+	buf.AppendBytes(60)
+	other.WritePacketData(&Packet{OutBuf: buf, EpochID: "c", Ci: gopacket.CaptureInfo{Length: 60}})
+	other.Close()
+	other.wg.Wait()
+
+	// Epoch identifiers that do not sort chronologically, one trying to
+	// leave the directory
+	epochIDs := []string{"c", "b", "../a"}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, epoch := range []int{0, 1, 0, 2, 1, 0} {
+		buf := gopacket.NewSerializeBuffer()
+		data, _ := buf.AppendBytes(60)
+		data[0] = byte(i)
+		h.WritePacketData(&Packet{OutBuf: buf, EpochID: epochIDs[epoch], EpochStart: start.Add(time.Duration(epoch) * time.Hour),
+			Ci: gopacket.CaptureInfo{Length: 60}})
+	}
+	h.Close()
+	h.wg.Wait()
+
+	// The last packet is from an epoch whose file is closed
+	for name, expected := range map[string][]byte{
+		"out_1_c":    {0, 2},
+		"out_1_b":    {1, 4},
+		"out_1_.._a": {3},
+		"out_0_c":    {0},
+	} {
+		f, err := os.Open(filepath.Join(dir, name+".pcap"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		for {
+			data, _, err := r.ReadPacketData()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, data[0])
+		}
+		if string(got) != string(expected) {
+			t.Errorf("File %s: packets %v instead of %v", name, got, expected)
+		}
+	}
+}
@@ -11,6 +11,10 @@ type HandleConfig struct {
 	ZeroCopy  bool
 	FanOut    bool
 	W         bool
+	// Whether to rotate output files when the key epoch changes
+	AlignEpochs bool
+	// Index of the instance writing to the interface, to tell its files apart
+	Instance int
 }
 
 type Handle interface {
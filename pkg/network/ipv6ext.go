@@ -0,0 +1,125 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// IPv6ExtensionHeader is a header of a chain of IPv6 extension headers
+type IPv6ExtensionHeader struct {
+	Type layers.IPProtocol
+	// Whole header, starting with the next header field
+	Data []byte
+}
+
+// IsIPv6Extension tells whether a protocol is one of the extension headers
+// walked by ParseIPv6Extensions.
+func IsIPv6Extension(protocol layers.IPProtocol) bool {
+	switch protocol {
+	case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination, layers.IPProtocolIPv6Fragment:
+		return true
+	}
+	return false
+}
+
+// ParseIPv6Extensions parses the chain of extension headers at the beginning
+// of data, the first one being of type first, and appends them to headers. The
+// chain ends at the upper layer protocol, which is returned, or after a
+// fragment header, in which case the protocol of the fragmented datagram is
+// returned.
+func ParseIPv6Extensions(first layers.IPProtocol, data []byte, headers []IPv6ExtensionHeader) ([]IPv6ExtensionHeader, layers.IPProtocol, error) {
+	next := first
+	for IsIPv6Extension(next) {
+		length := 8
+		if next != layers.IPProtocolIPv6Fragment {
+			if len(data) < 2 {
+				return headers, next, errors.New("IPv6 extension header truncated")
+			}
+			length = (int(data[1]) + 1) * 8
+		}
+		if len(data) < length {
+			return headers, next, errors.New("IPv6 extension header truncated")
+		}
+		headers = append(headers, IPv6ExtensionHeader{Type: next, Data: data[:length]})
+		if next == layers.IPProtocolIPv6Fragment {
+			return headers, layers.IPProtocol(data[0]), nil
+		}
+		next = layers.IPProtocol(data[0])
+		data = data[length:]
+	}
+	return headers, next, nil
+}
+
+// IPv6Extensions decodes the chain of extension headers of an IPv6 packet with
+// a DecodingLayerParser. The hop-by-hop options header is decoded by gopacket
+// with the IPv6 header, so the chain starts after it.
+type IPv6Extensions struct {
+	layers.BaseLayer
+	// Extension headers, in order
+	Headers []IPv6ExtensionHeader
+	// Protocol following the chain, or of the fragmented datagram
+	NextHeader layers.IPProtocol
+	// IPv6 header followed by the chain, decoded before it
+	ip6 *layers.IPv6
+}
+
+// NewIPv6Extensions creates the decoder of the extension headers following
+// the IPv6 header ip6.
+func NewIPv6Extensions(ip6 *layers.IPv6) *IPv6Extensions {
+	return &IPv6Extensions{ip6: ip6}
+}
+
+func (e *IPv6Extensions) LayerType() gopacket.LayerType {
+	if len(e.Headers) > 0 {
+		return e.Headers[0].Type.LayerType()
+	}
+	return layers.LayerTypeIPv6Routing
+}
+
+func (e *IPv6Extensions) CanDecode() gopacket.LayerClass {
+	return gopacket.NewLayerClass([]gopacket.LayerType{
+		layers.LayerTypeIPv6Routing,
+		layers.LayerTypeIPv6Destination,
+		layers.LayerTypeIPv6Fragment,
+	})
+}
+
+func (e *IPv6Extensions) NextLayerType() gopacket.LayerType {
+	if _, _, _, ok := e.Fragment(); ok {
+		return gopacket.LayerTypeFragment
+	}
+	return e.NextHeader.LayerType()
+}
+
+func (e *IPv6Extensions) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	first := e.ip6.NextHeader
+	if e.ip6.HopByHop != nil {
+		first = e.ip6.HopByHop.NextHeader
+	}
+	var err error
+	e.Headers, e.NextHeader, err = ParseIPv6Extensions(first, data, e.Headers[:0])
+	if err != nil {
+		df.SetTruncated()
+		return err
+	}
+	length := 0
+	for _, h := range e.Headers {
+		length += len(h.Data)
+	}
+	e.BaseLayer = layers.BaseLayer{Contents: data[:length], Payload: data[length:]}
+	return nil
+}
+
+// Fragment returns the fragment offset in bytes, the more fragments flag and
+// the identification of the fragment header ending the chain, if any.
+func (e *IPv6Extensions) Fragment() (offset int, more bool, id uint32, ok bool) {
+	if len(e.Headers) == 0 || e.Headers[len(e.Headers)-1].Type != layers.IPProtocolIPv6Fragment {
+		return 0, false, 0, false
+	}
+	data := e.Headers[len(e.Headers)-1].Data
+	field := binary.BigEndian.Uint16(data[2:])
+	return int(field &^ 0x7), field&0x1 != 0, binary.BigEndian.Uint32(data[4:]), true
+}
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// MPLSStack decodes a whole stack of MPLS labels with a DecodingLayerParser.
+// The payload is guessed to be IPv4 or IPv6 from its first byte.
+type MPLSStack struct {
+	layers.BaseLayer
+	// Label stack entries, top of the stack first
+	Labels []layers.MPLS
+}
+
+func (m *MPLSStack) LayerType() gopacket.LayerType {
+	return layers.LayerTypeMPLS
+}
+
+func (m *MPLSStack) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeMPLS
+}
+
+func (m *MPLSStack) NextLayerType() gopacket.LayerType {
+	if len(m.Payload) == 0 {
+		return gopacket.LayerTypeZero
+	}
+	switch m.Payload[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypePayload
+}
+
+func (m *MPLSStack) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	m.Labels = m.Labels[:0]
+	for off := 0; ; off += 4 {
+		if len(data) < off+4 {
+			df.SetTruncated()
+			return errors.New("MPLS label stack truncated")
+		}
+		entry := uint32(data[off])<<24 | uint32(data[off+1])<<16 | uint32(data[off+2])<<8 | uint32(data[off+3])
+		label := layers.MPLS{
+			Label:        entry >> 12,
+			TrafficClass: uint8(entry>>9) & 0x7,
+			StackBottom:  entry&0x100 != 0,
+			TTL:          uint8(entry),
+		}
+		m.Labels = append(m.Labels, label)
+		if label.StackBottom {
+			m.BaseLayer = layers.BaseLayer{Contents: data[:off+4], Payload: data[off+4:]}
+			return nil
+		}
+	}
+}
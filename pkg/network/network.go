@@ -41,6 +41,10 @@ type NetworkInterfaceConfiguration struct {
 	ClusterID int
 	ZeroCopy  bool
 	FanOut    bool
+	// Whether to rotate output files when the key epoch changes
+	AlignEpochs bool
+	// Index of the instance writing to the interface, to tell its files apart
+	Instance int
 }
 
 // NetworkInterface is a structure that carries information on the interface it maps to
@@ -98,6 +102,9 @@ func (ni *NetworkInterface) NewNetworkInterface(conf NetworkInterfaceConfigurati
 		ClusterID: conf.ClusterID,
 		ZeroCopy:  conf.ZeroCopy,
 		FanOut:    conf.FanOut,
+
+		AlignEpochs: conf.AlignEpochs,
+		Instance:    conf.Instance,
 	}
 
 	// Initiate the interface based on type
@@ -1,18 +1,37 @@
 package network
 
 import (
+	"time"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// Fragment is the fragment of a datagram carried by a packet
+type Fragment struct {
+	// Offset of the data in the datagram, in bytes
+	Offset int
+	// Whether more fragments follow
+	More bool
+	// Identification of the datagram
+	ID uint32
+	// Protocol of the payload of the datagram
+	Protocol layers.IPProtocol
+	// Data of the fragment
+	Data []byte
+}
+
 type Packet struct {
 	RawData []byte
 	Ci      gopacket.CaptureInfo
 	Eth     *layers.Ethernet
 	Ip4     *layers.IPv4
 	Ip6     *layers.IPv6
+	Ip6Ext  *IPv6Extensions
 	Tcp     *layers.TCP
 	Udp     *layers.UDP
+	Icmp4   *layers.ICMPv4
+	Icmp6   *layers.ICMPv6
 	Dns     *layers.DNS
 	TLS     *layers.TLS
 	Payload *gopacket.Payload
@@ -23,11 +42,19 @@ type Packet struct {
 	DstIP   string
 	IsTCP   bool
 	IsUDP   bool
+	IsICMP4 bool
+	IsICMP6 bool
+	IsFrag  bool
+	Frag    Fragment
+	Tunnel  Tunnel
 	SrcPort uint16
 	DstPort uint16
 	IsDNS   bool
 	IsTLS   bool
-	OutBuf  gopacket.SerializeBuffer
+	EpochID string
+	// Start of the key epoch, which orders epochs
+	EpochStart time.Time
+	OutBuf     gopacket.SerializeBuffer
 }
 
 func NewPacket() *Packet {
@@ -35,8 +62,11 @@ func NewPacket() *Packet {
 	packet.Eth = new(layers.Ethernet)
 	packet.Ip4 = new(layers.IPv4)
 	packet.Ip6 = new(layers.IPv6)
+	packet.Ip6Ext = NewIPv6Extensions(packet.Ip6)
 	packet.Tcp = new(layers.TCP)
 	packet.Udp = new(layers.UDP)
+	packet.Icmp4 = new(layers.ICMPv4)
+	packet.Icmp6 = new(layers.ICMPv6)
 	packet.Dns = new(layers.DNS)
 	packet.TLS = new(layers.TLS)
 	packet.Payload = new(gopacket.Payload)
@@ -52,10 +82,17 @@ func (packet *Packet) Clear() {
 	packet.DstIP = ""
 	packet.IsTCP = false
 	packet.IsUDP = false
+	packet.IsICMP4 = false
+	packet.IsICMP6 = false
+	packet.IsFrag = false
+	packet.Frag = Fragment{}
+	packet.Tunnel = Tunnel{}
 	packet.SrcPort = 0
 	packet.DstPort = 0
 	packet.IsDNS = false
 	packet.IsTLS = false
+	packet.EpochID = ""
+	packet.EpochStart = time.Time{}
 }
 
 func (packet *Packet) ClearBool() {
@@ -63,6 +100,8 @@ func (packet *Packet) ClearBool() {
 	packet.IsIPv6 = false
 	packet.IsTCP = false
 	packet.IsUDP = false
+	packet.IsICMP4 = false
+	packet.IsICMP6 = false
 	packet.IsDNS = false
 	packet.IsTLS = false
 }
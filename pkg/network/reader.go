@@ -12,6 +12,10 @@ import (
 type Reader struct {
 	netif           *NetworkInterface
 	packetProcessor PacketProcessor
+	// Reassembler of fragmented datagrams, nil to process fragments on their own
+	reassembler *Reassembler
+	// Decoders of the packets carried by tunnels, per nesting level
+	tunnels []*tunnelDecoder
 }
 
 func NewReader(netif *NetworkInterface, packetProcessor PacketProcessor) *Reader {
@@ -21,6 +25,12 @@ func NewReader(netif *NetworkInterface, packetProcessor PacketProcessor) *Reader
 	return r
 }
 
+// SetReassembler makes the reader reassemble fragmented IPv4 datagrams before
+// processing them. The reassembler can be shared between readers.
+func (tp *Reader) SetReassembler(reassembler *Reassembler) {
+	tp.reassembler = reassembler
+}
+
 func (tp *Reader) parseUdpLayer(udp *layers.UDP) (uint16, uint16, error) {
 	srcPort := udp.SrcPort
 	dstPort := udp.DstPort
@@ -56,13 +66,131 @@ func isDNS(srcPort, dstPort uint16) bool {
 	return false
 }
 
+// parseFirstFragment decodes the transport header at the beginning of the
+// first fragment of a datagram, if it is complete.
+func (tp *Reader) parseFirstFragment(pkt *Packet) (err error) {
+	switch pkt.Frag.Protocol {
+	case layers.IPProtocolTCP:
+		if pkt.Tcp.DecodeFromBytes(pkt.Frag.Data, gopacket.NilDecodeFeedback) == nil {
+			pkt.SrcPort, pkt.DstPort, err = tp.parseTcpLayer(pkt.Tcp)
+			pkt.IsTCP = true
+		}
+	case layers.IPProtocolUDP:
+		if pkt.Udp.DecodeFromBytes(pkt.Frag.Data, gopacket.NilDecodeFeedback) == nil {
+			pkt.SrcPort, pkt.DstPort, err = tp.parseUdpLayer(pkt.Udp)
+			pkt.IsUDP = true
+			pkt.IsDNS = isDNS(pkt.SrcPort, pkt.DstPort)
+		}
+	}
+	return err
+}
+
+// decodeTunnel decodes the packet carried by the tunnel of pkt, if any, pkt
+// being at nesting level depth. Carried packets that can not be processed are
+// left as payload.
+func (tp *Reader) decodeTunnel(pkt *Packet, depth int) {
+	if depth >= maxTunnelDepth {
+		return
+	}
+	tunnel, ok := ParseTunnel(pkt)
+	if !ok {
+		return
+	}
+	for len(tp.tunnels) <= depth {
+		tp.tunnels = append(tp.tunnels, newTunnelDecoder())
+	}
+	d := tp.tunnels[depth]
+	d.pkt.Clear()
+	d.pkt.TStamp = pkt.TStamp
+	d.pkt.Ci = gopacket.CaptureInfo{Timestamp: pkt.Ci.Timestamp, CaptureLength: len(tunnel.Data), Length: len(tunnel.Data)}
+	d.pkt.RawData = tunnel.Data
+	if err := d.parsers[tunnel.First].DecodeLayers(tunnel.Data, &d.decoded); err != nil {
+		log.Debugln(err)
+	}
+	if isValid, err := tp.classify(d.pkt, d.decoded, depth+1); !isValid || err != nil {
+		return
+	}
+	tunnel.Inner = d.pkt
+	pkt.Tunnel = tunnel
+}
+
+// classify sets the fields of the packet from its decoded layers, and decodes
+// the packet carried by its tunnel, the packet being at nesting level depth. It
+// returns whether the packet has the layers required to be processed.
+func (tp *Reader) classify(pkt *Packet, decoded []gopacket.LayerType, depth int) (isValid bool, parsingErr error) {
+	for _, typ := range decoded {
+		switch typ {
+		case layers.LayerTypeEthernet:
+
+		case layers.LayerTypeIPv4:
+			pkt.SrcIP, pkt.DstIP, parsingErr = tp.parseIpV4Layer(pkt.Ip4)
+			pkt.IsIPv4 = true
+			if IsFragment(pkt.Ip4) {
+				// Fragments carry no transport header, except for the first one
+				pkt.IsFrag = true
+				pkt.Frag = Fragment{
+					Offset:   int(pkt.Ip4.FragOffset) * 8,
+					More:     pkt.Ip4.Flags&layers.IPv4MoreFragments != 0,
+					ID:       uint32(pkt.Ip4.Id),
+					Protocol: pkt.Ip4.Protocol,
+					Data:     pkt.Ip4.Payload,
+				}
+				isValid = true
+				if pkt.Frag.Offset == 0 {
+					parsingErr = tp.parseFirstFragment(pkt)
+				}
+			}
+		case layers.LayerTypeIPv6:
+			pkt.SrcIP, pkt.DstIP, parsingErr = tp.parseIpV6Layer(pkt.Ip6)
+			pkt.IsIPv6 = true
+		case layers.LayerTypeIPv6Routing, layers.LayerTypeIPv6Destination, layers.LayerTypeIPv6Fragment:
+			if offset, more, id, ok := pkt.Ip6Ext.Fragment(); ok {
+				pkt.IsFrag = true
+				pkt.Frag = Fragment{
+					Offset:   offset,
+					More:     more,
+					ID:       id,
+					Protocol: pkt.Ip6Ext.NextHeader,
+					Data:     pkt.Ip6Ext.Payload,
+				}
+				isValid = true
+				if offset == 0 {
+					parsingErr = tp.parseFirstFragment(pkt)
+				}
+			}
+		case layers.LayerTypeTCP:
+			pkt.SrcPort, pkt.DstPort, parsingErr = tp.parseTcpLayer(pkt.Tcp)
+			pkt.IsTCP = true
+			isValid = true
+		case layers.LayerTypeUDP:
+			pkt.SrcPort, pkt.DstPort, parsingErr = tp.parseUdpLayer(pkt.Udp)
+			pkt.IsUDP = true
+			isValid = true
+			pkt.IsDNS = isDNS(pkt.SrcPort, pkt.DstPort)
+		case layers.LayerTypeICMPv4:
+			pkt.IsICMP4 = true
+			isValid = true
+		case layers.LayerTypeICMPv6:
+			pkt.IsICMP6 = true
+			isValid = true
+		case layers.LayerTypeTLS:
+			pkt.IsTLS = true
+		}
+	}
+	if parsingErr == nil {
+		tp.decodeTunnel(pkt, depth)
+		if pkt.Tunnel.Inner != nil {
+			isValid = true
+		}
+	}
+	return isValid, parsingErr
+}
+
 // TrafficParser is the worker function for parsing network traffic. Each worker reads directly from the ring that is passed
 // The waitgroup is used to cleanly shut down. Each worker listen on the stop chan to know when to stop processing
 func (tp *Reader) Parse(wg *sync.WaitGroup, stop chan struct{}) {
 	// We use decodinglayerparser, so we set up variables for the layers we intend to parse
 	pkt := NewPacket()
-	var vlantag *layers.Dot1Q
-	vlantag = new(layers.Dot1Q)
 
 	// We use Flows to access the network and transport endpoints when building the 4-tuple flow
 	// var netFlow, tranFlow gopacket.Flow
@@ -70,7 +198,7 @@ func (tp *Reader) Parse(wg *sync.WaitGroup, stop chan struct{}) {
 	var isValid bool
 	var parsingErr error
 
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, pkt.Eth, vlantag, pkt.Ip4, pkt.Ip6, pkt.Tcp, pkt.Udp, pkt.Payload)
+	parser := newParser(layers.LayerTypeEthernet, pkt)
 	decoded := []gopacket.LayerType{}
 	if wg != nil {
 		defer wg.Done()
@@ -106,27 +234,30 @@ loop:
 				log.Debugln(err)
 			}
 
-			for _, typ := range decoded {
-				switch typ {
-				case layers.LayerTypeEthernet:
-
-				case layers.LayerTypeIPv4:
-					pkt.SrcIP, pkt.DstIP, parsingErr = tp.parseIpV4Layer(pkt.Ip4)
-					pkt.IsIPv4 = true
-				case layers.LayerTypeIPv6:
-					pkt.SrcIP, pkt.DstIP, parsingErr = tp.parseIpV6Layer(pkt.Ip6)
-					pkt.IsIPv6 = true
-				case layers.LayerTypeTCP:
-					pkt.SrcPort, pkt.DstPort, parsingErr = tp.parseTcpLayer(pkt.Tcp)
-					pkt.IsTCP = true
-					isValid = true
-				case layers.LayerTypeUDP:
-					pkt.SrcPort, pkt.DstPort, parsingErr = tp.parseUdpLayer(pkt.Udp)
-					pkt.IsUDP = true
-					isValid = true
-					pkt.IsDNS = isDNS(pkt.SrcPort, pkt.DstPort)
-				case layers.LayerTypeTLS:
-					pkt.IsTLS = true
+			isValid, parsingErr = tp.classify(pkt, decoded, 0)
+			if isValid && pkt.IsFrag && pkt.IsIPv4 && tp.reassembler != nil {
+				ipOff := cap(data) - cap(pkt.Ip4.Contents)
+				datagram, flushed, buffered := tp.reassembler.Add(pkt.Ip4, data, ci)
+				// Fragments of datagrams that are not reassembled
+				for _, frame := range flushed {
+					tp.processFrame(parser, &decoded, pkt, frame)
+				}
+				if datagram == nil && buffered {
+					// Processed once the datagram is complete
+					continue
+				}
+				if datagram != nil {
+					// The reassembled datagram replaces the last fragment,
+					// behind the same link layer header
+					whole := make([]byte, ipOff+len(datagram))
+					copy(whole, data[:ipOff])
+					copy(whole[ipOff:], datagram)
+					data = whole
+					ci.CaptureLength = len(data)
+					ci.Length = len(data)
+				}
+				if datagram != nil || len(flushed) > 0 {
+					isValid, parsingErr = tp.decode(parser, &decoded, pkt, data, ci)
 				}
 			}
 
@@ -143,3 +274,29 @@ loop:
 		}
 	}
 }
+
+// decode decodes a frame read with ci into pkt and classifies it.
+func (tp *Reader) decode(parser *gopacket.DecodingLayerParser, decoded *[]gopacket.LayerType, pkt *Packet,
+	data []byte, ci gopacket.CaptureInfo) (bool, error) {
+	pkt.Clear()
+	pkt.TStamp = ci.Timestamp.UnixNano()
+	pkt.Ci = ci
+	pkt.RawData = data
+	if err := parser.DecodeLayers(data, decoded); err != nil {
+		log.Debugln(err)
+	}
+	return tp.classify(pkt, *decoded, 0)
+}
+
+// processFrame processes a frame read earlier, such as a fragment of a datagram
+// that is not reassembled.
+func (tp *Reader) processFrame(parser *gopacket.DecodingLayerParser, decoded *[]gopacket.LayerType, pkt *Packet, frame Frame) {
+	isValid, parsingErr := tp.decode(parser, decoded, pkt, frame.Data, frame.Ci)
+	if parsingErr != nil {
+		log.Warnln(parsingErr)
+		return
+	}
+	if isValid {
+		tp.packetProcessor.ProcessPacket(pkt)
+	}
+}
@@ -0,0 +1,270 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Time after which incomplete datagrams are given up if not configured
+	DefaultFragmentTimeout = 30 * time.Second
+	// Maximum number of datagrams being reassembled
+	maxDatagrams = 4096
+	// Maximum number of fragments of a datagram
+	maxFragments = 64
+	// Maximum number of bytes buffered for all the datagrams, as overlapping
+	// fragments may buffer much more than the size of their datagrams
+	maxBufferedBytes = 32 << 20
+	// Maximum size of the payload of an IPv4 datagram
+	maxDatagramSize = 65535 - 20
+)
+
+// IsFragment tells whether an IPv4 packet is a fragment of a larger datagram.
+func IsFragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// datagramKey identifies the fragments of a datagram (RFC 791)
+type datagramKey struct {
+	src      [net.IPv6len]byte
+	dst      [net.IPv6len]byte
+	protocol uint8
+	id       uint16
+}
+
+// Frame is a frame read by a reader, with its capture information.
+type Frame struct {
+	Data []byte
+	Ci   gopacket.CaptureInfo
+}
+
+type fragment struct {
+	offset int
+	// Payload of the fragment, within its frame
+	data []byte
+}
+
+// datagram holds the fragments received for a datagram
+type datagram struct {
+	// Header of the first fragment, nil until it is received
+	header    []byte
+	fragments []fragment
+	// Frames of the fragments in the order they were read, processed on
+	// their own if the datagram is not reassembled
+	frames []Frame
+	// Size of the payload, known once the last fragment is received
+	size int
+	// Number of bytes buffered for the datagram
+	bytes     int
+	firstSeen time.Time
+	// Whether the datagram exceeded the limits, its fragments being then
+	// processed on their own until it expires
+	overflowed bool
+}
+
+// ReassemblyStats counts the datagrams of a reassembler.
+type ReassemblyStats struct {
+	// Datagrams reassembled
+	Reassembled uint64
+	// Datagrams still incomplete after the timeout
+	Expired uint64
+	// Datagrams that exceeded the limits of the reassembler. While too many
+	// datagrams are buffered, every fragment of a new datagram counts
+	Overflowed uint64
+	// Fragments processed on their own, as their datagram expired or
+	// exceeded the limits
+	Fragments uint64
+}
+
+// Reassembler reassembles IPv4 datagrams from their fragments. It can be
+// shared by the readers of all threads, as the fragments of a datagram may be
+// read by different threads. A datagram is either reassembled, or all its
+// fragments are processed on their own.
+type Reassembler struct {
+	mu         sync.Mutex
+	timeout    time.Duration
+	lastExpiry time.Time
+	datagrams  map[datagramKey]*datagram
+	// Number of bytes buffered for all the datagrams
+	bytes int
+	stats ReassemblyStats
+}
+
+// NewReassembler creates a reassembler giving up on the datagrams still
+// incomplete after timeout.
+func NewReassembler(timeout time.Duration) *Reassembler {
+	if timeout <= 0 {
+		timeout = DefaultFragmentTimeout
+	}
+	return &Reassembler{
+		timeout:   timeout,
+		datagrams: make(map[datagramKey]*datagram),
+	}
+}
+
+// Add adds the fragment ip, decoded from frame, read with ci. Once the datagram
+// is complete it returns the whole datagram, the header of the first fragment
+// followed by the payload. It also returns the frames of the buffered
+// fragments that must now be processed on their own, in the order they were
+// read: those of the datagrams that expired, and those of the datagram of ip
+// if it exceeds the limits. It returns false if the fragment was not buffered,
+// because its datagram has too many fragments or buffered bytes, there are too
+// many datagrams or the offset is invalid, in which case it must be handled on
+// its own after the returned frames.
+func (r *Reassembler) Add(ip *layers.IPv4, frame []byte, ci gopacket.CaptureInfo) ([]byte, []Frame, bool) {
+	offset := int(ip.FragOffset) * 8
+	var key datagramKey
+	copy(key.src[:], ip.SrcIP.To16())
+	copy(key.dst[:], ip.DstIP.To16())
+	key.protocol = uint8(ip.Protocol)
+	key.id = ip.Id
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var flushed []Frame
+	if ci.Timestamp.Sub(r.lastExpiry) > r.timeout {
+		flushed = r.expire(ci.Timestamp)
+		r.lastExpiry = ci.Timestamp
+	}
+	d, ok := r.datagrams[key]
+	if !ok {
+		if len(r.datagrams) >= maxDatagrams {
+			r.stats.Overflowed++
+			r.stats.Fragments++
+			return nil, flushed, false
+		}
+		d = &datagram{firstSeen: ci.Timestamp}
+		r.datagrams[key] = d
+	}
+	if d.overflowed {
+		r.stats.Fragments++
+		return nil, flushed, false
+	}
+	if offset+len(ip.Payload) > maxDatagramSize || r.bytes+len(frame) > maxBufferedBytes ||
+		len(d.fragments) >= maxFragments {
+		// The datagram is kept until it expires, so that its later
+		// fragments are not buffered either
+		r.stats.Overflowed++
+		r.stats.Fragments++
+		return nil, append(flushed, r.flush(d)...), false
+	}
+
+	// The frame is copied, as the reader reuses its buffers
+	data := append([]byte(nil), frame...)
+	d.frames = append(d.frames, Frame{Data: data, Ci: ci})
+	start := cap(frame) - cap(ip.Payload)
+	d.fragments = append(d.fragments, fragment{offset: offset, data: data[start : start+len(ip.Payload)]})
+	if offset == 0 {
+		start = cap(frame) - cap(ip.Contents)
+		d.header = data[start : start+len(ip.Contents)]
+	}
+	d.bytes += len(frame)
+	r.bytes += len(frame)
+	if ip.Flags&layers.IPv4MoreFragments == 0 {
+		d.size = offset + len(ip.Payload)
+	}
+	if d.header == nil || d.size == 0 || !d.complete() {
+		return nil, flushed, true
+	}
+	r.remove(key, d)
+	r.stats.Reassembled++
+	return d.build(), flushed, true
+}
+
+// Stats returns the counters of the reassembler.
+func (r *Reassembler) Stats() ReassemblyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// flush releases the fragments buffered for a datagram and returns their
+// frames in the order they were read. The datagram is marked as overflowed.
+func (r *Reassembler) flush(d *datagram) []Frame {
+	frames := d.frames
+	r.stats.Fragments += uint64(len(frames))
+	r.bytes -= d.bytes
+	d.bytes = 0
+	d.fragments = nil
+	d.frames = nil
+	d.header = nil
+	d.overflowed = true
+	return frames
+}
+
+// remove removes a datagram and releases its buffered bytes.
+func (r *Reassembler) remove(key datagramKey, d *datagram) {
+	delete(r.datagrams, key)
+	r.bytes -= d.bytes
+}
+
+// complete tells whether the fragments cover the whole payload.
+func (d *datagram) complete() bool {
+	sort.SliceStable(d.fragments, func(i, j int) bool {
+		return d.fragments[i].offset < d.fragments[j].offset
+	})
+	end := 0
+	for _, f := range d.fragments {
+		if f.offset > end {
+			return false
+		}
+		if f.offset+len(f.data) > end {
+			end = f.offset + len(f.data)
+		}
+	}
+	return end >= d.size
+}
+
+// build returns the reassembled datagram, with the flags, fragment offset,
+// total length and checksum of the header updated. Overlapping data is taken
+// from the fragment with the lowest offset.
+func (d *datagram) build() []byte {
+	hdrLen := len(d.header)
+	out := make([]byte, hdrLen+d.size)
+	copy(out, d.header)
+	for i := len(d.fragments) - 1; i >= 0; i-- {
+		f := d.fragments[i]
+		if f.offset < d.size {
+			copy(out[hdrLen+f.offset:], f.data)
+		}
+	}
+	binary.BigEndian.PutUint16(out[2:], uint16(len(out)))
+	// Keep the don't fragment flag
+	out[6] &= 0x40
+	out[7] = 0
+	binary.BigEndian.PutUint16(out[10:], 0)
+	var sum uint32
+	for i := 0; i+1 < hdrLen; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(out[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(out[10:], ^uint16(sum))
+	return out
+}
+
+// expire forgets the datagrams started before the timeout, and returns the
+// frames of their buffered fragments.
+func (r *Reassembler) expire(now time.Time) []Frame {
+	var flushed []Frame
+	for key, d := range r.datagrams {
+		if now.Sub(d.firstSeen) > r.timeout {
+			if !d.overflowed {
+				r.stats.Expired++
+				flushed = append(flushed, r.flush(d)...)
+			}
+			r.remove(key, d)
+		}
+	}
+	sort.SliceStable(flushed, func(i, j int) bool {
+		return flushed[i].Ci.Timestamp.Before(flushed[j].Ci.Timestamp)
+	})
+	return flushed
+}
@@ -0,0 +1,172 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TestReassembler tests the reassembly of a datagram from fragments received
+// out of order.
+func TestReassembler(t *testing.T) {
+	payload := make([]byte, 40)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	fragment := func(offset, end int, more bool) (*layers.IPv4, []byte) {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: 42, Protocol: layers.IPProtocolUDP,
+			FragOffset: uint16(offset / 8), SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("198.51.100.7")}
+		if more {
+			ip.Flags = layers.IPv4MoreFragments
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, ip, gopacket.Payload(payload[offset:end])); err != nil {
+			t.Fatal(err)
+		}
+		decoded := &layers.IPv4{}
+		if err := decoded.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+			t.Fatal(err)
+		}
+		return decoded, buf.Bytes()
+	}
+
+	r := NewReassembler(time.Minute)
+	now := time.Now()
+	ci := gopacket.CaptureInfo{Timestamp: now}
+	for _, offsets := range [][2]int{{32, 40}, {0, 16}} {
+		ip, frame := fragment(offsets[0], offsets[1], offsets[0] == 0)
+		if datagram, _, buffered := r.Add(ip, frame, ci); datagram != nil || !buffered {
+			t.Fatal("Incomplete datagram reassembled")
+		}
+	}
+	ip, frame := fragment(16, 32, true)
+	datagram, _, _ := r.Add(ip, frame, ci)
+	if datagram == nil {
+		t.Fatal("Complete datagram not reassembled")
+	}
+	ip = &layers.IPv4{}
+	if err := ip.DecodeFromBytes(datagram, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if IsFragment(ip) || ip.Length != 60 {
+		t.Errorf("Reassembled header with flags %v, offset %d and length %d", ip.Flags, ip.FragOffset, ip.Length)
+	}
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(datagram[i:]))
+	}
+	if sum = sum&0xffff + sum>>16; sum != 0xffff {
+		t.Errorf("Invalid header checksum")
+	}
+	if !bytes.Equal(ip.Payload, payload) {
+		t.Errorf("Reassembled payload %x", ip.Payload)
+	}
+
+	// Incomplete datagrams are given up after the timeout, their fragments
+	// being processed on their own
+	ip, frame = fragment(0, 16, true)
+	r.Add(ip, frame, ci)
+	_, flushed, _ := r.Add(ip, frame, gopacket.CaptureInfo{Timestamp: now.Add(2 * time.Minute)})
+	if len(flushed) != 1 || !bytes.Equal(flushed[0].Data, frame) || !flushed[0].Ci.Timestamp.Equal(now) {
+		t.Errorf("Flushed %d frames of the expired datagram", len(flushed))
+	}
+	for _, d := range r.datagrams {
+		if len(d.fragments) != 1 {
+			t.Error("Fragments of an expired datagram kept")
+		}
+	}
+	if stats := r.Stats(); stats.Reassembled != 1 || stats.Expired != 1 || stats.Fragments != 1 {
+		t.Errorf("Stats %+v", stats)
+	}
+}
+
+// TestReassemblerBytes tests that overlapping fragments can not buffer more
+// than maxBufferedBytes.
+func TestReassemblerBytes(t *testing.T) {
+	// First fragments of datagrams that are never complete
+	frame := make([]byte, 60020)
+	fragment := func(id uint16) *layers.IPv4 {
+		ip := &layers.IPv4{Version: 4, IHL: 5, Id: id, Protocol: layers.IPProtocolUDP, Flags: layers.IPv4MoreFragments,
+			SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("198.51.100.7")}
+		ip.Contents = frame[:20]
+		ip.Payload = frame[20:]
+		return ip
+	}
+	r := NewReassembler(time.Minute)
+	ci := gopacket.CaptureInfo{Timestamp: time.Now()}
+	refused := false
+	for id := uint16(0); id < 16; id++ {
+		for i := 0; i < maxFragments; i++ {
+			if _, _, buffered := r.Add(fragment(id), frame, ci); !buffered {
+				refused = true
+			}
+		}
+	}
+	if !refused || r.bytes > maxBufferedBytes {
+		t.Fatalf("%d bytes buffered", r.bytes)
+	}
+
+	// The bytes of expired datagrams are released
+	ci.Timestamp = ci.Timestamp.Add(2 * time.Minute)
+	if _, _, buffered := r.Add(fragment(1000), frame, ci); !buffered || r.bytes != len(frame) {
+		t.Errorf("%d bytes buffered after the timeout", r.bytes)
+	}
+}
+
+// TestReassemblerOverflow tests that all the fragments of a datagram exceeding
+// the limits are processed on their own.
+func TestReassemblerOverflow(t *testing.T) {
+	fragment := func(offset int) (*layers.IPv4, []byte) {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: 42, Protocol: layers.IPProtocolUDP, Flags: layers.IPv4MoreFragments,
+			FragOffset: uint16(offset / 8), SrcIP: net.ParseIP("192.0.2.1"), DstIP: net.ParseIP("198.51.100.7")}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, ip, gopacket.Payload(make([]byte, 8))); err != nil {
+			t.Fatal(err)
+		}
+		decoded := &layers.IPv4{}
+		if err := decoded.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+			t.Fatal(err)
+		}
+		return decoded, buf.Bytes()
+	}
+
+	r := NewReassembler(time.Minute)
+	ci := gopacket.CaptureInfo{Timestamp: time.Now()}
+	var frames [][]byte
+	for i := 0; i < maxFragments; i++ {
+		ip, frame := fragment(i * 8)
+		frames = append(frames, frame)
+		if _, flushed, buffered := r.Add(ip, frame, ci); !buffered || len(flushed) != 0 {
+			t.Fatalf("Fragment %d not buffered", i)
+		}
+	}
+	ip, frame := fragment(maxFragments * 8)
+	_, flushed, buffered := r.Add(ip, frame, ci)
+	if buffered || len(flushed) != maxFragments {
+		t.Fatalf("Flushed %d fragments of the datagram exceeding the limits", len(flushed))
+	}
+	for i, f := range flushed {
+		if !bytes.Equal(f.Data, frames[i]) {
+			t.Errorf("Flushed fragment %d is %x instead of %x", i, f.Data, frames[i])
+		}
+	}
+	if r.bytes != 0 {
+		t.Errorf("%d bytes still buffered", r.bytes)
+	}
+
+	// The later fragments are not buffered either
+	ip, frame = fragment((maxFragments + 1) * 8)
+	if _, flushed, buffered := r.Add(ip, frame, ci); buffered || len(flushed) != 0 {
+		t.Error("Later fragment of the datagram buffered")
+	}
+	if stats := r.Stats(); stats.Overflowed != 1 || stats.Fragments != maxFragments+2 || stats.Expired != 0 {
+		t.Errorf("Stats %+v", stats)
+	}
+}
@@ -0,0 +1,225 @@
+package network
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	TunnelGRE    = "gre"
+	TunnelVXLAN  = "vxlan"
+	TunnelGENEVE = "geneve"
+	TunnelGTPU   = "gtp-u"
+	TunnelIPinIP = "ip-in-ip"
+)
+
+const (
+	// UDP destination ports of the tunnels
+	vxlanPort  = 4789
+	genevePort = 6081
+	gtpuPort   = 2152
+	// Maximum number of nested tunnels decoded
+	maxTunnelDepth = 4
+)
+
+// Tunnel is the encapsulation of a packet carried by another one
+type Tunnel struct {
+	// One of the Tunnel* constants, empty if the packet is not a tunnel
+	Kind string
+	// Tunnel header preceding the carried packet, empty for IP-in-IP
+	Header []byte
+	// First layer of the carried packet: Ethernet, IPv4 or IPv6
+	First gopacket.LayerType
+	// Carried packet, as in the tunnel
+	Data []byte
+	// Decoded carried packet, nil if it could not be decoded
+	Inner *Packet
+}
+
+// ipDecoder wraps the decoder of an IP header so that a DecodingLayerParser
+// stops after it when it carries another IP header (IP-in-IP), which would
+// otherwise overwrite it. The carried header is decoded as a tunnel.
+type ipDecoder struct {
+	gopacket.DecodingLayer
+}
+
+func (d ipDecoder) NextLayerType() gopacket.LayerType {
+	next := d.DecodingLayer.NextLayerType()
+	if next == layers.LayerTypeIPv4 || next == layers.LayerTypeIPv6 {
+		return gopacket.LayerTypeZero
+	}
+	return next
+}
+
+// newParser creates the parser of the layers of pkt, starting at first.
+func newParser(first gopacket.LayerType, pkt *Packet) *gopacket.DecodingLayerParser {
+	return gopacket.NewDecodingLayerParser(first, pkt.Eth, new(layers.Dot1Q), new(MPLSStack),
+		ipDecoder{pkt.Ip4}, ipDecoder{pkt.Ip6}, ipDecoder{pkt.Ip6Ext}, pkt.Tcp, pkt.Udp, pkt.Icmp4, pkt.Icmp6, pkt.Payload)
+}
+
+// ipPayload returns the upper layer protocol of a packet and its data, after
+// the IPv6 extension headers.
+func ipPayload(pkt *Packet) (layers.IPProtocol, []byte) {
+	if pkt.IsIPv4 {
+		return pkt.Ip4.Protocol, pkt.Ip4.Payload
+	}
+	// The hop-by-hop header is not part of the payload of the IPv6 layer
+	first := pkt.Ip6.NextHeader
+	if pkt.Ip6.HopByHop != nil {
+		first = pkt.Ip6.HopByHop.NextHeader
+	}
+	headers, protocol, err := ParseIPv6Extensions(first, pkt.Ip6.Payload, nil)
+	if err != nil {
+		return protocol, nil
+	}
+	data := pkt.Ip6.Payload
+	for _, h := range headers {
+		data = data[len(h.Data):]
+	}
+	return protocol, data
+}
+
+// ParseTunnel returns the tunnel of a packet, if it is a GRE (RFC 2784, RFC
+// 2890), VXLAN (RFC 7348), GENEVE (RFC 8926), GTP-U or IP-in-IP packet. The
+// carried packet is not decoded.
+func ParseTunnel(pkt *Packet) (Tunnel, bool) {
+	if pkt.IsFrag || pkt.IsTCP || pkt.IsICMP4 || pkt.IsICMP6 || !pkt.IsIPv4 && !pkt.IsIPv6 {
+		return Tunnel{}, false
+	}
+	if pkt.IsUDP {
+		data := pkt.Udp.Payload
+		switch pkt.DstPort {
+		case vxlanPort:
+			// The VNI must be valid
+			if len(data) >= 8 && data[0]&0x08 != 0 {
+				return Tunnel{Kind: TunnelVXLAN, Header: data[:8], First: layers.LayerTypeEthernet, Data: data[8:]}, true
+			}
+		case genevePort:
+			return parseGENEVE(data)
+		case gtpuPort:
+			return parseGTPU(data)
+		}
+		return Tunnel{}, false
+	}
+
+	protocol, data := ipPayload(pkt)
+	switch protocol {
+	case layers.IPProtocolIPv4:
+		return Tunnel{Kind: TunnelIPinIP, First: layers.LayerTypeIPv4, Data: data}, true
+	case layers.IPProtocolIPv6:
+		return Tunnel{Kind: TunnelIPinIP, First: layers.LayerTypeIPv6, Data: data}, true
+	case layers.IPProtocolGRE:
+		return parseGRE(data)
+	}
+	return Tunnel{}, false
+}
+
+// etherTypeLayer returns the layer of the packet carried by a tunnel with the
+// protocol type etherType.
+func etherTypeLayer(etherType layers.EthernetType) (gopacket.LayerType, bool) {
+	switch etherType {
+	case layers.EthernetTypeTransparentEthernetBridging:
+		return layers.LayerTypeEthernet, true
+	case layers.EthernetTypeIPv4:
+		return layers.LayerTypeIPv4, true
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6, true
+	}
+	return gopacket.LayerTypeZero, false
+}
+
+func parseGRE(data []byte) (Tunnel, bool) {
+	if len(data) < 4 {
+		return Tunnel{}, false
+	}
+	flags := binary.BigEndian.Uint16(data)
+	// Version 0, without the deprecated source routing
+	if flags&0x4007 != 0 {
+		return Tunnel{}, false
+	}
+	length := 4
+	// Checksum, key and sequence number fields
+	for _, bit := range []uint16{0x8000, 0x2000, 0x1000} {
+		if flags&bit != 0 {
+			length += 4
+		}
+	}
+	first, ok := etherTypeLayer(layers.EthernetType(binary.BigEndian.Uint16(data[2:])))
+	if !ok || len(data) < length {
+		return Tunnel{}, false
+	}
+	return Tunnel{Kind: TunnelGRE, Header: data[:length], First: first, Data: data[length:]}, true
+}
+
+func parseGENEVE(data []byte) (Tunnel, bool) {
+	if len(data) < 8 || data[0]>>6 != 0 {
+		return Tunnel{}, false
+	}
+	length := 8 + int(data[0]&0x3f)*4
+	first, ok := etherTypeLayer(layers.EthernetType(binary.BigEndian.Uint16(data[2:])))
+	if !ok || len(data) < length {
+		return Tunnel{}, false
+	}
+	return Tunnel{Kind: TunnelGENEVE, Header: data[:length], First: first, Data: data[length:]}, true
+}
+
+func parseGTPU(data []byte) (Tunnel, bool) {
+	// Version 1 G-PDU, carrying a user packet
+	if len(data) < 8 || data[0]>>5 != 1 || data[0]&0x10 == 0 || data[1] != 0xff {
+		return Tunnel{}, false
+	}
+	length := 8
+	if data[0]&0x07 != 0 {
+		// Sequence number, N-PDU number and extension headers
+		length = 12
+		if len(data) < length {
+			return Tunnel{}, false
+		}
+		for next := data[11]; next != 0; {
+			if len(data) < length+1 {
+				return Tunnel{}, false
+			}
+			extLen := int(data[length]) * 4
+			if extLen == 0 || len(data) < length+extLen {
+				return Tunnel{}, false
+			}
+			next = data[length+extLen-1]
+			length += extLen
+		}
+	}
+	// The message length does not count the mandatory header
+	end := 8 + int(binary.BigEndian.Uint16(data[2:]))
+	if end < length || end > len(data) {
+		return Tunnel{}, false
+	}
+	t := Tunnel{Kind: TunnelGTPU, Header: data[:length], Data: data[length:end]}
+	if len(t.Data) == 0 {
+		return Tunnel{}, false
+	}
+	switch t.Data[0] >> 4 {
+	case 4:
+		t.First = layers.LayerTypeIPv4
+	case 6:
+		t.First = layers.LayerTypeIPv6
+	default:
+		return Tunnel{}, false
+	}
+	return t, true
+}
+
+// tunnelDecoder decodes the packets carried by tunnels at a nesting level
+type tunnelDecoder struct {
+	pkt     *Packet
+	parsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+}
+
+func newTunnelDecoder() *tunnelDecoder {
+	d := &tunnelDecoder{pkt: NewPacket(), parsers: make(map[gopacket.LayerType]*gopacket.DecodingLayerParser)}
+	for _, first := range []gopacket.LayerType{layers.LayerTypeEthernet, layers.LayerTypeIPv4, layers.LayerTypeIPv6} {
+		d.parsers[first] = newParser(first, d.pkt)
+	}
+	return d
+}
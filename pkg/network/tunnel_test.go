@@ -0,0 +1,85 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TestTunnels tests that the packets carried by tunnels are decoded
+// without overwriting the outer headers.
+func TestTunnels(t *testing.T) {
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	serialize := func(l ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	eth := func(etherType layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{6, 7, 8, 9, 10, 11},
+			EthernetType: etherType,
+		}
+	}
+	ip := func(protocol layers.IPProtocol, src, dst string) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	}
+	udp := func(dstPort layers.UDPPort, nl gopacket.NetworkLayer) *layers.UDP {
+		u := &layers.UDP{SrcPort: 40000, DstPort: dstPort}
+		u.SetNetworkLayerForChecksum(nl)
+		return u
+	}
+
+	innerIP := ip(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2")
+	inner := serialize(innerIP, udp(2000, innerIP), gopacket.Payload("data"))
+	innerFrame := serialize(eth(layers.EthernetTypeIPv4), gopacket.Payload(inner))
+	outer := func(protocol layers.IPProtocol) *layers.IPv4 {
+		return ip(protocol, "192.0.2.1", "198.51.100.7")
+	}
+	outerUDP := outer(layers.IPProtocolUDP)
+	gtpu := []byte{0x30, 0xff, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(gtpu[2:], uint16(len(inner)))
+
+	tests := []struct {
+		kind string
+		data []byte
+	}{
+		{TunnelIPinIP, serialize(eth(layers.EthernetTypeIPv4), outer(layers.IPProtocolIPv4), gopacket.Payload(inner))},
+		{TunnelGRE, serialize(eth(layers.EthernetTypeIPv4), outer(layers.IPProtocolGRE),
+			gopacket.Payload(append([]byte{0, 0, 0x08, 0}, inner...)))},
+		{TunnelVXLAN, serialize(eth(layers.EthernetTypeIPv4), outerUDP, udp(vxlanPort, outerUDP),
+			gopacket.Payload(append([]byte{0x08, 0, 0, 0, 0, 0, 1, 0}, innerFrame...)))},
+		{TunnelGENEVE, serialize(eth(layers.EthernetTypeIPv4), outerUDP, udp(genevePort, outerUDP),
+			gopacket.Payload(append([]byte{0, 0, 0x65, 0x58, 0, 0, 1, 0}, innerFrame...)))},
+		{TunnelGTPU, serialize(eth(layers.EthernetTypeIPv4), outerUDP, udp(gtpuPort, outerUDP),
+			gopacket.Payload(append(gtpu, inner...)))},
+	}
+	tp := &Reader{}
+	for _, test := range tests {
+		pkt := NewPacket()
+		decoded := []gopacket.LayerType{}
+		newParser(layers.LayerTypeEthernet, pkt).DecodeLayers(test.data, &decoded)
+		isValid, err := tp.classify(pkt, decoded, 0)
+		if !isValid || err != nil {
+			t.Errorf("%s: packet not valid, %v", test.kind, err)
+			continue
+		}
+		if pkt.SrcIP != "192.0.2.1" || pkt.DstIP != "198.51.100.7" {
+			t.Errorf("%s: outer addresses %s > %s", test.kind, pkt.SrcIP, pkt.DstIP)
+		}
+		if pkt.Tunnel.Kind != test.kind || pkt.Tunnel.Inner == nil {
+			t.Errorf("%s: tunnel %q not decoded", test.kind, pkt.Tunnel.Kind)
+			continue
+		}
+		in := pkt.Tunnel.Inner
+		if in.SrcIP != "10.0.0.1" || in.DstIP != "10.0.0.2" || !in.IsUDP || in.DstPort != 2000 {
+			t.Errorf("%s: carried packet %s > %s:%d", test.kind, in.SrcIP, in.DstIP, in.DstPort)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/wontoniii/traffic-anonymization/pkg/anonymization"
 	"github.com/wontoniii/traffic-anonymization/pkg/network"
 )
 
@@ -23,6 +24,18 @@ type ParserStats struct {
 	PktDrop uint64
 }
 
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+type ReassemblyStats struct {
+	Reassembled uint64
+	Expired     uint64
+	Overflowed  uint64
+	Fragments   uint64
+}
+
 type OutJson struct {
 	Version string
 	Conf    string
@@ -93,3 +106,141 @@ func (cp *IfStatsPrinter) Run() {
 func (cp *IfStatsPrinter) Stop() {
 	cp.end <- true
 }
+
+type CacheStatsPrinter struct {
+	AModule  *anonymization.AModule
+	lastTime int64
+	end      chan bool
+	name     string
+}
+
+func NewCacheStatsPrinter(am *anonymization.AModule, name string) *CacheStatsPrinter {
+	cp := new(CacheStatsPrinter)
+	cp.AModule = am
+	cp.name = name
+	return cp
+}
+
+func (cp *CacheStatsPrinter) Type() string {
+	return "CacheStatsPrinter"
+}
+
+func (cp *CacheStatsPrinter) Init() error {
+	cp.lastTime = time.Now().Unix()
+	return nil
+}
+
+func (cp *CacheStatsPrinter) Generate() []byte {
+	endTime := time.Now().Unix()
+	hits, misses := cp.AModule.CacheStats()
+
+	cacheData, _ := json.Marshal(CacheStats{
+		Hits:   hits,
+		Misses: misses,
+	})
+
+	outJson := OutJson{
+		Version: "0.1",
+		Conf:    "--",
+		Type:    cp.Type(),
+		TsStart: cp.lastTime,
+		TsEnd:   endTime,
+		Data:    cacheData,
+	}
+
+	cp.lastTime = endTime
+
+	b, _ := json.Marshal(outJson)
+	return b
+}
+
+func (cp *CacheStatsPrinter) Run() {
+	cp.end = make(chan bool, 1)
+	ticker := time.NewTicker(time.Duration(1 * time.Minute))
+	for {
+		select {
+		case <-cp.end:
+			return
+		case <-ticker.C:
+			s := cp.Generate()
+			err := os.WriteFile(fmt.Sprintf("%s%s%s", "/tmp/", cp.name, "_cachestats.out"), s, 0644)
+			if err != nil {
+				log.Fatalf("Something went wrong writing statistics: %s", err)
+			}
+		}
+	}
+}
+
+func (cp *CacheStatsPrinter) Stop() {
+	cp.end <- true
+}
+
+type ReassemblyStatsPrinter struct {
+	Reassembler *network.Reassembler
+	lastTime    int64
+	end         chan bool
+	name        string
+}
+
+func NewReassemblyStatsPrinter(r *network.Reassembler, name string) *ReassemblyStatsPrinter {
+	cp := new(ReassemblyStatsPrinter)
+	cp.Reassembler = r
+	cp.name = name
+	return cp
+}
+
+func (cp *ReassemblyStatsPrinter) Type() string {
+	return "ReassemblyStatsPrinter"
+}
+
+func (cp *ReassemblyStatsPrinter) Init() error {
+	cp.lastTime = time.Now().Unix()
+	return nil
+}
+
+func (cp *ReassemblyStatsPrinter) Generate() []byte {
+	endTime := time.Now().Unix()
+	s := cp.Reassembler.Stats()
+
+	reassemblyData, _ := json.Marshal(ReassemblyStats{
+		Reassembled: s.Reassembled,
+		Expired:     s.Expired,
+		Overflowed:  s.Overflowed,
+		Fragments:   s.Fragments,
+	})
+
+	outJson := OutJson{
+		Version: "0.1",
+		Conf:    "--",
+		Type:    cp.Type(),
+		TsStart: cp.lastTime,
+		TsEnd:   endTime,
+		Data:    reassemblyData,
+	}
+
+	cp.lastTime = endTime
+
+	b, _ := json.Marshal(outJson)
+	return b
+}
+
+func (cp *ReassemblyStatsPrinter) Run() {
+	cp.end = make(chan bool, 1)
+	ticker := time.NewTicker(time.Duration(1 * time.Minute))
+	for {
+		select {
+		case <-cp.end:
+			return
+		case <-ticker.C:
+			s := cp.Generate()
+			err := os.WriteFile(fmt.Sprintf("%s%s%s", "/tmp/", cp.name, "_reassemblystats.out"), s, 0644)
+			if err != nil {
+				log.Fatalf("Something went wrong writing statistics: %s", err)
+			}
+		}
+	}
+}
+
+func (cp *ReassemblyStatsPrinter) Stop() {
+	cp.end <- true
+}